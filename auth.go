@@ -0,0 +1,110 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrBadSignature is returned by CheckSignedURL for a bad signature
+	ErrBadSignature = errors.New("bad signature")
+	// ErrExpired is returned by CheckSignedURL for an expired URL
+	ErrExpired = errors.New("signed URL expired")
+)
+
+// returns whether the token is one of the tokens (in constant time)
+func validToken(tokens []string, token string) bool {
+	ok := 0
+	for _, t := range tokens {
+		ok |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	return token != "" && ok == 1
+}
+
+// CanRead returns whether the bearer token grants read access to the realm
+// (everybody can read if no read_tokens are configured)
+func (c Config) CanRead(token string) bool {
+	return len(c.ReadTokens) == 0 || validToken(c.ReadTokens, token)
+}
+
+// CanWrite returns whether the bearer token grants write access to the realm
+// (everybody can write if no write_tokens are configured)
+func (c Config) CanWrite(token string) bool {
+	return len(c.WriteTokens) == 0 || validToken(c.WriteTokens, token)
+}
+
+// CanAdmin returns whether the bearer token grants access to the admin
+// endpoints (nobody has it if no admin_tokens are configured)
+func (c Config) CanAdmin(token string) bool {
+	return validToken(c.AdminTokens, token)
+}
+
+// returns the signature of the path with the given expiry
+func signature(key, path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL returns path (i.e. /realm/key) with the query parameters
+// (expires, signature) which grant read access till expires
+func SignURL(realm, path string, expires time.Time) (string, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return "", err
+	}
+	if conf.SignKey == "" {
+		return "", fmt.Errorf("no sign_key for %s", realm)
+	}
+	exp := expires.Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(exp, 10))
+	q.Set("signature", signature(conf.SignKey, path, exp))
+	return path + "?" + q.Encode(), nil
+}
+
+// CheckSignedURL checks the signature of the path, with the query
+// parameters returned by SignURL
+func (c Config) CheckSignedURL(path string, query url.Values) error {
+	sig, exp := query.Get("signature"), query.Get("expires")
+	if c.SignKey == "" || sig == "" || exp == "" {
+		return ErrBadSignature
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(c.SignKey, path, expires))) {
+		return ErrBadSignature
+	}
+	if time.Now().Unix() > expires {
+		return ErrExpired
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/tgulacsi/go-cdb"
+	"github.com/tgulacsi/go-locking"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// report of a consistency check
+type CheckReport struct {
+	Realm    string
+	Tars     int      // tars checked
+	Objects  int      // objects read
+	Skipped  int      // objects of the compressed cold tars (not read)
+	Problems []string // the inconsistencies found
+}
+
+func (r *CheckReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *CheckReport) String() string {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "%s: checked %d tars, %d objects (%d skipped), %d problems\n",
+		r.Realm, r.Tars, r.Objects, r.Skipped, len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(buf, "  %s\n", p)
+	}
+	return buf.String()
+}
+
+// Check checks the consistency of the realm's tars and indexes: every object
+// of each tar's cdb is read (and decoded) and its size is compared with its info,
+// the L00 links and the higher level cdbs must point to existing tars.
+// The objects of the compressed cold tars are not read.
+//
+// The index dir is locked only while the list of the tars is taken and the
+// indexes are checked, then for each tar while its objects are read; the
+// tars merged or moved away since are skipped.
+//
+// The inconsistencies are collected in the report; the returned error is
+// for the failures of the check itself (and ErrCanceled).
+func Check(realm string, opts *CompactOptions) (*CheckReport, error) {
+	report := &CheckReport{Realm: realm}
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return report, err
+	}
+	tarfns, err := checkIndexes(conf, realm, report)
+	if err != nil {
+		return report, err
+	}
+	for _, tarfn := range tarfns {
+		if opts.canceled() {
+			return report, ErrCanceled
+		}
+		if err = checkTar(conf, tarfn, report); err != nil {
+			return report, err
+		}
+		opts.progress("checked %s", filepath.Base(tarfn))
+	}
+	logger.Infof("checked %s: %d tars, %d objects, %d problems", realm, report.Tars,
+		report.Objects, len(report.Problems))
+	return report, nil
+}
+
+// reads the objects of the tar, with the index dir locked
+func checkTar(conf Config, tarfn string, report *CheckReport) error {
+	locks, err := locking.FLockDirs(conf.IndexDir)
+	if err != nil {
+		return err
+	}
+	defer locks.Unlock()
+	if !tarExists(tarfn) { // merged or moved since
+		return nil
+	}
+	report.Tars++
+	return checkTarObjects(conf, tarfn, report)
+}
+
+// returns the tars of the realm, and checks the L00 links and the higher
+// level cdbs against them, with the index dir locked
+func checkIndexes(conf Config, realm string, report *CheckReport) ([]string, error) {
+	locks, err := locking.FLockDirs(conf.IndexDir)
+	if err != nil {
+		return nil, err
+	}
+	defer locks.Unlock()
+
+	tars := make(map[string]bool, 64)
+	tarfns := make([]string, 0, 64)
+	listTar := func(uuid, tarfn string) error {
+		if tars[filepath.Base(tarfn)] { // compressed and thawed cold tar
+			return nil
+		}
+		tars[filepath.Base(tarfn)] = true
+		tarfns = append(tarfns, tarfn)
+		return nil
+	}
+	if err = walkTarFiles(realm, conf.TarDir, listTar); err == nil && conf.ColdDir != "" {
+		err = walkTarFiles(realm, conf.ColdDir, listTar)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkCdbFiles(realm, conf.IndexDir, func(level int, fn string) error {
+		if level == 0 {
+			if _, err := os.Stat(fn); err != nil {
+				report.problem("%s: dangling link (%s)", fn, err)
+			}
+			return nil
+		}
+		fh, err := os.Open(fn)
+		if err != nil {
+			report.problem("%s: %s", fn, err)
+			return nil
+		}
+		defer fh.Close()
+		return cdb.DumpMap(fh, func(elt cdb.Element) error {
+			if isBookKey(elt.Key) && !tars[BytesToStr(elt.Data)] {
+				report.problem("%s: book %s points to missing tar %s", fn, elt.Key, elt.Data)
+			}
+			return nil
+		})
+	})
+	return tarfns, err
+}
+
+// reads each object of the tar's cdb
+func checkTarObjects(conf Config, tarfn string, report *CheckReport) error {
+	cdb_fn := tarfn + ".cdb"
+	fh, err := os.Open(cdb_fn)
+	if err != nil {
+		report.problem("%s: %s", cdb_fn, err)
+		return nil
+	}
+	defer fh.Close()
+	// the compressed cold tars would have to be thawed
+	cold := !fileExists(tarfn)
+	return cdb.DumpMap(fh, func(elt cdb.Element) error {
+		key, err := UUIDFromBytes(elt.Key)
+		if err != nil {
+			report.problem("%s: bad key %q: %s", cdb_fn, elt.Key, err)
+			return nil
+		}
+		info, err := ReadInfo(bytes.NewReader(elt.Data))
+		if err != nil {
+			report.problem("%s: bad info of %s: %s", cdb_fn, key, err)
+			return nil
+		} else if info.Key != key {
+			report.problem("%s: info of %s has key %s", cdb_fn, key, info.Key)
+		}
+		if cold {
+			report.Skipped++
+			return nil
+		}
+		report.Objects++
+		if e := checkObject(conf, key, cdb_fn, info); e != nil {
+			report.problem("%s: %s: %s", cdb_fn, key, e)
+		}
+		return nil
+	})
+}
+
+// reads (and decodes) the data of the object, compares its size with the info's
+func checkObject(conf Config, key UUID, cdb_fn string, info Info) error {
+	_, reader, err := getFromCdb(conf, key, cdb_fn)
+	if err != nil {
+		if _, ok := err.(*refMovedError); ok { // checked at the referenced object
+			return nil
+		}
+		return err
+	}
+	if c, ok := reader.(*closer); ok {
+		defer c.Close()
+	} else if c, ok := reader.(io.Closer); ok {
+		defer c.Close()
+	}
+	if reader, err = Decode(reader, info.Get("Content-Encoding")); err != nil {
+		return err
+	}
+	n, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return err
+	}
+	if info.Get(InfoPref+"Chunks") != "" { // the data is the manifest
+		return nil
+	}
+	if size := info.Get(InfoPref + "Original-Size"); size != "" {
+		if awaited, e := strconv.ParseInt(strings.TrimSpace(size), 10, 64); e == nil && n != awaited {
+			return fmt.Errorf("size mismatch: read %d bytes, awaited %s", n, size)
+		}
+	}
+	return nil
+}
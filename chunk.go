@@ -0,0 +1,258 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Objects bigger than Config.ChunkSize are stored as chunks: each chunk is
+// an object on its own (with its own info and data), and the object's data
+// is a manifest listing the chunks' keys, one per line.
+// The info of such a manifest has an X-Aostor-Chunks header.
+
+// reads at most conf.ChunkSize bytes from r into a chunk, until r is exhausted.
+// If the whole data fits into one chunk, it is written into dfn, and no chunks
+// are returned.
+func putChunks(conf Config, parent UUID, dfn string, r *bufio.Reader) (chunks []UUID, stored int64, err error) {
+	defer func() {
+		if err != nil {
+			removeChunks(conf.StagingDir, chunks)
+			chunks = nil
+		}
+	}()
+	parent_s := parent.String()
+	for i := 0; ; i++ {
+		key, e := NewUUID()
+		if e != nil {
+			err = e
+			return
+		}
+		key_s := key.String()
+		base := filepath.Join(conf.StagingDir, key_s[:2], key_s)
+		if err = os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+			return
+		}
+		hsh := conf.ContentHashFunc()
+		cnt := NewCounter()
+		cr := io.TeeReader(io.LimitReader(r, int64(conf.ChunkSize)),
+			io.MultiWriter(hsh, cnt))
+		if _, err = compressFile(base+SuffData, cr, conf.CompressMethod); err != nil {
+			_ = os.Remove(base + SuffData)
+			return
+		}
+		_, e = r.Peek(1)
+		if e != nil && e != io.EOF {
+			_ = os.Remove(base + SuffData)
+			err = e
+			return
+		}
+		if i == 0 && e == io.EOF {
+			// fits into one chunk
+			if err = os.Rename(base+SuffData, dfn); err != nil {
+				_ = os.Remove(base + SuffData)
+			}
+			return nil, fileSize(dfn), err
+		}
+
+		fs := fileSize(base + SuffData)
+		info := Info{Key: key}
+		info.SetFilename(fmt.Sprintf("%s.%d", parent_s, i), "application/octet-stream")
+		if conf.CompressMethod != "" {
+			info.Add("Content-Encoding", conf.CompressMethod)
+		}
+		info.Add(InfoPref+"Chunk-Of", parent_s)
+		info.Add(InfoPref+"Chunk-Index", fmt.Sprintf("%d", i))
+		info.Add(InfoPref+"Original-Size", fmt.Sprintf("%d", cnt.Num))
+		info.Add(InfoPref+"Stored-Size", fmt.Sprintf("%d", fs))
+		info.Add(InfoPref+"Content-"+conf.ContentHash,
+			fmt.Sprintf("%x", hsh.Sum(nil)))
+		chunks = append(chunks, key)
+		if err = writeInfoFile(base+SuffInfo, info); err != nil {
+			return
+		}
+		stored += fs
+		logger.Debugf("stored chunk %d of %s as %s (%d bytes)", i, parent_s, key_s, fs)
+		if e == io.EOF {
+			break
+		}
+	}
+	return
+}
+
+// removes the (staged) chunks - used for cleanup after a failed Put
+func removeChunks(stagingDir string, chunks []UUID) {
+	for _, key := range chunks {
+		key_s := key.String()
+		base := filepath.Join(stagingDir, key_s[:2], key_s)
+		for _, end := range []string{SuffInfo, SuffData} {
+			if err := os.Remove(base + end); err != nil && !os.IsNotExist(err) {
+				logger.Errorf("cannot remove chunk %s: %s", base+end, err)
+			}
+		}
+	}
+}
+
+// writes the chunks' keys into dfn, one per line
+func writeManifest(dfn string, chunks []UUID) error {
+	fh, err := os.OpenFile(dfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	for _, key := range chunks {
+		if _, err = fh.Write([]byte(key.String() + "\n")); err != nil {
+			_ = fh.Close()
+			return err
+		}
+	}
+	_ = fh.Sync()
+	return fh.Close()
+}
+
+// reads back the chunks' keys written by writeManifest
+func readManifest(r io.Reader) ([]UUID, error) {
+	chunks := make([]UUID, 0, 16)
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			key, e := UUIDFromString(line)
+			if e != nil {
+				return nil, e
+			}
+			chunks = append(chunks, key)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// reads the chunks of an object one after the other, retrieving them lazily
+type chunkReader struct {
+	realm     string
+	keys      []UUID
+	cur       io.Reader
+	chunkSize int64 // the size of each but the last chunk (0: unknown)
+}
+
+// returns a reader concatenating the chunks listed in the manifest of the
+// object with the given info
+func newChunkReader(realm string, info Info, manifest io.Reader) (*chunkReader, error) {
+	keys, err := readManifest(manifest)
+	closeReader(manifest)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize, _ := strconv.ParseInt(info.Get(InfoPref+"Chunk-Size"), 10, 64)
+	return &chunkReader{realm: realm, keys: keys, chunkSize: chunkSize}, nil
+}
+
+// drops the whole chunks of the first n bytes (if none has been read yet),
+// returns the number of bytes still to be skipped
+func (cr *chunkReader) skip(n int64) int64 {
+	if cr.cur != nil || cr.chunkSize <= 0 {
+		return n
+	}
+	whole := n / cr.chunkSize
+	if whole > int64(len(cr.keys)) {
+		whole = int64(len(cr.keys))
+	}
+	cr.keys = cr.keys[whole:]
+	return n - whole*cr.chunkSize
+}
+
+// Skip skips the first n bytes of the data returned by Get (or GetRaw, if
+// not encoded): the whole chunks of a chunked object are not even read.
+func Skip(data io.Reader, n int64) error {
+	if cr, ok := asChunkReader(data); ok {
+		n = cr.skip(n)
+	}
+	if n <= 0 {
+		return nil
+	}
+	_, err := io.CopyN(ioutil.Discard, data, n)
+	return err
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	for {
+		if cr.cur == nil {
+			if len(cr.keys) == 0 {
+				return 0, io.EOF
+			}
+			key := cr.keys[0]
+			cr.keys = cr.keys[1:]
+			if _, cr.cur, err = get(cr.realm, key); err != nil {
+				logger.Errorf("cannot get chunk %s@%s: %s", key, cr.realm, err)
+				cr.cur = nil
+				return 0, err
+			}
+		}
+		n, err = cr.cur.Read(p)
+		if err == io.EOF {
+			closeReader(cr.cur)
+			cr.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.cur != nil {
+		closeReader(cr.cur)
+		cr.cur = nil
+	}
+	cr.keys = nil
+	return nil
+}
+
+// returns the chunkReader of the data returned by Get (wrapped for the metrics)
+func asChunkReader(data io.Reader) (*chunkReader, bool) {
+	if c, ok := data.(*countingReadCloser); ok {
+		data = c.Reader
+	}
+	cr, ok := data.(*chunkReader)
+	return cr, ok
+}
+
+// closes the reader, if it is closable
+func closeReader(r io.Reader) {
+	switch c := r.(type) {
+	case io.Closer:
+		_ = c.Close()
+	case *closer:
+		c.Close()
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// the errors of CompactAll, per realm
+type CompactErrors map[string]error
+
+func (e CompactErrors) Error() string {
+	realms := make([]string, 0, len(e))
+	for realm := range e {
+		realms = append(realms, realm)
+	}
+	sort.Strings(realms)
+	buf := bytes.NewBuffer(nil)
+	for i, realm := range realms {
+		if i > 0 {
+			buf.WriteString("; ")
+		}
+		fmt.Fprintf(buf, "%s: %s", realm, e[realm])
+	}
+	return buf.String()
+}
+
+// CompactAll compacts every realm of the config, with opts.Workers
+// (or the [compact] workers option) realms concurrently. Each realm's
+// compaction takes its realm's locks (as Compact does), so a concurrent
+// compaction of the same realm is waited for.
+//
+// Returns the reports per realm, and a CompactErrors if any of them failed.
+// onChange is called at most once at a time.
+func CompactAll(onChange NotifyFunc, opts *CompactOptions) (map[string]*CompactReport, error) {
+	conf, err := ReadConf("", "")
+	if err != nil {
+		return nil, err
+	}
+	workers := int(conf.CompactWorkers)
+	if opts != nil && opts.Workers > 0 {
+		workers = opts.Workers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if onChange != nil {
+		var changeLock sync.Mutex
+		oco := onChange
+		onChange = func() {
+			changeLock.Lock()
+			defer changeLock.Unlock()
+			oco()
+		}
+	}
+	return compactRealms(conf.Realms, workers, func(realm string) (*CompactReport, error) {
+		return Compact(realm, onChange, opts)
+	})
+}
+
+// calls compact for the realms, with workers realms concurrently,
+// collecting the reports and the errors per realm
+func compactRealms(realms []string, workers int,
+	compact func(realm string) (*CompactReport, error)) (map[string]*CompactReport, error) {
+	reports := make(map[string]*CompactReport, len(realms))
+	errs := make(CompactErrors, 4)
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	todo := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for realm := range todo {
+				logger.Infof("compacting %s", realm)
+				report, err := compact(realm)
+				lock.Lock()
+				reports[realm] = report
+				if err != nil {
+					logger.Errorf("error compacting %s: %s", realm, err)
+					errs[realm] = err
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, realm := range realms {
+		todo <- realm
+	}
+	close(todo)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return reports, errs
+	}
+	return reports, nil
+}
@@ -23,11 +23,11 @@ import (
 	"fmt"
 	//"io"
 	"errors"
+	"github.com/tgulacsi/aostor/uuid"
 	"github.com/tgulacsi/go-cdb"
 	"github.com/tgulacsi/go-locking"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 )
@@ -39,110 +39,124 @@ const (
 
 var checkMerge bool = false
 
+// isBookKey reports whether key is a book id ("/%d") of a higher level cdb.
+// Object keys are always uuid.Length bytes long, and may start with '/', too.
+func isBookKey(key []byte) bool {
+	return len(key) != uuid.Length && len(key) > 0 && key[0] == '/'
+}
+
 //Compact compacts the index cdbs
-func CompactIndices(realm string, level uint, onChange func(), alreadyLocked bool) error {
+//
+//With opts.DryRun, only reports which cdbs would be merged.
+func CompactIndices(realm string, level uint, onChange func(), alreadyLocked bool,
+	opts *CompactOptions) (*CompactReport, error) {
+	report := &CompactReport{Realm: realm, DryRun: opts.dryRun()}
 	conf, err := ReadConf("", realm)
 	if err != nil {
-		return err
+		return report, err
 	}
 	if !alreadyLocked {
 		if locks, err := locking.FLockDirs(conf.IndexDir); err != nil {
-			return err
+			return report, err
 		} else {
 			defer locks.Unlock()
 		}
 	}
 
-	var n int
-	for level < 100 && fileExists(filepath.Join(conf.IndexDir, fmt.Sprintf("L%02d"))) {
-		n, err = compactLevel(level, conf.IndexDir, conf.IndexThreshold)
+	strategy, err := NewCompactionStrategy(conf.IndexStrategy, conf.IndexWindow)
+	if err != nil {
+		return report, err
+	}
+	var merges []IndexMerge
+	for level < 100 && fileExists(filepath.Join(conf.IndexDir, fmt.Sprintf("L%02d", level))) {
+		if opts.canceled() {
+			err = ErrCanceled
+			break
+		}
+		merges, err = compactLevel(level, conf.IndexDir, conf.IndexThreshold, strategy,
+			report.DryRun)
+		report.IndexMerges = append(report.IndexMerges, merges...)
 		if err != nil {
 			logger.Errorf("compactLevel(%s, %s, %s): %s", level, conf.IndexDir, conf.IndexThreshold, err)
-			return err
-		} else if n == 0 {
+			return report, err
+		}
+		if !report.DryRun {
+			opts.progress("L%02d: %d merges", level, len(merges))
+		}
+		if len(merges) == 0 && !report.DryRun {
 			break
 		}
 		level++
 	}
-	if onChange != nil {
+	if onChange != nil && !report.DryRun {
 		onChange()
 	}
-	return nil
+	return report, err
 }
 
 func strNow() string {
 	return strings.Replace(strings.Replace(time.Now().Format(time.RFC3339), "-", "", -1), ":", "", -1)
 }
 
-func compactLevel(level uint, index_dir string, threshold uint) (int, error) {
-	num := 0
+//merges the cdbs of the level into the next level, as the strategy decides.
+//With dryRun, only returns the merges to be done.
+func compactLevel(level uint, index_dir string, threshold uint, strategy CompactionStrategy,
+	dryRun bool) ([]IndexMerge, error) {
+	groups, err := planLevel(level, index_dir, threshold, strategy)
+	if err != nil || len(groups) == 0 {
+		return nil, err
+	}
+	dest_dir := filepath.Join(index_dir, fmt.Sprintf("L%02d", level+1))
+	merges := make([]IndexMerge, 0, len(groups))
+	for _, fbuf := range groups {
+		uuid, err := NewUUID()
+		if err != nil {
+			logger.Criticalf("cannot generate uuid: %s", err)
+			return merges, err
+		}
+		dest_cdb_fn := filepath.Join(dest_dir, strNow()[:15]+"-"+uuid.String()+".cdb")
+		merge := IndexMerge{Level: level, Dest: dest_cdb_fn,
+			Sources: make([]string, 0, len(fbuf))}
+		for _, fn := range fbuf {
+			if fn != "" {
+				merge.Sources = append(merge.Sources, fn)
+			}
+		}
+		if !dryRun {
+			err = mergeCdbs(dest_cdb_fn, fbuf, level, uint(len(fbuf)), true)
+			if err != nil {
+				logger.Errorf("mergeCdbs(%s, %s, %d, %d, %t): %s", dest_cdb_fn, fbuf, level, len(fbuf), true, err)
+				return merges, err
+			}
+		}
+		merges = append(merges, merge)
+	}
+	return merges, nil
+}
+
+//returns the groups of cdbs of the level to be merged, by the strategy
+func planLevel(level uint, index_dir string, threshold uint, strategy CompactionStrategy) ([][]string, error) {
 	path := filepath.Join(index_dir, fmt.Sprintf("L%02d", level))
 	files_a, err := filepath.Glob(filepath.Join(path, "*.cdb"))
 	if err != nil {
 		logger.Errorf("cannot list files in %s: %s", path, err)
-		return 0, err
+		return nil, err
 	}
-	files := make(sizedFilenames, 0, 1024)
+	files := make([]CdbFile, 0, len(files_a))
 	for _, fn := range files_a {
 		if fn == "" {
 			continue
 		}
-		fsize := fileSize(fn)
-		if fsize > MIN_CDB_SIZE {
-			files = append(files, &sizedFilename{fn, fsize})
-		}
-	}
-	length := uint(len(files))
-	if length <= threshold {
-		return 0, nil
-	}
-	sort.Sort(bySizeReversed{files})
-	dest_dir := filepath.Join(index_dir, fmt.Sprintf("L%02d", level+1))
-	lskip := uint(0)
-	for lskip < length {
-		fbuf := make([]string, threshold)
-		j := 0
-		size := int64(0)
-		askip := uint(0)
-		for i, sizedfn := range files[lskip:] {
-			if size+sizedfn.size < MAX_CDB_SIZE {
-				// if !fileExists(sizedfn.filename) {
-				// 	logger.Warn("compactLevel: %s not exists!", sizedfn.filename)
-				// 	continue
-				// }
-				fbuf[j] = sizedfn.filename
-				j++
-				size += sizedfn.size
-				//delete(files, i)
-				if uint(j) >= threshold {
-					fbuf = fbuf[:j]
-					break
-				}
-			} else {
-				if askip == 0 {
-					askip = uint(i)
-				}
-			}
-		}
-		if askip == 0 {
-			askip = uint(len(fbuf))
-		}
-		lskip += askip
-
-		uuid, err := NewUUID()
+		fi, err := os.Stat(fn)
 		if err != nil {
-			logger.Criticalf("cannot generate uuid: %s", err)
-			return 0, err
+			logger.Warnf("cannot stat %s: %s", fn, err)
+			continue
 		}
-		dest_cdb_fn := filepath.Join(dest_dir, strNow()[:15]+"-"+uuid.String()+".cdb")
-		err = mergeCdbs(dest_cdb_fn, fbuf, level, threshold, true)
-		if err != nil {
-			logger.Errorf("mergeCdbs(%s, %s, %s, %s, %s): %s", dest_cdb_fn, fbuf, level, threshold, true, err)
-			return 0, err
+		if fi.Size() > MIN_CDB_SIZE {
+			files = append(files, CdbFile{Name: fn, Size: fi.Size(), ModTime: fi.ModTime()})
 		}
-		num += len(fbuf)
 	}
-	return num, nil
+	return strategy.Plan(level, files, threshold), nil
 }
 
 type sizedFilename struct {
@@ -165,7 +179,8 @@ func (s bySizeReversed) Less(i, j int) bool {
 //merges cdbs
 ///%02d is a book id, which exists as key and value, too.
 //The key's value is the tar file's name
-func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, threshold uint, move bool) error {
+//On error, the destination cdb is removed, and the sources are left untouched.
+func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, threshold uint, move bool) (err error) {
 	if uint(len(source_cdb_files)) < threshold {
 		return nil
 	}
@@ -179,8 +194,18 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 	cw, err := cdb.NewWriter(dest_cdb_fn)
 	if err != nil {
 		logger.Errorf("cannot open dest cdb %s: %s", dest_cdb_fn, err)
-		return err
+		return &ErrCorruptIndex{File: dest_cdb_fn, Err: err}
 	}
+	cwClosed, merged := false, false
+	defer func() {
+		if err != nil && !merged {
+			if !cwClosed {
+				_ = cw.Close()
+			}
+			logger.Errorf("removing %s: %s", dest_cdb_fn, err)
+			_ = os.Remove(dest_cdb_fn)
+		}
+	}()
 	booknum := 0
 	var book_id []byte
 	var books map[string]string
@@ -199,10 +224,6 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 		n := 0
 		if level == 0 {
 			book_id = StrToBytes(fmt.Sprintf("/%d", booknum))
-			if book_id[0] != '/' {
-				logger.Criticalf("book_id=%s not starts with /??", book_id)
-				os.Exit(1)
-			}
 			booknum++
 			//FIXME: store only the relative path?
 			logger.Tracef("put(%s,%s)", book_id, sfn)
@@ -213,10 +234,10 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 		} else {
 			books = make(map[string]string, threshold<<(3*level))
 		}
-		sfh, err := os.Open(sfn)
-		if err != nil {
-			logger.Errorf("cannot open source cdb %s: %s", sfn, err)
-			return err
+		sfh, e := os.Open(sfn)
+		if e != nil {
+			logger.Errorf("cannot open source cdb %s: %s", sfn, e)
+			return &ErrCorruptIndex{File: sfn, Err: e}
 		}
 		cr := make(chan cdb.Element, 1)
 		go cdb.DumpToChan(cr, sfh)
@@ -227,6 +248,9 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 				break
 			}
 			logger.Tracef("elt=%s", elt)
+			if err != nil { // drain the channel
+				continue
+			}
 			if level == 0 {
 				logger.Tracef("put(%s,%s)", elt.Key, book_id)
 				cw.PutPair(elt.Key, book_id)
@@ -235,7 +259,7 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 				}
 				n++
 			} else {
-				if elt.Key[0] == '/' {
+				if isBookKey(elt.Key) {
 					bs := fmt.Sprintf("/%d", booknum)
 					books[BytesToStr(elt.Key)] = bs
 					book_id = StrToBytes(bs)
@@ -246,7 +270,9 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 					if _, ok := books[BytesToStr(elt.Data)]; !ok {
 						logger.Criticalf("level %d, unknown book %s of %s from %s (known: %+v)",
 							level, elt.Data, elt.Key, sfh.Name(), books)
-						os.Exit(1)
+						err = &ErrCorruptIndex{File: sfn, Key: BytesToStr(elt.Key),
+							Err: fmt.Errorf("unknown book %s", elt.Data)}
+						continue
 					}
 					cw.PutPair(elt.Key, StrToBytes(books[BytesToStr(elt.Data)]))
 					if checkMerge {
@@ -257,6 +283,9 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 			}
 		}
 		_ = sfh.Close()
+		if err != nil {
+			return err
+		}
 		if move {
 			tbd = append(tbd, sfn)
 		}
@@ -264,15 +293,18 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 			lengths[sfn] = n
 		}
 	}
-	_ = cw.Close()
+	cwClosed = true
+	if err = cw.Close(); err != nil {
+		return &ErrCorruptIndex{File: dest_cdb_fn, Err: err}
+	}
 	if !fileExists(dest_cdb_fn) {
-		return errors.New("cdb " + dest_cdb_fn + " not exists!")
+		return &ErrCorruptIndex{File: dest_cdb_fn, Err: errors.New("cdb " + dest_cdb_fn + " not exists!")}
 	}
 	if checkMerge {
-		fh, err := os.Open(dest_cdb_fn)
-		if err != nil {
+		fh, e := os.Open(dest_cdb_fn)
+		if e != nil {
 			logger.Criticalf("cannot open %s", dest_cdb_fn)
-			os.Exit(1)
+			return &ErrCorruptIndex{File: dest_cdb_fn, Err: e}
 		}
 		cr := make(chan cdb.Element, 1)
 		go cdb.DumpToChan(cr, fh)
@@ -282,18 +314,23 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 			if !ok {
 				break
 			}
-			if elt.Key[0] != '/' {
+			if !isBookKey(elt.Key) {
 				n++
 				k := BytesToStr(elt.Key)
 				_, ok := check[k]
 				if ok {
 					delete(check, k)
-				} else {
+				} else if err == nil {
 					logger.Criticalf("CheckMerge error: %s in merged db, but not in checklist", k)
-					os.Exit(1)
+					err = &ErrCorruptIndex{File: dest_cdb_fn, Key: k,
+						Err: errors.New("in merged db, but not in checklist")}
 				}
 			}
 		}
+		_ = fh.Close()
+		if err != nil {
+			return err
+		}
 		length_sum := 0
 		for _, i := range lengths {
 			length_sum += i
@@ -302,9 +339,13 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 			length_sum, length_sum == n)
 		if len(check) > 0 {
 			logger.Criticalf("CheckMerge error: checklist not empty: %s", check)
-			os.Exit(1)
+			for k, sfn := range check {
+				return &ErrCorruptIndex{File: sfn, Key: k,
+					Err: fmt.Errorf("%d keys missing from the merged db", len(check))}
+			}
 		}
 	}
+	merged = true // from now on, the sources are removed
 	if move {
 		for _, fn := range tbd {
 			logger.Infof("deleting %s", fn)
@@ -319,6 +360,14 @@ func mergeCdbs(dest_cdb_fn string, source_cdb_files []string, level uint, thresh
 	return nil
 }
 
+//Returns the modification time of the file, zero time on error
+func fileModTime(fn string) time.Time {
+	if fi, err := os.Stat(fn); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
 //Returns the size of the file, -1 on error
 func fileSize(fn string) int64 {
 	if fh, err := os.Open(fn); err == nil {
@@ -21,14 +21,17 @@ package aostor
 
 import (
 	"archive/tar"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/tgulacsi/go-cdb"
 	"github.com/tgulacsi/go-locking"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type NotifyFunc func()
@@ -37,26 +40,70 @@ var StopIteration = errors.New("StopIteration")
 var AlreadyLocked = errors.New("AlreadyLocked")
 
 // compacts staging dir: moves info and data files to tar; calls CompactIndices
-func Compact(realm string, onChange NotifyFunc) error {
+//
+// Returns the report of what has been done (with opts.DryRun: would be done).
+func Compact(realm string, onChange NotifyFunc, opts *CompactOptions) (*CompactReport, error) {
+	start := time.Now()
+	report, err := compactStaging(realm, onChange, opts)
+	if !opts.dryRun() {
+		realmStats(realm).compact(start, err)
+	}
+	return report, err
+}
+
+func compactStaging(realm string, onChange NotifyFunc, opts *CompactOptions) (*CompactReport, error) {
+	report := &CompactReport{Realm: realm, DryRun: opts.dryRun()}
 	conf, err := ReadConf("", realm)
 	if err != nil {
-		return err
+		return report, err
 	}
 	if locks, err := locking.FLockDirs(conf.IndexDir, conf.StagingDir); err != nil {
 		logger.Error("cannot lock dir: ", err)
-		return err
+		return report, err
 	} else {
 		defer locks.Unlock()
 	}
 
-	n := DeDup(conf.StagingDir, conf.ContentHash, true)
-	logger.Infof("DeDup: %d", n)
+	if report.DryRun {
+		if err = planStaging(conf, report); err != nil {
+			return report, err
+		}
+		ir, err := CompactIndices(realm, 0, nil, true, opts)
+		report.IndexMerges = ir.IndexMerges
+		return report, err
+	}
+
+	if err = recoverCompaction(conf); err != nil {
+		return report, err
+	}
+	j, err := openJournal(conf.IndexDir)
+	if err != nil {
+		return report, err
+	}
+	finished := false
+	defer func() { _ = j.Close(finished) }()
+
+	report.DedupLinks, err = DeDup(conf.StagingDir, conf.ContentHash, true)
+	if err != nil {
+		logger.Error("error deduplicating staging: ", err)
+		return report, err
+	}
+	logger.Infof("DeDup: %d", report.DedupLinks)
+	hashes, err := openHashIndex(conf)
+	if err != nil {
+		logger.Error("cannot read the hash index: ", err)
+		return report, err
+	}
 
 	var is, ds int64
 	tthresh_mb := float64(conf.TarThreshold) / 1024 / 1024
 	size := uint64(0)
+	var oldest time.Time
 
 	var hamster listDirFunc = func(elt fElt) error {
+		if mtime := fileModTime(elt.infoFn); oldest.IsZero() || mtime.Before(oldest) {
+			oldest = mtime
+		}
 		is, ds = fileSize(elt.infoFn), int64(0)
 		if elt.isSymlink {
 			ds = int64(1)
@@ -71,53 +118,122 @@ func Compact(realm string, onChange NotifyFunc) error {
 		return nil
 	}
 
-	for {
+	for flush := false; !flush; {
+		if opts.canceled() { // the tars created so far are complete
+			finished = true
+			return report, ErrCanceled
+		}
 		size = uint64(0)
+		oldest = time.Time{}
 
 		if err = listDirMap(conf.StagingDir, conf.ContentHash, hamster); err != nil {
 			logger.Error("error compacting staging: ", err)
-			return err
+			return report, err
 		}
 
 		logger.Debugf("size=%.03fMb >?= %.03fMb", float64(size)/1024/1024, tthresh_mb)
 		if size < conf.TarThreshold {
-			break
+			if !mustFlush(conf, size, oldest) {
+				break
+			}
+			logger.Infof("flushing staging (%.03fMb), oldest from %s",
+				float64(size)/1024/1024, oldest)
+			flush = true
 		}
-		uuid, err := NewUUID()
+		tarfn_a, err := newTarName(conf, realm)
 		if err != nil {
-			return err
-		}
-		uuid_s := uuid.String()
-		tarfn := realm + "-" + strNow()[:15] + "-" + uuid_s + ".tar"
-		logger.Info("creating ", tarfn)
-		dn := filepath.Join(conf.TarDir, uuid_s[:2])
-		if err = os.MkdirAll(dn, 0755); err != nil {
-			return err
-		}
-		tarfn_a := filepath.Join(dn, tarfn)
-		if err = CreateTar(tarfn_a, conf.StagingDir, conf.TarThreshold, true); err != nil {
-			return err
+			return report, err
 		}
-		if err = os.Symlink(tarfn_a+".cdb",
-			filepath.Join(conf.IndexDir, "L00", tarfn+".cdb")); err != nil {
-			return err
-		}
-		if err = cleanupStaging(conf.StagingDir, tarfn_a); err != nil {
-			return err
+		logger.Info("creating ", tarfn_a)
+		tr, err := buildTar(conf, j, hashes, tarfn_a)
+		if err != nil {
+			return report, err
 		}
+		report.Tars = append(report.Tars, tr)
+		opts.progress("created %s (%d objects)", tr.Name, tr.Objects)
 		if onChange != nil {
 			onChange()
 		}
 	}
+	finished = true
 	logger.Info("staging compacted successfully")
-	if err = CompactIndices(realm, 0, onChange, true); err != nil {
+	ir, err := CompactIndices(realm, 0, onChange, true, opts)
+	report.IndexMerges = ir.IndexMerges
+	if err != nil {
 		logger.Error("error compacting indices: ", err)
-		return err
+		return report, err
 	}
 	logger.Info("indices compacted successfully")
+	return report, nil
+}
+
+// fills the report with the tars Compact would create, estimating their sizes
+// the same way as Compact does - counting the data of the duplicates as symlinks.
+func planStaging(conf Config, report *CompactReport) error {
+	var err error
+	if report.DedupLinks, err = dedup(conf.StagingDir, conf.ContentHash, true, true, nil); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, 1024)
+	var is, ds int64
+	var oldest time.Time
+	tr := TarReport{Name: "#1"}
+	var hamster listDirFunc = func(elt fElt) error {
+		if mtime := fileModTime(elt.infoFn); oldest.IsZero() || mtime.Before(oldest) {
+			oldest = mtime
+		}
+		is, ds = fileSize(elt.infoFn), int64(0)
+		if elt.isSymlink || elt.contentHash != "" && seen[elt.contentHash] {
+			ds = int64(1)
+		} else {
+			ds = fileSize(elt.dataFn)
+		}
+		if elt.contentHash != "" {
+			seen[elt.contentHash] = true
+		}
+		tr.Objects++
+		tr.Size += BS + inBs(is) + BS + inBs(ds)
+		if tr.Size >= conf.TarThreshold {
+			report.Tars = append(report.Tars, tr)
+			tr = TarReport{Name: fmt.Sprintf("#%d", len(report.Tars)+1)}
+			oldest = time.Time{}
+		}
+		return nil
+	}
+	if err = listDirMap(conf.StagingDir, conf.ContentHash, hamster); err != nil {
+		logger.Error("error listing staging: ", err)
+		return err
+	}
+	if mustFlush(conf, tr.Size, oldest) {
+		report.Tars = append(report.Tars, tr)
+		return nil
+	}
+	logger.Infof("%s: %d objects (%d bytes) remain in staging", report.Realm,
+		tr.Objects, tr.Size)
 	return nil
 }
 
+// returns the path of a new tar in the realm's tar dir (creating its subdir)
+func newTarName(conf Config, realm string) (string, error) {
+	uuid, err := NewUUID()
+	if err != nil {
+		return "", err
+	}
+	uuid_s := uuid.String()
+	dn := filepath.Join(conf.TarDir, uuid_s[:2])
+	if err = os.MkdirAll(dn, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dn, realm+"-"+strNow()[:15]+"-"+uuid_s+".tar"), nil
+}
+
+// returns whether the staged objects (of the given size, the oldest from
+// the given time) must be shoveled into a tar, even if it is below TarThreshold
+func mustFlush(conf Config, size uint64, oldest time.Time) bool {
+	return size > 0 && conf.FlushAge > 0 && !oldest.IsZero() &&
+		time.Since(oldest) >= conf.FlushAge
+}
+
 // func uuidKey(key string) []byte {
 // 	uuid, err := UUIDFromString(key)
 // 	if err != nil {
@@ -129,21 +245,34 @@ func Compact(realm string, onChange NotifyFunc) error {
 
 // Copies files from the given directory into a given tar file
 func CreateTar(tarfn string, dirname string, sizeLimit uint64, alreadyLocked bool) error {
+	_, err := createTar(tarfn, dirname, sizeLimit, 0, nil, alreadyLocked)
+	return err
+}
+
+// Copies files from the given directory into a given tar file,
+// and embeds data smaller than inlineLimit into the infos stored in the cdb.
+// Returns the number of objects written.
+// On error, the partial output is removed, and the staging dir is left untouched.
+func createTar(tarfn string, dirname string, sizeLimit uint64, inlineLimit int64,
+	hashes *hashIndex, alreadyLocked bool) (objects int, err error) {
 	if !alreadyLocked {
 		if locks, err := locking.FLockDirs(dirname); err != nil {
 			logger.Error("cannot lock dir: ", err)
-			return err
+			return 0, err
 		} else {
 			defer locks.Unlock()
 		}
 	}
 
 	links := make(map[string]uint64, 32)
+	// data already stored in another tar (global deduplication)
+	refs := make(map[string]hashEntry, 8)
+	tarfn_b := strings.TrimSuffix(filepath.Base(tarfn), SuffTemp)
 	buf := make([]fElt, 0, 8)
 	symlinks, err := harvestSymlinks(dirname)
 	if err != nil {
 		logger.Error("cannot read symlinks beforehand: ", err)
-		return err
+		return 0, err
 	}
 	// logger.Info("symlinks=", symlinks)
 	if len(symlinks) == 0 {
@@ -153,22 +282,53 @@ func CreateTar(tarfn string, dirname string, sizeLimit uint64, alreadyLocked boo
 	cfh, err := os.OpenFile(tarfn+".cdb", os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		logger.Errorf("cannot open %s.cdb: %s", tarfn, err)
-		return err
+		return 0, &ErrTarWrite{File: tarfn + ".cdb", Err: err}
 	}
 	defer cfh.Close()
 	adder, closer, err := cdb.MakeFactory(cfh)
 	if err != nil {
 		logger.Criticalf("cannot create factory: %s", err)
-		return err
+		_ = os.Remove(tarfn + ".cdb")
+		return 0, &ErrTarWrite{File: tarfn + ".cdb", Err: err}
 	}
 
 	tw, fh, pos, err := OpenForAppend(tarfn)
 	if err != nil {
 		logger.Error("cannot open %s for append: %s", tarfn, err)
-		return err
+		_ = os.Remove(tarfn + ".cdb")
+		return 0, &ErrTarWrite{File: tarfn, Err: err}
 	}
+	startPos := pos
+	// runs after the closes
+	defer func() {
+		if err != nil {
+			logger.Errorf("removing the partial output of %s: %s", tarfn, err)
+			_ = os.Remove(tarfn + ".cdb")
+			if e := truncateTar(tarfn, startPos); e != nil {
+				logger.Errorf("cannot truncate %s to %d: %s", tarfn, startPos, e)
+			}
+		}
+	}()
 	defer fh.Close()
 	defer tw.Close()
+	tarErr := func(fn string, err error) error {
+		logger.Criticalf("cannot append %s to %s: %s", fn, tarfn, err)
+		return &ErrTarWrite{File: tarfn, Key: fn, Err: err}
+	}
+
+	// adds the info to the cdb, with the data inlined if it is small enough
+	addInfo := func(info Info, dataFn string) error {
+		if inlineLimit > 0 {
+			if err := inlineData(&info, dataFn, inlineLimit); err != nil {
+				return err
+			}
+		}
+		if err := adder(cdb.Element{info.Key.Bytes(), info.Bytes()}); err != nil {
+			return err
+		}
+		objects++
+		return nil
+	}
 
 	var hamster listDirFunc = func(elt fElt) error {
 		if debug2 {
@@ -177,51 +337,77 @@ func CreateTar(tarfn string, dirname string, sizeLimit uint64, alreadyLocked boo
 		if elt.isSymlink {
 			return nil
 		}
-		if !elt.info.Key.IsEmpty() {
+		if elt.dataFn == "" { // a reference (deduplicated at upload)
+			elt.info.Ipos = pos
+			if _, pos, err = appendFile(tw, fh, elt.infoFn); err != nil {
+				return tarErr(elt.infoFn, err)
+			}
+			if err = addInfo(elt.info, ""); err != nil {
+				return tarErr(elt.infoFn, err)
+			}
+		} else if !elt.info.Key.IsEmpty() {
 			elt.info.Ipos = pos
 			_, pos, err = appendFile(tw, fh, elt.infoFn)
 			if err != nil {
-				logger.Criticalf("cannot append %s", elt.infoFn)
-				os.Exit(1)
+				return tarErr(elt.infoFn, err)
 			}
-			elt.info.Dpos = pos
-			links[elt.dataFn] = pos
-			_, pos, err = appendFile(tw, fh, elt.dataFn)
-			if err != nil {
-				logger.Criticalf("cannot append %s", elt.dataFn)
-				os.Exit(1)
+			contentHash := hashes.contentHash(elt.info)
+			ref, isRef := hashes.Get(contentHash)
+			if isRef && inlineLimit > 0 && fileSize(elt.dataFn) < inlineLimit {
+				isRef = false
+			}
+			if isRef {
+				logger.Debugf("%s is stored already as %s in %s", elt.info.Key, ref.Key, ref.Tar)
+				refs[elt.dataFn] = ref
+				setRef(&elt.info, ref)
+			} else {
+				elt.info.Dpos = pos
+				links[elt.dataFn] = pos
+				hashes.Add(contentHash, hashEntry{Tar: tarfn_b, Dpos: pos,
+					Key: elt.info.Key, Encoding: elt.info.Get("Content-Encoding")})
+				_, pos, err = appendFile(tw, fh, elt.dataFn)
+				if err != nil {
+					return tarErr(elt.dataFn, err)
+				}
 			}
 
 			for _, sym := range symlinks[elt.dataFn] {
+				if ref, ok := refs[sym.dataFnOrig]; ok {
+					sym.info.Ipos = pos
+					if _, pos, err = appendFile(tw, fh, sym.infoFn); err != nil {
+						return tarErr(sym.infoFn, err)
+					}
+					setRef(&sym.info, ref)
+					if err = addInfo(sym.info, sym.dataFn); err != nil {
+						return tarErr(sym.infoFn, err)
+					}
+					continue
+				}
 				linkpos, ok := links[sym.dataFnOrig]
 				logger.Tracef("adding %s (symlink of %s) linkpos? %s",
 					sym.info.Key, elt.dataFn, ok)
 				if !ok {
 					buf = append(buf, sym)
-					return nil
+					continue
 				}
 				sym.info.Ipos = pos
 				_, pos, err = appendFile(tw, fh, sym.infoFn)
 				if err != nil {
-					logger.Criticalf("cannot append %s: %s", sym.infoFn, err)
-					os.Exit(1)
+					return tarErr(sym.infoFn, err)
 				}
 				sym.info.Dpos = linkpos
 				_, pos, err = appendLink(tw, fh, sym.dataFn)
 				if err != nil {
-					logger.Criticalf("cannot append %s: %s", sym.dataFn, err)
-					os.Exit(1)
+					return tarErr(sym.dataFn, err)
 				}
-				if err = adder(cdb.Element{sym.info.Key.Bytes(), sym.info.Bytes()}); err != nil {
-					logger.Criticalf("cannot append %s: %s", sym.info, err)
-					os.Exit(1)
+				if err = addInfo(sym.info, sym.dataFn); err != nil {
+					return tarErr(sym.infoFn, err)
 				}
 			}
 			delete(symlinks, elt.dataFn)
 			// c <- cdb.Element{StrToBytes(elt.info.Key), elt.info.Bytes()}
-			if err = adder(cdb.Element{elt.info.Key.Bytes(), elt.info.Bytes()}); err != nil {
-				logger.Criticalf("cannot append %s: %s", elt.info, err)
-				os.Exit(1)
+			if err = addInfo(elt.info, elt.dataFn); err != nil {
+				return tarErr(elt.infoFn, err)
 			}
 		}
 		// logger.Tracef("buf=%s", buf)
@@ -235,7 +421,7 @@ func CreateTar(tarfn string, dirname string, sizeLimit uint64, alreadyLocked boo
 	err = listDirMap(dirname, "", hamster)
 	if err != nil {
 		logger.Criticalf("error listing %s: %s", dirname, err)
-		return err
+		return objects, err
 	}
 	// close(c)
 	// logger.Tracef("buf=%s", buf)
@@ -244,11 +430,12 @@ func CreateTar(tarfn string, dirname string, sizeLimit uint64, alreadyLocked boo
 		elt.info.Ipos = pos
 		_, pos, err = appendFile(tw, fh, elt.infoFn)
 		if err != nil {
-			logger.Criticalf("cannot append %s: %s", elt.infoFn, err)
-			os.Exit(1)
+			return objects, tarErr(elt.infoFn, err)
 		}
 		linkpos, ok := links[elt.dataFnOrig]
-		if !ok {
+		if ref, isRef := refs[elt.dataFnOrig]; isRef {
+			setRef(&elt.info, ref)
+		} else if !ok {
 			logger.Warnf("cannot find linkpos for %s -> %s", elt.dataFn, elt.dataFnOrig)
 			elt.info.Dpos = pos
 			_, pos, err = appendFile(tw, fh, elt.dataFn)
@@ -257,33 +444,76 @@ func CreateTar(tarfn string, dirname string, sizeLimit uint64, alreadyLocked boo
 			_, pos, err = appendLink(tw, fh, elt.dataFn)
 		}
 		if err != nil {
-			logger.Criticalf("cannot append %s", elt.dataFn)
-			os.Exit(1)
+			return objects, tarErr(elt.dataFn, err)
 		}
 		// logger.Debugf("adding ",keyb," to ",)
-		if err = adder(cdb.Element{elt.info.Key.Bytes(), elt.info.Bytes()}); err != nil {
-			logger.Criticalf("error adding %s: %s", elt.info, err)
-			os.Exit(1)
+		if err = addInfo(elt.info, elt.dataFn); err != nil {
+			return objects, tarErr(elt.infoFn, err)
 		}
 	}
 
-	// iw.Close()
-	if err != nil {
-		fmt.Printf("error: %s", err)
-	}
 	err = closer()
 	// err = <-d
 	if err != nil {
 		logger.Errorf("cdbMake error: %s", err)
+		return objects, &ErrTarWrite{File: tarfn + ".cdb", Err: err}
+	}
+	return objects, nil
+}
+
+// truncates the tar back to pos (removes it if pos is zero), and closes it
+// with an end-of-archive
+func truncateTar(tarfn string, pos uint64) error {
+	if pos == 0 {
+		return os.Remove(tarfn)
+	}
+	if err := os.Truncate(tarfn, int64(pos)); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(tarfn, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(make([]byte, 2*BS))
+	if e := fh.Close(); e != nil && err == nil {
+		err = e
 	}
 	return err
 }
 
+// turns the info into a reference to the data stored already in another tar
+func setRef(info *Info, ref hashEntry) {
+	info.Dpos = ref.Dpos
+	info.Add(InfoPref+"Ref-Tar", ref.Tar)
+	info.Add(InfoPref+"Ref-Key", ref.Key.String())
+	if ref.Encoding == "" {
+		info.Del("Content-Encoding")
+	} else {
+		info.Add("Content-Encoding", ref.Encoding)
+	}
+}
+
+// embeds the data of dataFn into the info (X-Aostor-Inline header, base64
+// encoded), if it is smaller than limit.
+// The stored (compressed) size is compared, as that is what is embedded.
+func inlineData(info *Info, dataFn string, limit int64) error {
+	if size := fileSize(dataFn); size < 0 || size >= limit {
+		return nil
+	}
+	data, err := ioutil.ReadFile(dataFn)
+	if err != nil {
+		logger.Errorf("cannot read %s for inlining: %s", dataFn, err)
+		return err
+	}
+	info.Add(InfoPref+"Inline", base64.StdEncoding.EncodeToString(data))
+	return nil
+}
+
 func harvestSymlinks(path string) (map[string][]fElt, error) {
 	dh, err := os.Open(path)
 	if err != nil {
 		logger.Criticalf("cannot open dir %s: %s", path, err)
-		os.Exit(1)
+		return nil, &ErrStagingRead{File: path, Err: err}
 	}
 	defer dh.Close()
 	links := make(map[string][]fElt, 1024)
@@ -303,6 +533,9 @@ func harvestSymlinks(path string) (map[string][]fElt, error) {
 			return nil
 		}
 		bn := fi.Name()
+		if !strings.HasSuffix(bn, SuffLink) { // i.e. staging hash links
+			return nil
+		}
 		origin = FindLinkOrigin(path, true)
 		logger.Debugf("bn=%s linkpath=%s origin=%s", bn, path, origin)
 		if !(strings.HasSuffix(bn, SuffLink) && origin != path &&
@@ -314,13 +547,13 @@ func harvestSymlinks(path string) (map[string][]fElt, error) {
 			dataFn: path, isSymlink: true, dataFnOrig: origin}
 		if ifh, err = os.Open(elt.infoFn); err != nil {
 			logger.Errorf("cannot open info file %s: %s", elt.infoFn, err)
-			return err
+			return &ErrStagingRead{File: elt.infoFn, Err: err}
 		}
 		elt.info, err = ReadInfo(ifh)
 		_ = ifh.Close()
 		if err != nil {
 			logger.Errorf("cannot read info from %s: %s", ifh, err)
-			return err
+			return &ErrStagingRead{File: elt.infoFn, Err: err}
 		}
 
 		if arr, ok := links[elt.dataFnOrig]; !ok || arr == nil {
@@ -398,8 +631,8 @@ func appendLink(tw *tar.Writer, tfh io.Seeker, fn string) (pos1 uint64, pos2 uin
 	return
 }
 
-// removes files already in tar
-func cleanupStaging(path string, tarfn string) error {
+// removes files already in tar (and their staging hash links)
+func cleanupStaging(path string, hash string, tarfn string) error {
 	cfh, err := os.Open(tarfn + ".cdb")
 	if err != nil {
 		return err
@@ -415,6 +648,16 @@ func cleanupStaging(path string, tarfn string) error {
 		uuid_s := uuid.String()
 		base := filepath.Join(path, uuid_s[:2], uuid_s)
 		// logger.Debugf("base %s exists? %s", base, fileExists(base+SuffInfo))
+		if fileExists(base+SuffInfo) && !fileExists(base+SuffData) &&
+			!fileIsSymlink(base+SuffLink) {
+			// a reference (deduplicated at upload)
+			return os.Remove(base + SuffInfo)
+		}
+		defer func() {
+			if info, e := InfoFromBytes(elt.Data); e == nil {
+				removeStagingHash(path, info.Get(InfoPref+"Content-"+hash))
+			}
+		}()
 		if fileExists(base + SuffInfo) {
 			for _, end := range endings {
 				err = os.Remove(base + end)
@@ -466,3 +709,41 @@ func dirCount(dirname string) uint64 {
 	}
 	return n
 }
+
+// statistics of a staging directory
+type StagingStat struct {
+	Count  uint64    // number of objects (infos)
+	Bytes  uint64    // sum of the sizes of the files
+	Oldest time.Time // modification time of the oldest info
+}
+
+// returns the statistics of the realm's staging directory
+func StagingStats(realm string) (stat StagingStat, err error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return
+	}
+	err = Walk(conf.StagingDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			logger.Errorf("cannot list %s: %s", path, err)
+			return nil
+		}
+		if fi.IsDir() {
+			// the content hash links (StagingHashDir), and the uploads in
+			// progress (UploadsDir, and the S3 gateway's) are not staged objects
+			if n := fi.Name(); len(n) > 2 && n[0] == '_' && path != conf.StagingDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		stat.Bytes += uint64(fi.Size())
+		if strings.HasSuffix(fi.Name(), SuffInfo) {
+			stat.Count++
+			if stat.Oldest.IsZero() || fi.ModTime().Before(stat.Oldest) {
+				stat.Oldest = fi.ModTime()
+			}
+		}
+		return nil
+	})
+	return
+}
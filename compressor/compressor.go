@@ -121,7 +121,7 @@ func ExternalCompressCopy(dst io.Writer, src io.Reader, compressMethod string) e
 		return err
 	}
 	if err = cmd.Wait(); err != nil {
-		logger.Fatalf("compressor %s error: %s", cmd, err)
+		logger.Printf("compressor %s error: %s", cmd, err)
 	}
 	return err
 }
@@ -141,7 +141,7 @@ func ExternalDecompressCopy(dst io.Writer, src io.Reader, compressMethod string)
 		return err
 	}
 	if err = cmd.Wait(); err != nil {
-		logger.Fatalf("decompressor %s error: %s", cmd, err)
+		logger.Printf("decompressor %s error: %s", cmd, err)
 	}
 	return err
 }
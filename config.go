@@ -29,27 +29,40 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	DefaultConfigFile     = "aostor.ini"
 	DefaultTarThreshold   = 1000 * (1 << 20) // 1000Mb
+	DefaultChunkSize      = 64 * (1 << 20)   // 64Mb
 	DefaultIndexThreshold = 10               // How many index cdb should be merged
 	DefaultContentHash    = "sha1"
 	DefaultCompressMethod = "gzip"
 	DefaultHostport       = ":8341"
+	DefaultCacheControl   = "public, max-age=31536000, immutable"
+	DefaultS3Region       = "us-east-1"
 	DefaultLogConfFile    = "seelog.xml"
 	TestConfig            = `[dirs]
 base = /tmp/aostor
 staging = %(base)s/#(realm)s/staging
 index = %(base)s/#(realm)s/ndx
 tar = %(base)s/#(realm)s/store
+cold = %(base)s/#(realm)s/cold
 
 [threshold]
 index = 2
 tar = 512
+chunk = 512
+inline = 256
+
+[compact]
+global_dedup = true
+upload_dedup = true
+cold_compress = gzip
 
 [http]
 hostport = :8431
@@ -63,6 +76,18 @@ config = seelog.xml
 `
 )
 
+// how often the server checks the compaction triggers
+const DefaultCompactCheckPeriod = time.Minute
+
+// tars smaller than this percent of TarThreshold are merged by MergeTars
+const DefaultMergeBelow = 50
+
+// number of realms compacted concurrently by CompactAll
+const DefaultCompactWorkers = 2
+
+// the resumable uploads not appended to for this long are removed
+const DefaultUploadExpiry = 24 * time.Hour
+
 var (
 	ConfigFile = DefaultConfigFile
 	configs    = make(map[string]Config, 2) // configs cache
@@ -72,14 +97,58 @@ var (
 // configuration variables, parsed
 type Config struct {
 	StagingDir, IndexDir, TarDir string
+	ColdDir                      string // the old tars are moved here by Tier
+	ColdCompress                 string // Tier compresses the cold tars with this
 	IndexThreshold               uint
 	TarThreshold                 uint64
+	ChunkSize                    uint64
+	InlineThreshold              uint64
 	Hostport                     string
+	CacheControl                 string // Cache-Control of the served objects
 	Realms                       []string
 	ContentHash                  string
 	ContentHashFunc              func() hash.Hash
 	LogConf                      string
 	CompressMethod               string
+	// background compaction (in the server): compact after CompactInterval,
+	// or when staging holds more than CompactStagingBytes bytes or
+	// CompactStagingCount objects, or its oldest object is older than
+	// CompactMaxAge - zero values disable the given trigger.
+	CompactInterval, CompactMaxAge time.Duration
+	CompactStagingBytes            uint64
+	CompactStagingCount            uint64
+	CompactCheckPeriod             time.Duration
+	// staged objects older than this are shoveled into a tar by Compact,
+	// even if the tar would be smaller than TarThreshold (0: disabled)
+	FlushAge time.Duration
+	// MergeTars merges the tars smaller than this percent of TarThreshold
+	MergeBelow uint64
+	// deduplicate against the already shoveled data of the realm, too
+	GlobalDedup bool
+	// deduplicate at upload (Put), against the staging dir and
+	// (with GlobalDedup) the hash index
+	UploadDedup bool
+	// the index compaction strategy (see NewCompactionStrategy),
+	// and the window of the time-window strategy
+	IndexStrategy string
+	IndexWindow   time.Duration
+	// number of realms compacted concurrently by CompactAll
+	CompactWorkers uint64
+	// the bearer tokens granting read and write access (none: open),
+	// and the key of the signed (read) URLs
+	ReadTokens, WriteTokens []string
+	SignKey                 string
+	// the limits of the realm (0: unlimited): the size of an object,
+	// and the sum of the objects' sizes and their number
+	MaxObjectSize, MaxBytes, MaxObjects uint64
+	// the S3 gateway's address (empty: disabled), region and credentials
+	// (access key -> secret key)
+	S3Hostport, S3Region string
+	S3Credentials        map[string]string
+	// the bearer tokens of the admin endpoints (none: only from localhost)
+	AdminTokens []string
+	// the resumable uploads not appended to for this long expire
+	UploadExpiry time.Duration
 }
 
 // reads config file (or ConfigFile if empty), replaces every #(realm)s with the
@@ -111,6 +180,19 @@ func ReadConf(fn string, realm string) (c Config, err error) {
 	return
 }
 
+// re-reads the config file (ConfigFile), and drops the cached configs, so the
+// realms' configs are read again on their next use. The cache is kept on error.
+func ReloadConf() (Config, error) {
+	if _, err := readConf("", "", Config{}); err != nil {
+		logger.Errorf("cannot reload config: %s", err)
+		return Config{}, err
+	}
+	configLock.Lock()
+	configs = make(map[string]Config, 2)
+	configLock.Unlock()
+	return ReadConf("", "")
+}
+
 func readConf(fn string, realm string, common Config) (c Config, err error) {
 	if fn == "" {
 		fn = ConfigFile
@@ -157,6 +239,17 @@ func readConf(fn string, realm string, common Config) (c Config, err error) {
 	if err != nil {
 		return c, err
 	}
+	if conf.HasOption("dirs", "cold") || conf.HasOption("dirs:"+realm, "cold") {
+		if c.ColdDir, err = realmString(conf, "dirs", "cold", realm); err != nil {
+			return c, err
+		}
+		if realm != "" {
+			c.ColdDir = strings.Replace(c.ColdDir, "#(realm)s", realm, -1)
+			if err = os.MkdirAll(c.ColdDir, 0755); err != nil {
+				return c, err
+			}
+		}
+	}
 
 	var i int
 	if common.IndexThreshold > 0 {
@@ -178,11 +271,45 @@ func readConf(fn string, realm string, common Config) (c Config, err error) {
 		if err != nil {
 			logger.Warn("cannot get threshold/tar: ", err)
 			c.TarThreshold = DefaultTarThreshold
+		} else if i < 0 {
+			return c, fmt.Errorf("bad threshold/tar %d: must not be negative", i)
 		} else {
 			c.TarThreshold = uint64(i)
 		}
 	}
 
+	if common.ChunkSize > 0 {
+		c.ChunkSize = common.ChunkSize
+	} else {
+		i, err = conf.Int("threshold", "chunk")
+		if err != nil {
+			logger.Warn("cannot get threshold/chunk: ", err)
+			c.ChunkSize = DefaultChunkSize
+		} else if i < 0 {
+			return c, fmt.Errorf("bad threshold/chunk %d: must not be negative", i)
+		} else {
+			c.ChunkSize = uint64(i)
+		}
+	}
+	// a chunk must fit into a tar
+	if c.TarThreshold > 0 && c.ChunkSize > c.TarThreshold {
+		logger.Infof("chunk size %d is bigger than threshold/tar, using %d",
+			c.ChunkSize, c.TarThreshold)
+		c.ChunkSize = c.TarThreshold
+	}
+
+	if common.InlineThreshold > 0 {
+		c.InlineThreshold = common.InlineThreshold
+	} else {
+		i, err = conf.Int("threshold", "inline")
+		if err != nil {
+			logger.Info("cannot get threshold/inline: ", err)
+			c.InlineThreshold = 0
+		} else {
+			c.InlineThreshold = uint64(i)
+		}
+	}
+
 	if common.Hostport != "" {
 		c.Hostport = common.Hostport
 	} else {
@@ -240,9 +367,199 @@ func readConf(fn string, realm string, common Config) (c Config, err error) {
 		}
 	}
 
+	c.CacheControl = DefaultCacheControl
+	if conf.HasOption("http", "cache_control") || conf.HasOption("http:"+realm, "cache_control") {
+		if c.CacheControl, err = realmString(conf, "http", "cache_control", realm); err != nil {
+			return c, err
+		}
+	}
+
+	if c.UploadExpiry, err = realmDuration(conf, "http", "upload_expiry", realm,
+		DefaultUploadExpiry); err != nil {
+		return c, err
+	}
+
+	if c.ReadTokens, err = realmList(conf, "auth", "read_tokens", realm); err != nil {
+		return c, err
+	}
+	if c.WriteTokens, err = realmList(conf, "auth", "write_tokens", realm); err != nil {
+		return c, err
+	}
+	if conf.HasOption("auth", "sign_key") || conf.HasOption("auth:"+realm, "sign_key") {
+		if c.SignKey, err = realmString(conf, "auth", "sign_key", realm); err != nil {
+			return c, err
+		}
+	}
+
+	if conf.HasOption("s3", "hostport") {
+		if c.S3Hostport, err = conf.String("s3", "hostport"); err != nil {
+			return c, err
+		}
+	}
+	c.S3Region = DefaultS3Region
+	if conf.HasOption("s3", "region") {
+		if c.S3Region, err = conf.String("s3", "region"); err != nil {
+			return c, err
+		}
+	}
+	creds, err := realmList(conf, "s3", "credentials", "")
+	if err != nil {
+		return c, err
+	}
+	c.S3Credentials = make(map[string]string, len(creds))
+	for _, cred := range creds {
+		i := strings.Index(cred, ":")
+		if i <= 0 {
+			return c, fmt.Errorf("bad s3/credentials %q: access_key:secret_key awaited", cred)
+		}
+		c.S3Credentials[cred[:i]] = cred[i+1:]
+	}
+
+	if c.AdminTokens, err = realmList(conf, "auth", "admin_tokens", ""); err != nil {
+		return c, err
+	}
+
+	if c.MaxObjectSize, err = realmUint(conf, "quota", "max_object_size", realm, 0); err != nil {
+		return c, err
+	}
+	if c.MaxBytes, err = realmUint(conf, "quota", "max_bytes", realm, 0); err != nil {
+		return c, err
+	}
+	if c.MaxObjects, err = realmUint(conf, "quota", "max_objects", realm, 0); err != nil {
+		return c, err
+	}
+
+	if c.CompactInterval, err = realmDuration(conf, "compact", "interval", realm, 0); err != nil {
+		return c, err
+	}
+	if c.CompactMaxAge, err = realmDuration(conf, "compact", "max_age", realm, 0); err != nil {
+		return c, err
+	}
+	if c.CompactStagingBytes, err = realmUint(conf, "compact", "staging_bytes", realm, 0); err != nil {
+		return c, err
+	}
+	if c.CompactStagingCount, err = realmUint(conf, "compact", "staging_count", realm, 0); err != nil {
+		return c, err
+	}
+	if c.CompactCheckPeriod, err = realmDuration(conf, "compact", "check", realm,
+		DefaultCompactCheckPeriod); err != nil {
+		return c, err
+	}
+	if c.FlushAge, err = realmDuration(conf, "compact", "flush_age", realm, 0); err != nil {
+		return c, err
+	}
+	if c.MergeBelow, err = realmUint(conf, "compact", "merge_below", realm,
+		DefaultMergeBelow); err != nil {
+		return c, err
+	}
+	if c.CompactWorkers, err = realmUint(conf, "compact", "workers", realm,
+		DefaultCompactWorkers); err != nil {
+		return c, err
+	}
+	if c.GlobalDedup, err = realmBool(conf, "compact", "global_dedup", realm, false); err != nil {
+		return c, err
+	}
+	if c.UploadDedup, err = realmBool(conf, "compact", "upload_dedup", realm, false); err != nil {
+		return c, err
+	}
+	if conf.HasOption("compact", "index_strategy") || conf.HasOption("compact:"+realm, "index_strategy") {
+		if c.IndexStrategy, err = realmString(conf, "compact", "index_strategy", realm); err != nil {
+			return c, err
+		}
+	}
+	if conf.HasOption("compact", "cold_compress") || conf.HasOption("compact:"+realm, "cold_compress") {
+		if c.ColdCompress, err = realmString(conf, "compact", "cold_compress", realm); err != nil {
+			return c, err
+		}
+	}
+	if c.IndexWindow, err = realmDuration(conf, "compact", "index_window", realm,
+		DefaultIndexWindow); err != nil {
+		return c, err
+	}
+	if _, err = NewCompactionStrategy(c.IndexStrategy, c.IndexWindow); err != nil {
+		return c, err
+	}
+
 	return c, err
 }
 
+// returns the comma-separated list option (see realmString),
+// nil if it is not given
+func realmList(conf *config.Config, section, option, realm string) ([]string, error) {
+	if !conf.HasOption(section, option) && !conf.HasOption(section+":"+realm, option) {
+		return nil, nil
+	}
+	s, err := realmString(conf, section, option, realm)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, 2)
+	for _, elt := range strings.Split(s, ",") {
+		if elt = strings.TrimSpace(elt); elt != "" {
+			list = append(list, elt)
+		}
+	}
+	return list, nil
+}
+
+// returns the option from the realm-specific section ("section:realm"),
+// if exists, else from section
+func realmString(conf *config.Config, section, option, realm string) (string, error) {
+	if realm != "" && conf.HasOption(section+":"+realm, option) {
+		return conf.String(section+":"+realm, option)
+	}
+	return conf.String(section, option)
+}
+
+// returns the option (see realmString) as an uint64, or def if not set
+func realmUint(conf *config.Config, section, option, realm string, def uint64) (uint64, error) {
+	if !conf.HasOption(section, option) && !conf.HasOption(section+":"+realm, option) {
+		return def, nil
+	}
+	s, err := realmString(conf, section, option, realm)
+	if err != nil {
+		return def, err
+	}
+	i, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("bad %s/%s for %s: %s", section, option, realm, err)
+	}
+	return i, nil
+}
+
+// returns the option (see realmString) as a bool, or def if not set
+func realmBool(conf *config.Config, section, option, realm string, def bool) (bool, error) {
+	if !conf.HasOption(section, option) && !conf.HasOption(section+":"+realm, option) {
+		return def, nil
+	}
+	s, err := realmString(conf, section, option, realm)
+	if err != nil {
+		return def, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return def, fmt.Errorf("bad %s/%s for %s: %s", section, option, realm, err)
+	}
+	return b, nil
+}
+
+// returns the option (see realmString) as a time.Duration (i.e. "1h30m"),
+// or def if not set
+func realmDuration(conf *config.Config, section, option, realm string, def time.Duration) (time.Duration, error) {
+	if !conf.HasOption(section, option) && !conf.HasOption(section+":"+realm, option) {
+		return def, nil
+	}
+	s, err := realmString(conf, section, option, realm)
+	if err != nil {
+		return def, err
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil {
+		return def, fmt.Errorf("bad %s/%s for %s: %s", section, option, realm, err)
+	}
+	return d, nil
+}
+
 func getDir(conf *config.Config, section string, option string, realm string) (string, error) {
 	path, err := conf.String(section, option)
 	if err != nil {
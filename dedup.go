@@ -28,12 +28,32 @@ import (
 )
 
 // deduplication: replace data with a symlink to a previous data with the same contant-hash-...
-func DeDup(path string, hash string, alreadyLocked bool) int {
+// returns the number of links created
+//
+// The symlink is created before the data is removed, so on error the data
+// stays in the staging dir.
+func DeDup(path string, hash string, alreadyLocked bool) (int, error) {
+	return dedup(path, hash, alreadyLocked, false, nil)
+}
+
+// DeDup of the realm's staging dir, which can be canceled (ErrCanceled)
+// and reports its progress through opts
+func DeDupRealm(realm string, opts *CompactOptions) (int, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return 0, err
+	}
+	return dedup(conf.StagingDir, conf.ContentHash, false, false, opts)
+}
+
+// deduplication - with dryRun, only counts the links to be created
+func dedup(path string, hash string, alreadyLocked bool, dryRun bool,
+	opts *CompactOptions) (int, error) {
 	var err error
 	if !alreadyLocked {
 		if locks, err := locking.FLockDirs(path); err != nil {
 			logger.Errorf("cannot create lock for %s: %s", path, err)
-			return -1
+			return -1, err
 		} else {
 			defer locking.FLocks(locks).Unlock()
 		}
@@ -47,7 +67,10 @@ func DeDup(path string, hash string, alreadyLocked bool) int {
 		if debug2 {
 			logger.Debugf("%s sl? %s lo=%s", elt.contentHash, elt.isSymlink, FindLinkOrigin(elt.dataFn, false))
 		}
-		if elt.contentHash == "" {
+		if opts.canceled() {
+			return ErrCanceled
+		}
+		if elt.contentHash == "" || elt.dataFn == "" {
 			return nil
 		}
 		//only one primal should exist!
@@ -57,18 +80,15 @@ func DeDup(path string, hash string, alreadyLocked bool) int {
 				if same, e := SameFile(elt.dataFnOrig, prim); e != nil {
 					logger.Errorf("cannot check equivalence of %s and %s: %s", elt.dataFnOrig, prim, e)
 					if os.IsNotExist(e) {
-						os.Exit(2)
+						return &ErrDedupLink{File: elt.dataFn, Key: prim, Err: e}
 					}
-				} else if !same {
+				} else if !same && !dryRun {
 					logger.Warnf("already exists differend origin (%s) for %s!",
-						prim, elt.dataFnOrig)
-					if err = os.Remove(elt.dataFn); err != nil {
-						logger.Errorf("cannot remove %s: %s", elt.dataFn, err)
-					}
+						prim, elt.dataFn)
 					destfn := CalculateLink(filepath.Dir(elt.dataFn), prim)
-					if err = os.Symlink(destfn, elt.dataFn); err != nil {
+					if err = replaceSymlink(destfn, elt.dataFn); err != nil {
 						logger.Errorf("cannot create symlink %s for %s", elt.dataFn, destfn)
-						os.Exit(3)
+						return &ErrDedupLink{File: elt.dataFn, Key: destfn, Err: err}
 					}
 				}
 			} else {
@@ -86,13 +106,17 @@ func DeDup(path string, hash string, alreadyLocked bool) int {
 
 	if err = listDirMap(path, hash, hamster); err != nil {
 		logger.Errorf("error listing %s: %s", path, err)
-		return 0
+		return 0, err
 	}
 	var (
 		p    int
 		prim string
 	)
 	for contentHash, elts := range hashes {
+		if opts.canceled() { // the links created so far are complete
+			return n, ErrCanceled
+		}
+		linked := n
 		prim = primals[contentHash]
 		for _, elt := range elts {
 			if prim == "" {
@@ -110,33 +134,54 @@ func DeDup(path string, hash string, alreadyLocked bool) int {
 				// logger.Info("skipping symlink origin: ", prim)
 				continue
 			}
-			if err := os.Remove(elt.dataFn); err != nil {
-				logger.Warnf("cannot remove %s: %s", elt.dataFn, err)
+			if dryRun {
+				n++
 				continue
+			}
+			destfn := CalculateLink(filepath.Dir(elt.dataFn), prim)
+			linkfn := elt.dataFn
+			p = len(linkfn) - 1
+			if linkfn[p:p+len(SuffData)] == SuffData || linkfn[p:p+len(SuffLink)] == SuffLink {
 			} else {
-				destfn := CalculateLink(filepath.Dir(elt.dataFn), prim)
-				linkfn := elt.dataFn
-				p = len(linkfn) - 1
-				if linkfn[p:p+len(SuffData)] == SuffData || linkfn[p:p+len(SuffLink)] == SuffLink {
-				} else {
-					p = strings.LastIndex(linkfn, SuffData)
-					if p < 0 {
-						p = strings.LastIndex(linkfn, SuffLink)
-					}
-				}
-				linkfn = linkfn[:p] + SuffLink
-				logger.Debugf("creating symlink from %s to %s", linkfn, destfn)
-				if err := os.Symlink(destfn, linkfn); err != nil {
-					logger.Warnf("cannot create symlink %s for %s: %s",
-						linkfn, destfn, err)
-					os.Exit(4)
-				} else {
-					n++
+				p = strings.LastIndex(linkfn, SuffData)
+				if p < 0 {
+					p = strings.LastIndex(linkfn, SuffLink)
 				}
 			}
+			linkfn = linkfn[:p] + SuffLink
+			logger.Debugf("creating symlink from %s to %s", linkfn, destfn)
+			if err := replaceSymlink(destfn, linkfn); err != nil {
+				logger.Warnf("cannot create symlink %s for %s: %s",
+					linkfn, destfn, err)
+				return n, &ErrDedupLink{File: linkfn, Key: destfn, Err: err}
+			}
+			if err := os.Remove(elt.dataFn); err != nil {
+				logger.Warnf("cannot remove %s: %s", elt.dataFn, err)
+				_ = os.Remove(linkfn)
+				continue
+			}
+			n++
+		}
+		if n > linked && !dryRun {
+			opts.progress("deduplicated %s (%d links)", contentHash, n-linked)
 		}
 	}
-	return n
+	return n, nil
+}
+
+// creates (atomically) the symlink linkfn pointing to destfn,
+// replacing linkfn if it exists
+func replaceSymlink(destfn, linkfn string) error {
+	tempfn := linkfn + SuffTemp
+	_ = os.Remove(tempfn)
+	if err := os.Symlink(destfn, tempfn); err != nil {
+		return err
+	}
+	if err := os.Rename(tempfn, linkfn); err != nil {
+		_ = os.Remove(tempfn)
+		return err
+	}
+	return nil
 }
 
 // CalculateLink calculates the symbolic link for destfn relative to basedir
@@ -257,7 +302,8 @@ func listDirMap(path string, hash string, hamster listDirFunc) error {
 					break
 				}
 			}
-			if elt.dataFn == "" {
+			// deduplicated at upload into a reference to a tar: no data file
+			if elt.dataFn == "" && info.Get(InfoPref+"Ref-Tar") == "" {
 				logger.Warn("cannot find data file for ", elt.infoFn)
 				return nil
 			}
@@ -0,0 +1,155 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// subdir of the staging dir for the content hash -> staged data symlinks
+const StagingHashDir = "_hashes"
+
+// writes the data into a temp file, and if its content hash is already
+// stored (in the staging dir or, with GlobalDedup, in a tar), writes the info
+// with only a link to that data (a hard link in staging, a reference to a tar).
+// Otherwise, returns the temp file (with info not touched).
+func putDedup(conf Config, info *Info, ifn string, data io.Reader) (tempfn string, deduplicated bool, err error) {
+	dfn := ifn[:len(ifn)-len(SuffInfo)] + SuffData
+	tempfn = dfn + SuffTemp
+	fh, err := os.OpenFile(tempfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return
+	}
+	hsh := conf.ContentHashFunc()
+	n, err := io.Copy(io.MultiWriter(fh, hsh), data)
+	if e := fh.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil || n == 0 {
+		if err != nil {
+			_ = os.Remove(tempfn)
+		}
+		return
+	}
+	contentHash := fmt.Sprintf("%x", hsh.Sum(nil))
+	hashKey := InfoPref + "Content-" + conf.ContentHash
+
+	if orig, ok := stagedInfo(conf.StagingDir, contentHash, hashKey); ok {
+		if err = os.Link(orig.dataFn, dfn); err == nil {
+			// the chunks (if any) of the original are shared, too
+			for _, k := range []string{"Content-Encoding", InfoPref + "Chunks",
+				InfoPref + "Chunk-Size"} {
+				if v := orig.info.Get(k); v != "" {
+					info.Add(k, v)
+				}
+			}
+			info.Add(InfoPref+"Stored-Size", fmt.Sprintf("%d", fileSize(dfn)))
+			deduplicated = true
+		} else {
+			logger.Debugf("cannot link %s to %s: %s", orig.dataFn, dfn, err)
+			err = nil
+		}
+	}
+	if !deduplicated {
+		ref, ok, e := lookupHash(conf, contentHash)
+		if e != nil {
+			logger.Errorf("cannot look up %s in the hash index: %s", contentHash, e)
+		} else if ok {
+			setRef(info, ref)
+			deduplicated = true
+		}
+	}
+	if !deduplicated {
+		return
+	}
+	info.Add(InfoPref+"Original-Size", fmt.Sprintf("%d", n))
+	info.Add(hashKey, contentHash)
+	if err = writeInfoFile(ifn, *info); err != nil {
+		_ = os.Remove(dfn)
+		_ = os.Remove(ifn)
+		return
+	}
+	_ = os.Remove(tempfn)
+	logger.Infof("%s deduplicated at upload (%s)", info.Key, contentHash)
+	return "", true, nil
+}
+
+// returns the path of the staging hash symlink of the content hash
+func stagingHashFn(staging, contentHash string) string {
+	return filepath.Join(staging, StagingHashDir, contentHash[:2], contentHash)
+}
+
+// records that dfn (staged data) has the given content hash
+func addStagingHash(staging, contentHash, dfn string) {
+	if len(contentHash) < 2 {
+		return
+	}
+	linkfn := stagingHashFn(staging, contentHash)
+	if err := os.MkdirAll(filepath.Dir(linkfn), 0755); err != nil {
+		logger.Warnf("cannot create %s: %s", filepath.Dir(linkfn), err)
+		return
+	}
+	if err := replaceSymlink(CalculateLink(filepath.Dir(linkfn), dfn), linkfn); err != nil {
+		logger.Warnf("cannot link %s to %s: %s", linkfn, dfn, err)
+	}
+}
+
+// removes the staging hash symlink of the content hash, if it is dangling
+func removeStagingHash(staging, contentHash string) {
+	if len(contentHash) < 2 {
+		return
+	}
+	if linkfn := stagingHashFn(staging, contentHash); fileIsSymlink(linkfn) && !fileExists(linkfn) {
+		_ = os.Remove(linkfn)
+	}
+}
+
+// returns the staged object with the given content hash
+func stagedInfo(staging, contentHash, hashKey string) (elt fElt, ok bool) {
+	if len(contentHash) < 2 {
+		return
+	}
+	linkfn := stagingHashFn(staging, contentHash)
+	if !fileIsSymlink(linkfn) {
+		return
+	}
+	elt.dataFn = FindLinkOrigin(linkfn, true)
+	if !strings.HasSuffix(elt.dataFn, SuffData) {
+		return
+	}
+	elt.infoFn = elt.dataFn[:len(elt.dataFn)-len(SuffData)] + SuffInfo
+	ifh, err := os.Open(elt.infoFn)
+	if err != nil {
+		if os.IsNotExist(err) { // shoveled since
+			_ = os.Remove(linkfn)
+		}
+		return
+	}
+	elt.info, err = ReadInfo(ifh)
+	_ = ifh.Close()
+	if err != nil || elt.info.Get(hashKey) != contentHash {
+		return
+	}
+	return elt, true
+}
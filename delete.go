@@ -0,0 +1,256 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tgulacsi/go-cdb"
+	"github.com/tgulacsi/go-locking"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// name of the realm's tombstone file (the deleted keys), in the index dir
+const TombstoneFile = "deleted"
+
+// ErrExists is returned by PutNew if the key is already used
+var ErrExists = errors.New("key already exists")
+
+// the realm's deleted keys: an append-only file of "key unixtime" lines
+type tombstones struct {
+	lineFile
+	m map[UUID]time.Time
+}
+
+var (
+	tombstoneCache = make(map[string]*tombstones, 4)
+	tombstoneLock  = sync.Mutex{}
+	// the keys being stored by PutNew (realm/key), so a key cannot be stored twice
+	putNewKeys = make(map[string]bool, 16)
+	putNewLock = sync.Mutex{}
+)
+
+// puts the file under the key in info (which must be given), like PutDedup,
+// but returns ErrExists if the key is already stored, is being stored, or
+// has been deleted (the keys are never reused)
+func PutNew(realm string, info Info, data io.Reader) (key UUID, deduplicated bool, err error) {
+	if info.Key.IsEmpty() {
+		return UUID{}, false, errors.New("PutNew needs a key")
+	}
+	// reserve the key, but do not hold the lock while the data is read
+	rk := realm + "/" + info.Key.String()
+	putNewLock.Lock()
+	if putNewKeys[rk] {
+		putNewLock.Unlock()
+		return info.Key, false, ErrExists
+	}
+	putNewKeys[rk] = true
+	putNewLock.Unlock()
+	defer func() {
+		putNewLock.Lock()
+		delete(putNewKeys, rk)
+		putNewLock.Unlock()
+	}()
+
+	if ok, err := Exists(realm, info.Key); err != nil {
+		return info.Key, false, err
+	} else if ok {
+		return info.Key, false, ErrExists
+	}
+	return PutDedup(realm, info, data)
+}
+
+// returns whether the key is stored (or has been deleted) in the realm.
+// Only the staging dir and the indexes are looked at, the data is not read.
+func Exists(realm string, key UUID) (bool, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return false, err
+	}
+	if _, ok, err := isDeleted(conf, key); err != nil || ok {
+		return ok, err
+	}
+	key_s := key.String()
+	if fileExists(filepath.Join(conf.StagingDir, key_s[:2], key_s+SuffInfo)) {
+		return true, nil
+	}
+	// the levels are walked upwards, and a merge writes the higher level cdb
+	// before removing its sources, so a vanished cdb can be skipped
+	found := false
+	err = walkCdbFiles(realm, conf.IndexDir, func(level int, fn string) error {
+		db, err := cdb.Open(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return &ErrCorruptIndex{File: fn, Err: err}
+		}
+		_, err = db.Data(key.Bytes())
+		_ = db.Close()
+		switch err {
+		case nil:
+			found = true
+			return StopIteration
+		case io.EOF, NotFound:
+			return nil
+		}
+		return &ErrCorruptIndex{File: fn, Key: key_s, Err: err}
+	})
+	if err == StopIteration {
+		err = nil
+	}
+	return found, err
+}
+
+// deletes the key from the realm: records a tombstone, so Get won't find it.
+// The data stays in its tar (append-only!).
+// Returns NotFound if the key is not stored.
+func Delete(realm string, key UUID) error {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	_, reader, err := get(realm, key)
+	if err != nil {
+		return err
+	}
+	if c, ok := reader.(io.Closer); ok {
+		_ = c.Close()
+	}
+	tombstoneLock.Lock()
+	defer tombstoneLock.Unlock()
+	ts, err := readTombstones(conf)
+	if err != nil {
+		return err
+	}
+	if _, ok := ts.m[key]; ok {
+		return NotFound
+	}
+	if err = ts.append([]byte(fmt.Sprintf("%s %d\n", key, time.Now().Unix()))); err != nil {
+		return &ErrCorruptIndex{File: ts.fn, Key: key.String(), Err: err}
+	}
+	logger.Infof("deleted %s@%s", key, realm)
+	return nil
+}
+
+// removes the still staged key from the realm (with its chunks, if they are
+// not shared with a deduplicated object), as if it had never been stored - to
+// roll back a failed upload. Returns NotFound if the key is not in the staging
+// dir (anymore): then it can only be deleted.
+func Unstage(realm string, key UUID) error {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	if locks, err := locking.FLockDirs(conf.IndexDir, conf.StagingDir); err != nil {
+		return err
+	} else {
+		defer locks.Unlock()
+	}
+	key_s := key.String()
+	base := filepath.Join(conf.StagingDir, key_s[:2], key_s)
+	ifh, err := os.Open(base + SuffInfo)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NotFound
+		}
+		return err
+	}
+	info, err := ReadInfo(ifh)
+	_ = ifh.Close()
+	if err != nil {
+		return &ErrCorruptIndex{File: base + SuffInfo, Key: key_s, Err: err}
+	}
+	var chunks []UUID
+	if info.Get(InfoPref+"Chunks") != "" {
+		// the manifest is hard linked by the objects deduplicated to this one
+		if fi, e := os.Stat(base + SuffData); e == nil {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink == 1 {
+				if fh, e := os.Open(base + SuffData); e == nil {
+					chunks, err = readManifest(fh)
+					_ = fh.Close()
+					if err != nil {
+						return &ErrCorruptIndex{File: base + SuffData, Key: key_s, Err: err}
+					}
+				}
+			}
+		}
+	}
+	for _, end := range []string{SuffData, SuffLink, SuffInfo} {
+		if err = os.Remove(base + end); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	removeChunks(conf.StagingDir, chunks)
+	removeStagingHash(conf.StagingDir, info.Get(InfoPref+"Content-"+conf.ContentHash))
+	size, _ := strconv.ParseUint(info.Get(InfoPref+"Original-Size"), 10, 64)
+	subUsage(conf, size)
+	logger.Infof("unstaged %s@%s", key, realm)
+	return nil
+}
+
+// returns whether (and when) the key has been deleted
+func isDeleted(conf Config, key UUID) (time.Time, bool, error) {
+	tombstoneLock.Lock()
+	defer tombstoneLock.Unlock()
+	ts, err := readTombstones(conf)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	t, ok := ts.m[key]
+	return t, ok, nil
+}
+
+// returns the (cached) tombstones of the realm, reading the new lines.
+// Must be called with tombstoneLock held.
+func readTombstones(conf Config) (*tombstones, error) {
+	fn := filepath.Join(conf.IndexDir, TombstoneFile)
+	ts, ok := tombstoneCache[fn]
+	if !ok {
+		ts = &tombstones{lineFile: lineFile{fn: fn}, m: make(map[UUID]time.Time, 16)}
+		tombstoneCache[fn] = ts
+	}
+	err := ts.read(func() { ts.m = make(map[UUID]time.Time, 16) },
+		func(fields []string) error {
+			if len(fields) != 2 {
+				return nil
+			}
+			key, err := UUIDFromString(fields[0])
+			if err != nil {
+				return err
+			}
+			sec, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			ts.m[key] = time.Unix(sec, 0)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
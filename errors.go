@@ -0,0 +1,85 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import "fmt"
+
+// The storage errors carry the file and the key (if any) involved.
+
+// ErrCorruptIndex is returned when an index (cdb) cannot be read or merged,
+// or its content is inconsistent
+type ErrCorruptIndex struct {
+	File string // the cdb file
+	Key  string // the key in the cdb
+	Err  error
+}
+
+func (e *ErrCorruptIndex) Error() string {
+	return fmt.Sprintf("corrupt index %s (key %q): %s", e.File, e.Key, e.Err)
+}
+
+func (e *ErrCorruptIndex) Unwrap() error {
+	return e.Err
+}
+
+// ErrTarWrite is returned when a file cannot be written into a tar (or its cdb)
+type ErrTarWrite struct {
+	File string // the tar file
+	Key  string // the file to be written into the tar
+	Err  error
+}
+
+func (e *ErrTarWrite) Error() string {
+	return fmt.Sprintf("cannot write %s into %s: %s", e.Key, e.File, e.Err)
+}
+
+func (e *ErrTarWrite) Unwrap() error {
+	return e.Err
+}
+
+// ErrDedupLink is returned when a deduplicating symlink cannot be created
+type ErrDedupLink struct {
+	File string // the symlink
+	Key  string // the link's target
+	Err  error
+}
+
+func (e *ErrDedupLink) Error() string {
+	return fmt.Sprintf("cannot link %s to %s: %s", e.File, e.Key, e.Err)
+}
+
+func (e *ErrDedupLink) Unwrap() error {
+	return e.Err
+}
+
+// ErrStagingRead is returned when the staging dir cannot be read
+type ErrStagingRead struct {
+	File string // the file or directory in the staging dir
+	Key  string
+	Err  error
+}
+
+func (e *ErrStagingRead) Error() string {
+	return fmt.Sprintf("cannot read staging %s (key %q): %s", e.File, e.Key, e.Err)
+}
+
+func (e *ErrStagingRead) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,191 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// name of the realm-wide content hash index file, in the index dir
+const HashIndexFile = "hashes"
+
+// location of the stored data of a content hash
+type hashEntry struct {
+	Tar      string // basename of the tar
+	Dpos     uint64 // position of the data in the tar
+	Key      UUID   // key of the object the data belongs to
+	Encoding string // Content-Encoding of the data
+}
+
+// the realm-wide content hash index: an append-only file of
+// "hash tar dpos key encoding" lines, the last line wins.
+// New entries are pending till Commit.
+type hashIndex struct {
+	lineFile
+	hash    string // name of the content hash (sha1)
+	m       map[string]hashEntry
+	pending map[string]hashEntry
+}
+
+var (
+	hashIndexes     = make(map[string]*hashIndex, 4)
+	hashIndexesLock = sync.Mutex{}
+)
+
+// opens (reads) the hash index of the realm, returns nil if global
+// deduplication is not enabled
+func openHashIndex(conf Config) (*hashIndex, error) {
+	if !conf.GlobalDedup {
+		return nil, nil
+	}
+	h := &hashIndex{lineFile: lineFile{fn: filepath.Join(conf.IndexDir, HashIndexFile)},
+		hash: conf.ContentHash, m: make(map[string]hashEntry, 1024),
+		pending: make(map[string]hashEntry, 16)}
+	if err := h.read(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// looks up the content hash in the (cached) hash index of the realm
+func lookupHash(conf Config, contentHash string) (hashEntry, bool, error) {
+	if !conf.GlobalDedup {
+		return hashEntry{}, false, nil
+	}
+	fn := filepath.Join(conf.IndexDir, HashIndexFile)
+	hashIndexesLock.Lock()
+	defer hashIndexesLock.Unlock()
+	h, ok := hashIndexes[fn]
+	if !ok {
+		var err error
+		if h, err = openHashIndex(conf); err != nil {
+			return hashEntry{}, false, err
+		}
+		hashIndexes[fn] = h
+	} else if err := h.read(); err != nil {
+		return hashEntry{}, false, err
+	}
+	entry, ok := h.Get(contentHash)
+	return entry, ok, nil
+}
+
+// reads the lines appended since the last read
+func (h *hashIndex) read() error {
+	err := h.lineFile.read(func() { h.m = make(map[string]hashEntry, 1024) },
+		func(fields []string) error {
+			if len(fields) != 5 {
+				return nil
+			}
+			var (
+				entry hashEntry
+				err   error
+			)
+			entry.Tar = fields[1]
+			if entry.Dpos, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+				return err
+			}
+			if entry.Key, err = UUIDFromString(fields[3]); err != nil {
+				return err
+			}
+			if fields[4] != "-" {
+				entry.Encoding = fields[4]
+			}
+			h.m[fields[0]] = entry
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	logger.Debugf("read %d hashes from %s", len(h.m), h.fn)
+	return nil
+}
+
+// returns the content hash of the info, if it is indexed
+// (the manifests of chunked objects are not: their chunks are)
+func (h *hashIndex) contentHash(info Info) string {
+	if h == nil || info.Get(InfoPref+"Chunks") != "" {
+		return ""
+	}
+	return info.Get(InfoPref + "Content-" + h.hash)
+}
+
+// returns the location of the data with the given content hash
+func (h *hashIndex) Get(contentHash string) (hashEntry, bool) {
+	if h == nil || contentHash == "" {
+		return hashEntry{}, false
+	}
+	if entry, ok := h.pending[contentHash]; ok {
+		return entry, true
+	}
+	entry, ok := h.m[contentHash]
+	return entry, ok
+}
+
+// adds (replaces) the location of the data with the given content hash
+func (h *hashIndex) Add(contentHash string, entry hashEntry) {
+	if h == nil || contentHash == "" {
+		return
+	}
+	h.pending[contentHash] = entry
+}
+
+// appends the pending entries to the index file
+func (h *hashIndex) Commit() error {
+	if h == nil || len(h.pending) == 0 {
+		return nil
+	}
+	buf := bytes.NewBuffer(nil)
+	for contentHash, entry := range h.pending {
+		enc := entry.Encoding
+		if enc == "" {
+			enc = "-"
+		}
+		fmt.Fprintf(buf, "%s %s %d %s %s\n", contentHash, entry.Tar, entry.Dpos,
+			entry.Key, enc)
+	}
+	if err := h.append(buf.Bytes()); err != nil {
+		return &ErrCorruptIndex{File: h.fn, Err: err}
+	}
+	for contentHash, entry := range h.pending {
+		h.m[contentHash] = entry
+	}
+	h.pending = make(map[string]hashEntry, 16)
+	return nil
+}
+
+// drops the pending entries
+func (h *hashIndex) Rollback() {
+	if h != nil {
+		h.pending = make(map[string]hashEntry, 16)
+	}
+}
+
+// returns the path of the tar (by its basename) in tardir
+func tarPath(tardir, tarfn_b string) string {
+	uuid := tarUUID(tarfn_b)
+	if len(uuid) < 2 {
+		return filepath.Join(tardir, tarfn_b)
+	}
+	return filepath.Join(tardir, uuid[:2], tarfn_b)
+}
@@ -79,6 +79,11 @@ func (info *Info) Add(key string, val string) {
 	}
 }
 
+// deletes a key
+func (info *Info) Del(key string) {
+	delete(info.m, http.CanonicalHeaderKey(key))
+}
+
 // adds a key (byte)
 func (info *Info) AddBytes(key, val []byte) {
 	k := CanonicalHeaderKey(key)
@@ -118,10 +123,11 @@ func (info *Info) SetFilename(fn string, mime string) {
 }
 
 // copies adata from Info to http.Header
+// Content-Encoding is not copied, as Get returns the decoded data.
 func (info *Info) Copy(header http.Header) {
 	for k, v := range info.m {
 		k = http.CanonicalHeaderKey(k)
-		if k != "Accept-Encoding" {
+		if k != "Accept-Encoding" && k != "Content-Encoding" {
 			header.Add(k, v)
 		}
 	}
@@ -143,8 +149,9 @@ func ReadInfo(r io.Reader) (info Info, err error) {
 	}
 	for err == nil {
 		if key, err = rb.ReadString(':'); err == nil {
-			if val, err = rb.ReadString('\n'); err == nil {
-				info.Add(key[:len(key)-1], val[:len(val)-1])
+			// the last line (i.e. in the cdb) has no newline
+			if val, err = rb.ReadString('\n'); err == nil || err == io.EOF && val != "" {
+				info.Add(key[:len(key)-1], strings.TrimSuffix(val, "\n"))
 			}
 		}
 	}
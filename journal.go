@@ -0,0 +1,270 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tgulacsi/go-locking"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compaction builds the tar and its cdb into temporary files, then renames
+// them, symlinks the cdb into L00 and cleans up the staging dir.
+// Each step is recorded in a journal, so an interrupted compaction can be
+// rolled back (if the tar has not been written completely) or forward
+// (if it has) by RecoverCompaction.
+
+const (
+	JournalFile = "compact.journal" // in the index dir
+	SuffTemp    = ".tmp"            // suffix of the tar under construction
+)
+
+// compaction steps, as recorded in the journal
+const (
+	stepBegin   = "begin"   // creating tarfn + SuffTemp
+	stepWritten = "written" // tarfn + SuffTemp and its cdb are written and synced
+	stepRenamed = "renamed" // renamed to tarfn
+	stepLinked  = "linked"  // cdb symlinked into L00
+	stepDone    = "done"    // staging cleaned up
+	stepAbort   = "abort"   // temporary files removed
+)
+
+type journal struct {
+	fh *os.File
+}
+
+// opens the journal of the index dir for appending
+func openJournal(indexDir string) (*journal, error) {
+	fh, err := os.OpenFile(filepath.Join(indexDir, JournalFile),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{fh: fh}, nil
+}
+
+// records the step for tarfn, and syncs the journal
+func (j *journal) Log(step, tarfn string) error {
+	if _, err := fmt.Fprintf(j.fh, "%s %s\n", step, tarfn); err != nil {
+		logger.Errorf("cannot write journal %s: %s", j.fh.Name(), err)
+		return err
+	}
+	return j.fh.Sync()
+}
+
+// closes the journal, and removes it if every compaction has been finished
+func (j *journal) Close(finished bool) error {
+	err := j.fh.Close()
+	if finished {
+		if e := os.Remove(j.fh.Name()); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// reads the last recorded step (and its tar) from the journal
+func readJournal(fn string) (step, tarfn string, err error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+	br := bufio.NewReader(fh)
+	for {
+		line, e := br.ReadString('\n')
+		if p := strings.Index(line, " "); p > 0 && strings.HasSuffix(line, "\n") {
+			step, tarfn = line[:p], line[p+1:len(line)-1]
+		}
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return "", "", e
+		}
+	}
+	return
+}
+
+// builds the tar (with its cdb) from the staging dir, journaling each step.
+// The new content hashes are added to hashes after the tar is finished.
+func buildTar(conf Config, j *journal, hashes *hashIndex, tarfn string) (tr TarReport, err error) {
+	tr.Name = tarfn
+	if err = j.Log(stepBegin, tarfn); err != nil {
+		return
+	}
+	tempfn := tarfn + SuffTemp
+	tr.Objects, err = createTar(tempfn, conf.StagingDir, conf.TarThreshold,
+		int64(conf.InlineThreshold), hashes, true)
+	if err == nil {
+		err = syncFiles(tempfn, tempfn+".cdb")
+	}
+	if err != nil {
+		hashes.Rollback()
+		removeTemp(tarfn)
+		_ = j.Log(stepAbort, tarfn)
+		return
+	}
+	if err = j.Log(stepWritten, tarfn); err != nil {
+		return
+	}
+	if err = finishTar(conf, j, tarfn, stepWritten); err != nil {
+		hashes.Rollback()
+		return
+	}
+	// the tar is done, the missing hashes mean only missed deduplication
+	if e := hashes.Commit(); e != nil {
+		logger.Errorf("cannot update the hash index: %s", e)
+		hashes.Rollback()
+	}
+	tr.Size = uint64(fileSize(tarfn))
+	return
+}
+
+// does the steps of the compaction of tarfn after the given step
+func finishTar(conf Config, j *journal, tarfn string, step string) error {
+	var err error
+	switch step {
+	case stepWritten:
+		tempfn := tarfn + SuffTemp
+		if fileExists(tempfn + ".cdb") {
+			if err = os.Rename(tempfn+".cdb", tarfn+".cdb"); err != nil {
+				return err
+			}
+		}
+		if fileExists(tempfn) {
+			if err = os.Rename(tempfn, tarfn); err != nil {
+				return err
+			}
+		}
+		if err = syncDir(filepath.Dir(tarfn)); err != nil {
+			return err
+		}
+		if err = j.Log(stepRenamed, tarfn); err != nil {
+			return err
+		}
+		fallthrough
+	case stepRenamed:
+		linkfn := filepath.Join(conf.IndexDir, "L00", filepath.Base(tarfn)+".cdb")
+		if !fileIsSymlink(linkfn) {
+			if err = os.Symlink(tarfn+".cdb", linkfn); err != nil {
+				return err
+			}
+		}
+		if err = j.Log(stepLinked, tarfn); err != nil {
+			return err
+		}
+		fallthrough
+	case stepLinked:
+		if err = cleanupStaging(conf.StagingDir, conf.ContentHash, tarfn); err != nil {
+			return err
+		}
+		return j.Log(stepDone, tarfn)
+	}
+	return nil
+}
+
+// removes the temporary files of tarfn
+func removeTemp(tarfn string) {
+	for _, fn := range []string{tarfn + SuffTemp, tarfn + SuffTemp + ".cdb"} {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("cannot remove %s: %s", fn, err)
+		}
+	}
+}
+
+// rolls back or forward the interrupted compaction of the realm, if any
+func RecoverCompaction(realm string) error {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	if locks, err := locking.FLockDirs(conf.IndexDir, conf.StagingDir); err != nil {
+		logger.Error("cannot lock dir: ", err)
+		return err
+	} else {
+		defer locks.Unlock()
+	}
+	return recoverCompaction(conf)
+}
+
+// recovers the compaction - the index and staging dirs must be locked
+func recoverCompaction(conf Config) error {
+	jfn := filepath.Join(conf.IndexDir, JournalFile)
+	step, tarfn, err := readJournal(jfn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		logger.Errorf("cannot read journal %s: %s", jfn, err)
+		return err
+	}
+	j, err := openJournal(conf.IndexDir)
+	if err != nil {
+		return err
+	}
+	switch step {
+	case "", stepDone, stepAbort:
+	case stepBegin:
+		logger.Warnf("rolling back the compaction of %s", tarfn)
+		removeTemp(tarfn)
+		err = j.Log(stepAbort, tarfn)
+	default:
+		logger.Warnf("rolling forward the compaction of %s from %s", tarfn, step)
+		err = finishTar(conf, j, tarfn, step)
+	}
+	if err != nil {
+		logger.Errorf("cannot recover the compaction of %s: %s", tarfn, err)
+	}
+	_ = j.Close(err == nil)
+	return err
+}
+
+// fsyncs the files
+func syncFiles(filenames ...string) error {
+	for _, fn := range filenames {
+		fh, err := os.OpenFile(fn, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		err = fh.Sync()
+		if e := fh.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsyncs the directory (to persist renames)
+func syncDir(dn string) error {
+	dh, err := os.Open(dn)
+	if err != nil {
+		return err
+	}
+	err = dh.Sync()
+	_ = dh.Close()
+	return err
+}
@@ -0,0 +1,91 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// an append-only file of lines (the tombstones, the name and the hash index),
+// read incrementally: only the lines appended since the last read are parsed
+type lineFile struct {
+	fn  string
+	off int64 // read till this offset
+}
+
+// calls parse with the fields of each complete line appended since the last
+// read (a partial last line is being written, or is the remnant of a crash).
+// If the file has been recreated, reset is called and it is read from the start.
+func (lf *lineFile) read(reset func(), parse func(fields []string) error) error {
+	fh, err := os.Open(lf.fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &ErrCorruptIndex{File: lf.fn, Err: err}
+	}
+	defer fh.Close()
+	if fi, err := fh.Stat(); err != nil {
+		return &ErrCorruptIndex{File: lf.fn, Err: err}
+	} else if fi.Size() < lf.off {
+		lf.off = 0
+		reset()
+	} else if fi.Size() == lf.off {
+		return nil
+	}
+	if _, err = fh.Seek(lf.off, 0); err != nil {
+		return &ErrCorruptIndex{File: lf.fn, Err: err}
+	}
+	br := bufio.NewReader(fh)
+	for {
+		line, e := br.ReadString('\n')
+		if !strings.HasSuffix(line, "\n") {
+			if e == io.EOF || e == nil {
+				return nil
+			}
+			return &ErrCorruptIndex{File: lf.fn, Err: e}
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			if err = parse(fields); err != nil {
+				return &ErrCorruptIndex{File: lf.fn, Key: fields[0], Err: err}
+			}
+		}
+		lf.off += int64(len(line))
+	}
+}
+
+// appends the lines (each terminated by a newline) to the file, and syncs it
+func (lf *lineFile) append(lines []byte) error {
+	fh, err := os.OpenFile(lf.fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(lines)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if e := fh.Close(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bytes"
+	"github.com/tgulacsi/go-cdb"
+	"os"
+	"strings"
+)
+
+// WalkInfos calls todo with the info of each object of the realm (first the
+// staged, then the shoveled ones), skipping the chunks and the deleted objects.
+// Returning StopIteration from todo stops the walk.
+func WalkInfos(realm string, todo func(info Info) error) error {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	tombstoneLock.Lock()
+	ts, err := readTombstones(conf)
+	var deleted map[UUID]bool
+	if err == nil {
+		deleted = make(map[UUID]bool, len(ts.m))
+		for key := range ts.m {
+			deleted[key] = true
+		}
+	}
+	tombstoneLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return walkInfos(realm, conf, func(info Info) error {
+		if info.Get(InfoPref+"Chunk-Of") != "" || deleted[info.Key] {
+			return nil
+		}
+		return todo(info)
+	})
+}
+
+// calls todo with the info of each object of the staging dir and of the
+// tars' cdbs (each key once)
+func walkInfos(realm string, conf Config, todo func(info Info) error) error {
+	seen := make(map[UUID]bool, 1024)
+	stopped := false
+	once := func(info Info) error {
+		if seen[info.Key] {
+			return nil
+		}
+		seen[info.Key] = true
+		err := todo(info)
+		stopped = err == StopIteration
+		return err
+	}
+	err := Walk(conf.StagingDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(fi.Name(), SuffInfo) {
+			return nil
+		}
+		fh, err := os.Open(path)
+		if err != nil {
+			return &ErrStagingRead{File: path, Err: err}
+		}
+		info, err := ReadInfo(fh)
+		_ = fh.Close()
+		if err != nil {
+			return &ErrStagingRead{File: path, Err: err}
+		}
+		return once(info)
+	})
+	if err != nil {
+		if err == StopIteration {
+			err = nil
+		}
+		return err
+	}
+	dumpCdb := func(uuid, tarfn string) error {
+		fn := tarfn + ".cdb"
+		fh, err := os.Open(fn)
+		if err != nil {
+			if os.IsNotExist(err) { // being written
+				return nil
+			}
+			return &ErrCorruptIndex{File: fn, Err: err}
+		}
+		defer fh.Close()
+		return cdb.DumpMap(fh, func(elt cdb.Element) error {
+			info, err := ReadInfo(bytes.NewReader(elt.Data))
+			if err != nil {
+				return &ErrCorruptIndex{File: fn, Key: BytesToStr(elt.Key), Err: err}
+			}
+			info.Del(InfoPref + "Inline")
+			return once(info)
+		})
+	}
+	if err = walkTarFiles(realm, conf.TarDir, dumpCdb); err == nil && !stopped && conf.ColdDir != "" {
+		err = walkTarFiles(realm, conf.ColdDir, dumpCdb)
+	}
+	return err
+}
@@ -0,0 +1,401 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/tgulacsi/go-cdb"
+	"github.com/tgulacsi/go-locking"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MergeTars merges the undersized tars of the realm (smaller than MergeBelow
+// percent of TarThreshold) into full-size ones.
+//
+// The objects remain reachable all the time: the new tar's cdb is linked into
+// L00 and the books of the higher levels are redirected to the new tar, and
+// onChange is called to refill the caches before the old tars are unlinked and
+// removed. An interrupted merge leaves the objects in both the old and the new
+// tar, which is harmless.
+//
+// Tars still linked into L00 are merged only with each other, as are the ones
+// already compacted into the higher levels, so no key gets indexed twice.
+//
+// With opts.DryRun, only reports which tars would be merged.
+func MergeTars(realm string, onChange NotifyFunc, opts *CompactOptions) (*CompactReport, error) {
+	report := &CompactReport{Realm: realm, DryRun: opts.dryRun()}
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return report, err
+	}
+	if locks, err := locking.FLockDirs(conf.IndexDir, conf.StagingDir); err != nil {
+		logger.Error("cannot lock dir: ", err)
+		return report, err
+	} else {
+		defer locks.Unlock()
+	}
+
+	merges, err := planTarMerges(conf, realm)
+	if err != nil {
+		return report, err
+	}
+	var hashes *hashIndex
+	if !report.DryRun {
+		if hashes, err = openHashIndex(conf); err != nil {
+			return report, err
+		}
+	}
+	for _, tm := range merges {
+		if !report.DryRun {
+			if tm.Dest, err = newTarName(conf, realm); err != nil {
+				return report, err
+			}
+			logger.Infof("merging %d tars into %s", len(tm.Sources), tm.Dest)
+			if tm.Objects, err = mergeTars(conf, tm.Dest, tm.Sources, hashes, onChange); err != nil {
+				logger.Errorf("cannot merge %s into %s: %s", tm.Sources, tm.Dest, err)
+				return report, err
+			}
+			tm.Size = uint64(fileSize(tm.Dest))
+		}
+		report.TarMerges = append(report.TarMerges, tm)
+	}
+	return report, nil
+}
+
+// groups the undersized tars (oldest first) into merges up to TarThreshold
+func planTarMerges(conf Config, realm string) ([]TarMerge, error) {
+	limit := int64(conf.TarThreshold * conf.MergeBelow / 100)
+	// [0]: already compacted into the higher levels, [1]: linked into L00
+	var files [2]sizedFilenames
+	err := walkTarFiles(realm, conf.TarDir, func(uuid, fn string) error {
+		if size := fileSize(fn); size >= 0 && size < limit && fileExists(fn+".cdb") {
+			i := 0
+			if isLinkedIntoL00(conf, fn) {
+				i = 1
+			}
+			files[i] = append(files[i], &sizedFilename{fn, size})
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("cannot list tars in %s: %s", conf.TarDir, err)
+		return nil, err
+	}
+
+	merges := make([]TarMerge, 0, 2)
+	tm := TarMerge{}
+	flush := func() {
+		if len(tm.Sources) > 1 {
+			tm.Dest = fmt.Sprintf("#%d", len(merges)+1)
+			merges = append(merges, tm)
+		}
+		tm = TarMerge{}
+	}
+	for _, group := range files {
+		// the names begin with realm-time
+		sort.Sort(byBaseName{group})
+		for _, sfn := range group {
+			if tm.Size+uint64(sfn.size) > conf.TarThreshold {
+				flush()
+			}
+			tm.Sources = append(tm.Sources, sfn.filename)
+			tm.Size += uint64(sfn.size)
+		}
+		flush()
+	}
+	return merges, nil
+}
+
+// returns the L00 link of tarfn's cdb
+func l00Link(conf Config, tarfn string) string {
+	return filepath.Join(conf.IndexDir, "L00", filepath.Base(tarfn)+".cdb")
+}
+
+// reports whether the cdb of tarfn is still linked into L00
+func isLinkedIntoL00(conf Config, tarfn string) bool {
+	return fileIsSymlink(l00Link(conf, tarfn))
+}
+
+type byBaseName struct{ sizedFilenames }
+
+func (s byBaseName) Less(i, j int) bool {
+	return filepath.Base(s.sizedFilenames[i].filename) <
+		filepath.Base(s.sizedFilenames[j].filename)
+}
+
+// merges the sources into tarfn, links it into L00 (if the sources were linked
+// there), redirects the higher level books (and the content hashes) to it,
+// calls onChange, then removes the sources.
+// Returns the number of objects.
+func mergeTars(conf Config, tarfn string, sources []string, hashes *hashIndex,
+	onChange NotifyFunc) (objects int, err error) {
+	if len(sources) == 0 {
+		return 0, nil
+	}
+	linked := isLinkedIntoL00(conf, sources[0])
+	for _, sfn := range sources[1:] {
+		if isLinkedIntoL00(conf, sfn) != linked {
+			return 0, fmt.Errorf("cannot merge tars linked into L00 with compacted ones: %s", sources)
+		}
+	}
+	tempfn := tarfn + SuffTemp
+	defer func() {
+		if err != nil {
+			hashes.Rollback()
+			removeTemp(tarfn)
+		}
+	}()
+	if objects, err = copyTars(tempfn, sources, hashes); err != nil {
+		return
+	}
+	if err = syncFiles(tempfn, tempfn+".cdb"); err != nil {
+		return
+	}
+	if err = os.Rename(tempfn+".cdb", tarfn+".cdb"); err != nil {
+		return
+	}
+	if err = os.Rename(tempfn, tarfn); err != nil {
+		_ = os.Remove(tarfn + ".cdb")
+		return
+	}
+	if err = syncDir(filepath.Dir(tarfn)); err != nil {
+		return
+	}
+	if linked {
+		if err = os.Symlink(tarfn+".cdb", l00Link(conf, tarfn)); err != nil {
+			return
+		}
+	}
+
+	olds := make(map[string]bool, len(sources))
+	for _, sfn := range sources {
+		olds[filepath.Base(sfn)] = true
+	}
+	if err = rebookCdbs(conf.IndexDir, olds, filepath.Base(tarfn)); err != nil {
+		return
+	}
+	// the references to the old tars are followed through the keys
+	if err = hashes.Commit(); err != nil {
+		return
+	}
+	// the caches may still point to the old tars
+	if onChange != nil {
+		onChange()
+	}
+
+	for _, sfn := range sources {
+		linkfn := l00Link(conf, sfn)
+		if fileIsSymlink(linkfn) {
+			if err = os.Remove(linkfn); err != nil {
+				return
+			}
+		}
+	}
+	for _, sfn := range sources {
+		for _, fn := range []string{sfn + ".cdb", sfn} {
+			if e := os.Remove(fn); e != nil {
+				logger.Errorf("cannot remove %s: %s", fn, e)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// copies the members of the sources into tarfn, and their infos (with the
+// positions rewritten) into tarfn.cdb, adding the content hashes to hashes
+func copyTars(tarfn string, sources []string, hashes *hashIndex) (objects int, err error) {
+	tarfn_b := strings.TrimSuffix(filepath.Base(tarfn), SuffTemp)
+	fh, err := os.OpenFile(tarfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, &ErrTarWrite{File: tarfn, Err: err}
+	}
+	defer fh.Close()
+	cfh, err := os.OpenFile(tarfn+".cdb", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, &ErrTarWrite{File: tarfn + ".cdb", Err: err}
+	}
+	defer cfh.Close()
+	adder, closer, err := cdb.MakeFactory(cfh)
+	if err != nil {
+		return 0, &ErrTarWrite{File: tarfn + ".cdb", Err: err}
+	}
+	tw := tar.NewWriter(fh)
+
+	for _, sfn := range sources {
+		positions, err := copyTar(tw, fh, sfn)
+		if err != nil {
+			return objects, &ErrTarWrite{File: tarfn, Key: sfn, Err: err}
+		}
+		sfh, err := os.Open(sfn + ".cdb")
+		if err != nil {
+			return objects, &ErrCorruptIndex{File: sfn + ".cdb", Err: err}
+		}
+		err = cdb.DumpMap(sfh, func(elt cdb.Element) error {
+			info, err := ReadInfo(bytes.NewReader(elt.Data))
+			if err != nil {
+				return &ErrCorruptIndex{File: sfn + ".cdb", Key: BytesToStr(elt.Key), Err: err}
+			}
+			ipos, err := movedPos(positions, info.Ipos)
+			// references point into other tars
+			if err == nil && info.Get(InfoPref+"Ref-Tar") == "" {
+				if info.Dpos, err = movedPos(positions, info.Dpos); err == nil {
+					hashes.Add(hashes.contentHash(info), hashEntry{Tar: tarfn_b,
+						Dpos: info.Dpos, Key: info.Key, Encoding: info.Get("Content-Encoding")})
+				}
+			}
+			if err != nil {
+				return &ErrCorruptIndex{File: sfn + ".cdb", Key: BytesToStr(elt.Key), Err: err}
+			}
+			// a zero Ipos is not written out by Prepare
+			info.Del(InfoPref + "Ipos")
+			info.Ipos = ipos
+			objects++
+			return adder(cdb.Element{Key: elt.Key, Data: info.Bytes()})
+		})
+		_ = sfh.Close()
+		if err != nil {
+			return objects, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return objects, &ErrTarWrite{File: tarfn, Err: err}
+	}
+	if err = closer(); err != nil {
+		return objects, &ErrTarWrite{File: tarfn + ".cdb", Err: err}
+	}
+	return objects, nil
+}
+
+// returns the new position of the member at pos
+func movedPos(positions map[uint64]uint64, pos uint64) (uint64, error) {
+	if p, ok := positions[pos]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("no tar member at %d", pos)
+}
+
+// appends the members of tarfn to tw, returns the old to new positions map
+func copyTar(tw *tar.Writer, tfh io.Seeker, tarfn string) (map[uint64]uint64, error) {
+	sfh, err := os.Open(tarfn)
+	if err != nil {
+		return nil, err
+	}
+	defer sfh.Close()
+	cr := &countingReader{Reader: sfh}
+	tr := tar.NewReader(cr)
+	positions := make(map[uint64]uint64, 64)
+	for {
+		// the data is read till its end, the padding is skipped by Next
+		opos := (cr.n + BS - 1) / BS * BS
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return positions, err
+		}
+		p, err := tfh.Seek(0, 1)
+		if err != nil {
+			return positions, err
+		}
+		positions[opos] = uint64(p)
+		if err = WriteTar(tw, hdr, tr); err != nil {
+			return positions, err
+		}
+	}
+	return positions, nil
+}
+
+// counts the bytes read
+type countingReader struct {
+	io.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
+// rewrites the higher level cdbs whose books point to the olds, to point to tarfn_b
+func rebookCdbs(index_dir string, olds map[string]bool, tarfn_b string) error {
+	return walkCdbFiles("", index_dir, func(level int, fn string) error {
+		if level == 0 {
+			return nil
+		}
+		fh, err := os.Open(fn)
+		if err != nil {
+			return &ErrCorruptIndex{File: fn, Err: err}
+		}
+		found := false
+		err = cdb.DumpMap(fh, func(elt cdb.Element) error {
+			if isBookKey(elt.Key) && olds[BytesToStr(elt.Data)] {
+				found = true
+				return StopIteration
+			}
+			return nil
+		})
+		if err != nil && err != StopIteration {
+			_ = fh.Close()
+			return &ErrCorruptIndex{File: fn, Err: err}
+		}
+		if !found {
+			_ = fh.Close()
+			return nil
+		}
+		if _, err = fh.Seek(0, 0); err != nil {
+			_ = fh.Close()
+			return err
+		}
+		tempfn := fn + SuffTemp
+		cw, err := cdb.NewWriter(tempfn)
+		if err != nil {
+			_ = fh.Close()
+			return &ErrCorruptIndex{File: tempfn, Err: err}
+		}
+		err = cdb.DumpMap(fh, func(elt cdb.Element) error {
+			if isBookKey(elt.Key) && olds[BytesToStr(elt.Data)] {
+				return cw.PutPair(elt.Key, StrToBytes(tarfn_b))
+			}
+			return cw.PutPair(elt.Key, elt.Data)
+		})
+		_ = fh.Close()
+		if e := cw.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err == nil {
+			if err = syncFiles(tempfn); err == nil {
+				err = os.Rename(tempfn, fn)
+			}
+		}
+		if err != nil {
+			_ = os.Remove(tempfn)
+			return &ErrCorruptIndex{File: fn, Err: err}
+		}
+		logger.Infof("%s redirected to %s", fn, tarfn_b)
+		return nil
+	})
+}
@@ -0,0 +1,275 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the upper bounds (in seconds) of the latency histograms' buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60, 300, 3600}
+
+// a Prometheus-style histogram (cumulative buckets)
+type histogram struct {
+	sync.Mutex
+	counts []uint64 // per bucket (not cumulative), the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+// records an observation
+func (h *histogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.Unlock()
+}
+
+// writes the histogram in Prometheus text format
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.Lock()
+	defer h.Unlock()
+	cum := uint64(0)
+	for i, le := range latencyBuckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// the counters of a realm (updated atomically)
+type realmMetrics struct {
+	Puts, PutErrors, BytesIn           uint64
+	Gets, GetErrors, BytesOut          uint64
+	Compactions, CompactErrors         uint64
+	CdbCacheHits, CdbCacheMisses       uint64
+	TarCacheHits, TarCacheMisses       uint64
+	PutLatency, GetLatency, CompactDur *histogram
+}
+
+var (
+	metrics     = make(map[string]*realmMetrics, 4)
+	metricsLock = sync.Mutex{}
+)
+
+// returns the metrics of the realm
+func realmStats(realm string) *realmMetrics {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m, ok := metrics[realm]
+	if !ok {
+		m = &realmMetrics{PutLatency: newHistogram(), GetLatency: newHistogram(),
+			CompactDur: newHistogram()}
+		metrics[realm] = m
+	}
+	return m
+}
+
+// records a Put
+func (m *realmMetrics) put(start time.Time, size uint64, err error) {
+	atomic.AddUint64(&m.Puts, 1)
+	if err != nil {
+		atomic.AddUint64(&m.PutErrors, 1)
+	} else {
+		atomic.AddUint64(&m.BytesIn, size)
+	}
+	m.PutLatency.Observe(time.Since(start))
+}
+
+// records a Get, and counts the bytes read from the returned reader
+func (m *realmMetrics) get(start time.Time, reader io.Reader, err error) io.Reader {
+	atomic.AddUint64(&m.Gets, 1)
+	m.GetLatency.Observe(time.Since(start))
+	if err != nil {
+		atomic.AddUint64(&m.GetErrors, 1)
+		return reader
+	} else if reader == nil {
+		return nil
+	}
+	// the *closer must be kept for Decode
+	if c, ok := reader.(*closer); ok {
+		c.Reader = &countingReadCloser{Reader: c.Reader, num: &m.BytesOut}
+		return c
+	}
+	return &countingReadCloser{Reader: reader, num: &m.BytesOut}
+}
+
+// records a compaction
+func (m *realmMetrics) compact(start time.Time, err error) {
+	atomic.AddUint64(&m.Compactions, 1)
+	if err != nil {
+		atomic.AddUint64(&m.CompactErrors, 1)
+	}
+	m.CompactDur.Observe(time.Since(start))
+}
+
+// records a cache lookup (hit or miss) of the cdb or tar cache
+func cacheStat(realm string, tar, hit bool) {
+	m := realmStats(realm)
+	switch {
+	case tar && hit:
+		atomic.AddUint64(&m.TarCacheHits, 1)
+	case tar:
+		atomic.AddUint64(&m.TarCacheMisses, 1)
+	case hit:
+		atomic.AddUint64(&m.CdbCacheHits, 1)
+	default:
+		atomic.AddUint64(&m.CdbCacheMisses, 1)
+	}
+}
+
+// counts the bytes read, closes the underlying reader if it is an io.Closer
+type countingReadCloser struct {
+	io.Reader
+	num *uint64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddUint64(r.num, uint64(n))
+	return n, err
+}
+
+func (r *countingReadCloser) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WriteMetrics writes the metrics of every realm in Prometheus text format:
+// the put/get counts, bytes and latencies, the compactions, the cache hits,
+// and the state of the staging dir and the index
+func WriteMetrics(w io.Writer) error {
+	conf, err := ReadConf("", "")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	counters := []struct {
+		name, help string
+		get        func(*realmMetrics) *uint64
+	}{
+		{"aostor_puts_total", "Number of puts.",
+			func(m *realmMetrics) *uint64 { return &m.Puts }},
+		{"aostor_put_errors_total", "Number of failed puts.",
+			func(m *realmMetrics) *uint64 { return &m.PutErrors }},
+		{"aostor_bytes_in_total", "Bytes stored (uncompressed).",
+			func(m *realmMetrics) *uint64 { return &m.BytesIn }},
+		{"aostor_gets_total", "Number of gets.",
+			func(m *realmMetrics) *uint64 { return &m.Gets }},
+		{"aostor_get_errors_total", "Number of failed (or not found) gets.",
+			func(m *realmMetrics) *uint64 { return &m.GetErrors }},
+		{"aostor_bytes_out_total", "Bytes read from the returned objects.",
+			func(m *realmMetrics) *uint64 { return &m.BytesOut }},
+		{"aostor_compactions_total", "Number of compactions.",
+			func(m *realmMetrics) *uint64 { return &m.Compactions }},
+		{"aostor_compaction_errors_total", "Number of failed compactions.",
+			func(m *realmMetrics) *uint64 { return &m.CompactErrors }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, realm := range conf.Realms {
+			fmt.Fprintf(bw, "%s{realm=%q} %d\n", c.name, realm,
+				atomic.LoadUint64(c.get(realmStats(realm))))
+		}
+	}
+
+	for _, kind := range []string{"hits", "misses"} {
+		name := "aostor_cache_" + kind + "_total"
+		fmt.Fprintf(bw, "# HELP %s Number of the cdb and tar cache %s.\n# TYPE %s counter\n",
+			name, kind, name)
+		for _, realm := range conf.Realms {
+			m := realmStats(realm)
+			cdb, tar := &m.CdbCacheHits, &m.TarCacheHits
+			if kind == "misses" {
+				cdb, tar = &m.CdbCacheMisses, &m.TarCacheMisses
+			}
+			fmt.Fprintf(bw, "%s{realm=%q,cache=\"cdb\"} %d\n", name, realm, atomic.LoadUint64(cdb))
+			fmt.Fprintf(bw, "%s{realm=%q,cache=\"tar\"} %d\n", name, realm, atomic.LoadUint64(tar))
+		}
+	}
+
+	histograms := []struct {
+		name, help string
+		get        func(*realmMetrics) *histogram
+	}{
+		{"aostor_put_duration_seconds", "Latency of the puts.",
+			func(m *realmMetrics) *histogram { return m.PutLatency }},
+		{"aostor_get_duration_seconds", "Latency of the gets (finding the object).",
+			func(m *realmMetrics) *histogram { return m.GetLatency }},
+		{"aostor_compaction_duration_seconds", "Duration of the compactions.",
+			func(m *realmMetrics) *histogram { return m.CompactDur }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for _, realm := range conf.Realms {
+			h.get(realmStats(realm)).write(bw, h.name, fmt.Sprintf("realm=%q", realm))
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP aostor_staging_objects Number of the objects in the staging dir.\n"+
+		"# TYPE aostor_staging_objects gauge\n")
+	stats := make(map[string]StagingStat, len(conf.Realms))
+	for _, realm := range conf.Realms {
+		if stats[realm], err = StagingStats(realm); err != nil {
+			logger.Errorf("cannot get the staging stats of %s: %s", realm, err)
+		}
+		fmt.Fprintf(bw, "aostor_staging_objects{realm=%q} %d\n", realm, stats[realm].Count)
+	}
+	fmt.Fprintf(bw, "# HELP aostor_staging_bytes Size of the staging dir.\n"+
+		"# TYPE aostor_staging_bytes gauge\n")
+	for _, realm := range conf.Realms {
+		fmt.Fprintf(bw, "aostor_staging_bytes{realm=%q} %d\n", realm, stats[realm].Bytes)
+	}
+
+	fmt.Fprintf(bw, "# HELP aostor_tars Number of the tars.\n# TYPE aostor_tars gauge\n")
+	cacheLock.RLock()
+	for _, realm := range conf.Realms {
+		tars := make(map[string]bool, len(tarFiles[realm])/2)
+		for _, fn := range tarFiles[realm] {
+			tars[fn] = true
+		}
+		fmt.Fprintf(bw, "aostor_tars{realm=%q} %d\n", realm, len(tars))
+	}
+	fmt.Fprintf(bw, "# HELP aostor_cdbs Number of the cdbs per level.\n# TYPE aostor_cdbs gauge\n")
+	for _, realm := range conf.Realms {
+		for level, files := range cdbFiles[realm] {
+			fmt.Fprintf(bw, "aostor_cdbs{realm=%q,level=\"L%02d\"} %d\n", realm, level, len(files))
+		}
+	}
+	cacheLock.RUnlock()
+	return bw.Flush()
+}
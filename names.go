@@ -0,0 +1,240 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the realm's object name index file, in the index dir
+const NameIndexFile = "names"
+
+// an object stored under a name (by PutNamed)
+type NamedObject struct {
+	Name   string
+	Key    UUID
+	Size   uint64
+	ETag   string // given by the caller of PutNamed, or the MD5 of the data
+	Stored time.Time
+}
+
+// the realm's name index: an append-only file of
+// "name key size unixtime etag" lines (query-escaped),
+// the last line of a name wins; "name -" removes the name
+type nameIndex struct {
+	lineFile
+	m map[string]NamedObject
+}
+
+var (
+	nameIndexes   = make(map[string]*nameIndex, 4)
+	nameIndexLock = sync.Mutex{}
+)
+
+// PutNamed stores the object under a new key, and records it under the name,
+// replacing (and removing, as DeleteNamed does) the previous object of the name.
+// etag is recorded with the name - if empty, the MD5 of the data is used.
+// An empty object is not stored, only its name is recorded (with an empty key).
+func PutNamed(realm, name, etag string, info Info, data io.Reader) (NamedObject, error) {
+	obj := NamedObject{Name: name, ETag: etag}
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return obj, err
+	}
+	info.Key = UUID{}
+	if info.Get(InfoPref+"Original-Filename") == "" {
+		info.SetFilename(name, "")
+	}
+	cnt := NewCounter()
+	md5h := md5.New()
+	br := bufio.NewReader(data)
+	if _, err = br.Peek(1); err != nil && err != io.EOF {
+		return obj, err
+	} else if err == nil {
+		if obj.Key, _, err = PutDedup(realm, info, io.TeeReader(br, io.MultiWriter(cnt, md5h))); err != nil {
+			return obj, err
+		}
+	}
+	obj.Size, obj.Stored = cnt.Num, time.Now()
+	if obj.ETag == "" {
+		obj.ETag = fmt.Sprintf("%x", md5h.Sum(nil))
+	}
+	prev, ok, err := appendName(conf, name, fmt.Sprintf("%s %s %d %d %s\n",
+		url.QueryEscape(name), obj.Key, obj.Size, obj.Stored.Unix(), url.QueryEscape(obj.ETag)))
+	if err == nil && ok && !prev.Key.IsEmpty() {
+		removeNamed(realm, prev)
+	}
+	return obj, err
+}
+
+// removes the object which is not stored under its name anymore: unstages
+// it if it is still staged, deletes it otherwise
+func removeNamed(realm string, obj NamedObject) {
+	err := Unstage(realm, obj.Key)
+	if err == NotFound {
+		err = Delete(realm, obj.Key)
+	}
+	if err != nil && err != NotFound {
+		logger.Errorf("cannot remove %s (formerly %s@%s): %s", obj.Key, obj.Name, realm, err)
+	}
+}
+
+// LookupName returns the object stored under the name
+func LookupName(realm, name string) (NamedObject, bool, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return NamedObject{}, false, err
+	}
+	nameIndexLock.Lock()
+	defer nameIndexLock.Unlock()
+	ni, err := readNames(conf)
+	if err != nil {
+		return NamedObject{}, false, err
+	}
+	obj, ok := ni.m[name]
+	return obj, ok, nil
+}
+
+// DeleteNamed deletes the object stored under the name, and removes the name.
+// Returns NotFound if no object is stored under the name.
+func DeleteNamed(realm, name string) error {
+	if _, ok, err := LookupName(realm, name); err != nil {
+		return err
+	} else if !ok {
+		return NotFound
+	}
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	obj, ok, err := appendName(conf, name, url.QueryEscape(name)+" -\n")
+	if err != nil {
+		return err
+	} else if !ok { // removed meanwhile
+		return NotFound
+	} else if obj.Key.IsEmpty() { // empty, not stored
+		return nil
+	}
+	if err = Delete(realm, obj.Key); err != nil && err != NotFound {
+		return err
+	}
+	return nil
+}
+
+// ListNames returns the objects whose name has the prefix, sorted by name
+func ListNames(realm, prefix string) ([]NamedObject, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return nil, err
+	}
+	nameIndexLock.Lock()
+	ni, err := readNames(conf)
+	if err != nil {
+		nameIndexLock.Unlock()
+		return nil, err
+	}
+	objs := make([]NamedObject, 0, 16)
+	for name, obj := range ni.m {
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, obj)
+		}
+	}
+	nameIndexLock.Unlock()
+	sort.Sort(byName(objs))
+	return objs, nil
+}
+
+type byName []NamedObject
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// appends the line of the name to the name index, returns the object which
+// has been stored under the name
+func appendName(conf Config, name, line string) (NamedObject, bool, error) {
+	nameIndexLock.Lock()
+	defer nameIndexLock.Unlock()
+	ni, err := readNames(conf)
+	if err != nil {
+		return NamedObject{}, false, err
+	}
+	prev, ok := ni.m[name]
+	if err = ni.append([]byte(line)); err != nil {
+		return NamedObject{}, false, &ErrCorruptIndex{File: ni.fn, Err: err}
+	}
+	return prev, ok, nil
+}
+
+// returns the (cached) name index of the realm, reading the new lines.
+// Must be called with nameIndexLock held.
+func readNames(conf Config) (*nameIndex, error) {
+	fn := filepath.Join(conf.IndexDir, NameIndexFile)
+	ni, ok := nameIndexes[fn]
+	if !ok {
+		ni = &nameIndex{lineFile: lineFile{fn: fn}, m: make(map[string]NamedObject, 1024)}
+		nameIndexes[fn] = ni
+	}
+	err := ni.read(func() { ni.m = make(map[string]NamedObject, 1024) },
+		func(fields []string) error {
+			name, err := url.QueryUnescape(fields[0])
+			if err != nil {
+				return err
+			}
+			switch len(fields) {
+			case 2: // removed
+				delete(ni.m, name)
+			case 5:
+				obj := NamedObject{Name: name}
+				if obj.Key, err = UUIDFromString(fields[1]); err != nil {
+					return err
+				}
+				if obj.Size, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+					return err
+				}
+				sec, err := strconv.ParseInt(fields[3], 10, 64)
+				if err != nil {
+					return err
+				}
+				obj.Stored = time.Unix(sec, 0)
+				if fields[4] != "-" {
+					if obj.ETag, err = url.QueryUnescape(fields[4]); err != nil {
+						return err
+					}
+				}
+				ni.m[name] = obj
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ni, nil
+}
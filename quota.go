@@ -0,0 +1,342 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// name of the realm's usage file (objects and bytes stored), in the index dir
+const UsageFile = "usage"
+
+var (
+	// ErrTooLarge is returned by Put if the object is bigger than MaxObjectSize
+	ErrTooLarge = errors.New("object too large")
+	// ErrQuotaExceeded is returned by Put if the realm's MaxBytes or
+	// MaxObjects quota would be exceeded
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// the usage of a realm: the number of stored objects (the chunks are not
+// counted) and the sum of their (original) sizes. The deleted objects are
+// counted, too: their data remains stored.
+type Usage struct {
+	Objects, Bytes uint64
+}
+
+// the cached usage, with the modification time and size of its file
+type cachedUsage struct {
+	u       *Usage
+	modTime time.Time
+	size    int64
+}
+
+var (
+	usages = make(map[string]cachedUsage, 4)
+	// the objects and bytes reserved by the puts in progress, by usage file
+	reserved  = make(map[string]*Usage, 4)
+	usageLock = sync.Mutex{}
+)
+
+// returns the (cached) usage of the realm - read again if the file has been
+// changed by another process (e.g. RecomputeUsage of shovel).
+// Must be called with usageLock held.
+func readUsage(conf Config) (*Usage, error) {
+	fn := filepath.Join(conf.IndexDir, UsageFile)
+	var modTime time.Time
+	size := int64(-1)
+	fi, err := os.Stat(fn)
+	if err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if c, ok := usages[fn]; ok && c.modTime.Equal(modTime) && c.size == size {
+		return c.u, nil
+	}
+	u := &Usage{}
+	if size >= 0 {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = fmt.Sscanf(string(data), "%d %d", &u.Objects, &u.Bytes); err != nil {
+			return nil, &ErrCorruptIndex{File: fn, Err: err}
+		}
+	}
+	usages[fn] = cachedUsage{u: u, modTime: modTime, size: size}
+	return u, nil
+}
+
+// writes the usage into the realm's usage file. Must be called with usageLock held.
+func writeUsage(conf Config, u *Usage) error {
+	fn := filepath.Join(conf.IndexDir, UsageFile)
+	if err := ioutil.WriteFile(fn+SuffTemp, []byte(fmt.Sprintf("%d %d\n", u.Objects, u.Bytes)), 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(fn+SuffTemp, fn); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(fn); err == nil {
+		usages[fn] = cachedUsage{u: u, modTime: fi.ModTime(), size: fi.Size()}
+	} else {
+		delete(usages, fn)
+	}
+	return nil
+}
+
+// returns the usage of the realm
+func RealmUsage(realm string) (Usage, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return Usage{}, err
+	}
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	u, err := readUsage(conf)
+	if err != nil {
+		return Usage{}, err
+	}
+	return *u, nil
+}
+
+// the object and the bytes reserved by a put (or append) in progress:
+// the bytes are reserved as they are read (see limitedReader)
+type quotaReservation struct {
+	conf     Config
+	fn       string // the usage file
+	uploaded uint64 // the bytes of the open uploads, at the check
+	bytes    uint64 // reserved so far
+	released bool
+}
+
+// checks the object count quota, returns the limit of the object's size
+// (0: unlimited), and whether exceeding it is ErrQuotaExceeded (not ErrTooLarge).
+// The open resumable uploads (but the busy ones, which are being appended
+// to or finished, so reserved) count as objects, with the bytes received so far.
+//
+// If a quota is configured, an object is reserved, which must be released
+// (or committed by addUsage) when the put finishes.
+func checkQuota(conf Config) (limit uint64, quota bool, res *quotaReservation, err error) {
+	limit = conf.MaxObjectSize
+	if conf.MaxBytes == 0 && conf.MaxObjects == 0 {
+		return limit, false, nil, nil
+	}
+	uploads, uploaded, err := openUploads(conf)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	u, err := readUsage(conf)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	fn := filepath.Join(conf.IndexDir, UsageFile)
+	r, ok := reserved[fn]
+	if !ok {
+		r = &Usage{}
+		reserved[fn] = r
+	}
+	if conf.MaxObjects > 0 && u.Objects+r.Objects+uploads >= conf.MaxObjects {
+		return 0, true, nil, ErrQuotaExceeded
+	}
+	if conf.MaxBytes > 0 {
+		used := u.Bytes + r.Bytes + uploaded
+		if used >= conf.MaxBytes {
+			return 0, true, nil, ErrQuotaExceeded
+		}
+		if left := conf.MaxBytes - used; limit == 0 || left < limit {
+			limit, quota = left, true
+		}
+	}
+	r.Objects++
+	return limit, quota, &quotaReservation{conf: conf, fn: fn, uploaded: uploaded}, nil
+}
+
+// reserves n more bytes, returns ErrQuotaExceeded if they do not fit
+func (res *quotaReservation) take(n uint64) error {
+	if res == nil || n == 0 {
+		return nil
+	}
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	u, err := readUsage(res.conf)
+	if err != nil {
+		return err
+	}
+	r := reserved[res.fn]
+	if res.conf.MaxBytes > 0 && u.Bytes+r.Bytes+res.uploaded+n > res.conf.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	r.Bytes += n
+	res.bytes += n
+	return nil
+}
+
+// releases the reservation. Must be called with usageLock held.
+func (res *quotaReservation) releaseLocked() {
+	if res == nil || res.released {
+		return
+	}
+	res.released = true
+	r := reserved[res.fn]
+	r.Objects--
+	r.Bytes -= res.bytes
+}
+
+// releases the reservation of the failed put (or of the append)
+func (res *quotaReservation) release() {
+	if res == nil {
+		return
+	}
+	usageLock.Lock()
+	res.releaseLocked()
+	usageLock.Unlock()
+}
+
+// adds the stored object to the realm's usage, releasing its reservation
+func addUsage(conf Config, size uint64, res *quotaReservation) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	res.releaseLocked()
+	u, err := readUsage(conf)
+	if err != nil {
+		logger.Errorf("cannot read usage: %s", err)
+		return
+	}
+	u.Objects++
+	u.Bytes += size
+	if err = writeUsage(conf, u); err != nil {
+		logger.Errorf("cannot write usage: %s", err)
+	}
+}
+
+// removes the unstaged object from the realm's usage
+func subUsage(conf Config, size uint64) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	u, err := readUsage(conf)
+	if err != nil {
+		logger.Errorf("cannot read usage: %s", err)
+		return
+	}
+	if u.Objects > 0 {
+		u.Objects--
+	}
+	if u.Bytes > size {
+		u.Bytes -= size
+	} else {
+		u.Bytes = 0
+	}
+	if err = writeUsage(conf, u); err != nil {
+		logger.Errorf("cannot write usage: %s", err)
+	}
+}
+
+// wraps data to return ErrTooLarge (or ErrQuotaExceeded) after the size
+// allowed for an object of the realm. The returned reservation (see
+// checkQuota) must be released or committed.
+func limitData(conf Config, data io.Reader) (io.Reader, *quotaReservation, error) {
+	limit, quota, res, err := checkQuota(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit > 0 {
+		tooLarge := ErrTooLarge
+		if quota {
+			tooLarge = ErrQuotaExceeded
+		}
+		data = &limitedReader{r: data, left: limit, err: tooLarge, res: res}
+	}
+	return data, res, nil
+}
+
+// returns at most limit bytes of the underlying reader, and err after that.
+// The bytes read are reserved in res (if not nil).
+type limitedReader struct {
+	r     io.Reader
+	left  uint64
+	err   error
+	res   *quotaReservation
+	extra [1]byte
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left == 0 {
+		// is there more? (a reader may return 0 bytes without an error)
+		for i := 0; i < 100; i++ {
+			n, err := l.r.Read(l.extra[:])
+			if n > 0 {
+				return 0, l.err
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.ErrNoProgress
+	}
+	if uint64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= uint64(n)
+	if e := l.res.take(uint64(n)); e != nil {
+		return 0, e
+	}
+	return n, err
+}
+
+// RecomputeUsage counts the objects of the realm (in the staging dir and
+// the tars' cdbs) and rewrites the usage file
+func RecomputeUsage(realm string) (Usage, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return Usage{}, err
+	}
+	var u Usage
+	err = walkInfos(realm, conf, func(info Info) error {
+		if info.Get(InfoPref+"Chunk-Of") == "" {
+			u.Objects++
+			size, _ := strconv.ParseUint(info.Get(InfoPref+"Original-Size"), 10, 64)
+			u.Bytes += size
+		}
+		return nil
+	})
+	if err != nil {
+		return u, err
+	}
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	if err = writeUsage(conf, &u); err != nil {
+		return u, err
+	}
+	logger.Infof("usage of %s: %d objects, %d bytes", realm, u.Objects, u.Bytes)
+	return u, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrCanceled is returned when the work is canceled (opts.Cancel is closed)
+var ErrCanceled = errors.New("canceled")
+
+// options for Compact and CompactIndices
+type CompactOptions struct {
+	DryRun  bool // only report what would be done
+	Workers int  // number of realms compacted concurrently by CompactAll
+	// closing Cancel stops the work at the next safe point: Compact between
+	// the tars, CompactIndices between the levels, Check between the tars,
+	// DeDupRealm between the content hashes
+	Cancel <-chan struct{}
+	// Progress is called after each step (tar created, level merged, tar
+	// checked, content hash deduplicated)
+	Progress func(step string)
+}
+
+func (opts *CompactOptions) dryRun() bool {
+	return opts != nil && opts.DryRun
+}
+
+// returns whether the work is canceled
+func (opts *CompactOptions) canceled() bool {
+	if opts == nil || opts.Cancel == nil {
+		return false
+	}
+	select {
+	case <-opts.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// reports the finished step
+func (opts *CompactOptions) progress(format string, args ...interface{}) {
+	if opts != nil && opts.Progress != nil {
+		opts.Progress(fmt.Sprintf(format, args...))
+	}
+}
+
+// report of a (dry-run) compaction
+type CompactReport struct {
+	Realm       string
+	DryRun      bool
+	DedupLinks  int          // number of symlinks created by DeDup
+	Tars        []TarReport  // tars created
+	IndexMerges []IndexMerge // cdbs merged
+	TarMerges   []TarMerge   // undersized tars merged by MergeTars
+}
+
+// a tar created by Compact
+type TarReport struct {
+	Name    string
+	Objects int
+	Size    uint64 // estimated size (in dry-run mode)
+}
+
+// a merge of cdbs done by CompactIndices
+type IndexMerge struct {
+	Level   uint     // level of the sources
+	Sources []string // merged cdbs
+	Dest    string   // the result, at the next level
+}
+
+// a merge of undersized tars done by MergeTars
+type TarMerge struct {
+	Sources []string // merged tars
+	Dest    string   // the result
+	Objects int
+	Size    uint64
+}
+
+// returns the sum of the tars' sizes
+func (r *CompactReport) TarSize() uint64 {
+	size := uint64(0)
+	for _, tr := range r.Tars {
+		size += tr.Size
+	}
+	return size
+}
+
+func (r *CompactReport) String() string {
+	buf := bytes.NewBuffer(nil)
+	verb := "created"
+	if r.DryRun {
+		verb = "would create"
+	}
+	fmt.Fprintf(buf, "%s: DeDup %s %d links\n", r.Realm, verb, r.DedupLinks)
+	fmt.Fprintf(buf, "%s: %s %d tars (%.03fMb)\n", r.Realm, verb, len(r.Tars),
+		float64(r.TarSize())/1024/1024)
+	for _, tr := range r.Tars {
+		fmt.Fprintf(buf, "  %s: %d objects, %.03fMb\n", tr.Name, tr.Objects,
+			float64(tr.Size)/1024/1024)
+	}
+	verb = "merged"
+	if r.DryRun {
+		verb = "would merge"
+	}
+	for _, m := range r.IndexMerges {
+		fmt.Fprintf(buf, "%s: L%02d %s %d cdbs into %s\n", r.Realm, m.Level, verb,
+			len(m.Sources), m.Dest)
+		for _, fn := range m.Sources {
+			fmt.Fprintf(buf, "  %s\n", fn)
+		}
+	}
+	for _, m := range r.TarMerges {
+		fmt.Fprintf(buf, "%s: %s %d tars into %s (%d objects, %.03fMb)\n", r.Realm,
+			verb, len(m.Sources), m.Dest, m.Objects, float64(m.Size)/1024/1024)
+		for _, fn := range m.Sources {
+			fmt.Fprintf(buf, "  %s\n", fn)
+		}
+	}
+	return buf.String()
+}
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/tgulacsi/go-cdb"
@@ -56,7 +57,97 @@ var (
 //At higher levels, the cdbs contains only "/%d" signs (which cdb,
 //only a number) and that sign is which zero-level cdb. So at this level an
 //additional lookup is required.
+//
+//Chunked objects are reassembled transparently, the deleted ones are NotFound.
 func Get(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
+	defer func(start time.Time) {
+		reader = realmStats(realm).get(start, reader, err)
+	}(time.Now())
+	if err = checkDeleted(realm, uuid); err != nil {
+		return
+	}
+	if info, reader, err = get(realm, uuid); err != nil {
+		return
+	}
+	if info.Get(InfoPref+"Chunks") != "" {
+		if reader, err = newChunkReader(realm, info, reader); err != nil {
+			logger.Errorf("cannot read manifest of %s@%s: %s", uuid, realm, err)
+		}
+	}
+	return
+}
+
+// GetRaw returns the object as it is stored (not decoded), with its
+// Content-Encoding ("" if it is not encoded) - see Decode.
+// Chunked objects are reassembled (and decoded), as Get does.
+func GetRaw(realm string, uuid UUID) (info Info, reader io.Reader, encoding string, err error) {
+	defer func(start time.Time) {
+		reader = realmStats(realm).get(start, reader, err)
+	}(time.Now())
+	if err = checkDeleted(realm, uuid); err != nil {
+		return
+	}
+	if info, reader, err = getRaw(realm, uuid); err != nil {
+		return
+	}
+	encoding = info.Get("Content-Encoding")
+	if info.Get(InfoPref+"Chunks") != "" {
+		if reader, err = Decode(reader, encoding); err != nil {
+			return
+		}
+		encoding = ""
+		if reader, err = newChunkReader(realm, info, reader); err != nil {
+			logger.Errorf("cannot read manifest of %s@%s: %s", uuid, realm, err)
+		}
+	}
+	return
+}
+
+// Decode decodes the reader returned by GetRaw, according to the encoding
+func Decode(reader io.Reader, encoding string) (io.Reader, error) {
+	var err error
+	if c, ok := reader.(*closer); ok {
+		c.Reader, err = decodeReader(c.Reader, encoding)
+		return c, err
+	}
+	return decodeReader(reader, encoding)
+}
+
+// returns NotFound if the key has been deleted
+func checkDeleted(realm string, uuid UUID) error {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	if _, deleted, err := isDeleted(conf, uuid); err != nil {
+		return err
+	} else if deleted {
+		return NotFound
+	}
+	return nil
+}
+
+// returns the object (decoded), following the references to moved data
+func get(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
+	if info, reader, err = getRaw(realm, uuid); err != nil {
+		return
+	}
+	reader, err = Decode(reader, info.Get("Content-Encoding"))
+	return
+}
+
+// returns the object as it is stored, following the references to moved data
+func getRaw(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
+	info, reader, err = find(realm, uuid)
+	if moved, ok := err.(*refMovedError); ok {
+		logger.Infof("data of %s@%s is read through %s", uuid, realm, moved.Key)
+		_, reader, err = find(realm, moved.Key)
+	}
+	return
+}
+
+// finds the object (the reader is not decoded)
+func find(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
 	conf, err := ReadConf("", realm)
 	if err != nil {
 		logger.Errorf("cannot read config: %s", err)
@@ -65,7 +156,7 @@ func Get(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
 	tries := 0
 	for tries < 3 {
 		// L00
-		if info, reader, err = findAtStaging(uuid, conf.StagingDir); err == nil {
+		if info, reader, err = findAtStaging(conf, uuid); err == nil {
 			//logger.Printf("found at staging: %s", info)
 			return
 		} else if !os.IsNotExist(err) {
@@ -77,16 +168,20 @@ func Get(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
 			return
 		}
 		logger.Debugf("findAtLevelZero(%s, %s)", realm, uuid)
-		if info, reader, err = findAtLevelZero(realm, uuid); err == nil {
+		if info, reader, err = findAtLevelZero(conf, realm, uuid); err == nil {
 			//logger.Printf("found at level zero: %s", info)
 			return
+		} else if _, ok := err.(*refMovedError); ok {
+			return
 		}
 		if err == NotFound {
-			if err = fillTarCache(realm, conf.TarDir, false); err != nil {
+			if err = fillTarCache(realm, conf.TarDir, conf.ColdDir, false); err != nil {
 				return
 			}
 			logger.Debugf("findAtLevelHigher(%s, %s)", realm, uuid)
-			if info, reader, err = findAtLevelHigher(realm, uuid); err == nil {
+			if info, reader, err = findAtLevelHigher(conf, realm, uuid); err == nil {
+				return
+			} else if _, ok := err.(*refMovedError); ok {
 				return
 			}
 			// logger.Debug("ERR: ", err, " ? ", os.IsNotExist(err))
@@ -127,7 +222,7 @@ func FillCaches(force bool) error {
 		if err = fillCdbCache(realm, conf.IndexDir, force); err != nil {
 			return err
 		}
-		if err = fillTarCache(realm, conf.TarDir, force); err != nil {
+		if err = fillTarCache(realm, conf.TarDir, conf.ColdDir, force); err != nil {
 			return err
 		}
 	}
@@ -142,9 +237,11 @@ func fillCdbCache(realm string, indexdir string, force bool) error {
 	if !force && cdbFiles != nil && len(cdbFiles) > 0 {
 		cf, ok := cdbFiles[realm]
 		if ok && cf != nil && len(cf) > 0 {
+			cacheStat(realm, false, true)
 			return nil
 		}
 	}
+	cacheStat(realm, false, false)
 
 	cf := make([][]string, 1, 10)
 	err := walkCdbFiles(realm, indexdir, func(level int, fn string) error {
@@ -202,22 +299,28 @@ func walkCdbFiles(realm, indexdir string, todo func(level int, fn string) error)
 	return nil
 }
 
-func fillTarCache(realm string, tardir string, force bool) error {
+func fillTarCache(realm string, tardir, colddir string, force bool) error {
 	cacheLock.Lock()
 	defer cacheLock.Unlock()
 	if !force && tarFiles != nil && len(tarFiles) > 0 {
 		tf, ok := tarFiles[realm]
 		if ok && tf != nil && len(tf) > 0 {
+			cacheStat(realm, true, true)
 			return nil
 		}
 	}
+	cacheStat(realm, true, false)
 
 	tf := make(map[string]string, 1000)
-	err := walkTarFiles(realm, tardir, func(uuid, fn string) error {
+	fill := func(uuid, fn string) error {
 		tf[filepath.Base(fn)] = fn
 		tf[uuid] = fn
 		return nil
-	})
+	}
+	err := walkTarFiles(realm, tardir, fill)
+	if err == nil && colddir != "" {
+		err = walkTarFiles(realm, colddir, fill)
+	}
 	if err != nil {
 		logger.Error("error with fillTarCache: ", err)
 	}
@@ -236,17 +339,10 @@ func walkTarFiles(realm, tardir string, todo func(uuid, fn string) error) error
 					return nil
 				}
 			} else {
-				if strings.HasSuffix(info.Name(), ".tar") {
-					bn := info.Name()
-					uuid := bn[:len(bn)-4] //213-uuid.tar
-					p := strings.LastIndex(uuid, "-")
-					if p >= 0 {
-						uuid = uuid[p+1:]
-					} else if len(uuid) > 32 {
-						uuid = uuid[len(uuid)-32:]
-					}
-
-					return todo(uuid, fn)
+				// the compressed cold tars are walked by their logical name
+				fn = coldTarName(fn)
+				if strings.HasSuffix(fn, ".tar") {
+					return todo(tarUUID(filepath.Base(fn)), fn)
 				}
 			}
 			return nil
@@ -257,7 +353,22 @@ func walkTarFiles(realm, tardir string, todo func(uuid, fn string) error) error
 	return err
 }
 
-func findAtLevelHigher(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
+// returns the uuid part of the tar's basename (213-uuid.tar)
+func tarUUID(tarfn_b string) string {
+	uuid := strings.TrimSuffix(tarfn_b, ".tar")
+	// realm-time-uuid (see newTarName), where the uuid may contain '-', too
+	if n := len(uuid) - 22; n > 0 && uuid[n-1] == '-' {
+		return uuid[n:]
+	}
+	if p := strings.LastIndex(uuid, "-"); p >= 0 {
+		uuid = uuid[p+1:]
+	} else if len(uuid) > 32 {
+		uuid = uuid[len(uuid)-32:]
+	}
+	return uuid
+}
+
+func findAtLevelHigher(conf Config, realm string, uuid UUID) (info Info, reader io.Reader, err error) {
 	var tarfn_b string
 	cacheLock.RLock()
 	defer cacheLock.RUnlock()
@@ -316,7 +427,7 @@ func findAtLevelHigher(realm string, uuid UUID) (info Info, reader io.Reader, er
 			err = NotFound
 			return
 		}
-		info, reader, err = GetFromCdb(uuid, tarfn+".cdb")
+		info, reader, err = getFromCdb(conf, uuid, tarfn+".cdb")
 		logger.Debug("found ", realm, "/", uuid, " in ",
 			tarfn, "(", tarfn_b, "): ", info)
 	} else {
@@ -325,13 +436,61 @@ func findAtLevelHigher(realm string, uuid UUID) (info Info, reader io.Reader, er
 	return
 }
 
-func GetFromCdb(uuid UUID, cdb_fn string) (info Info, reader io.Reader, err error) {
+// the referenced data has been moved (i.e. merged by MergeTars), so it must be
+// read through the key of the referenced object
+type refMovedError struct {
+	Key UUID
+}
+
+func (e *refMovedError) Error() string {
+	return "referenced data has been moved, read " + e.Key.String()
+}
+
+// returns the tar of the referenced data (stripping the reference from the
+// info) in the tar or the cold dir, or a refMovedError if that tar is gone
+func refTarfn(info *Info, conf Config, from string) (string, error) {
+	refTar, refKey := info.Get(InfoPref+"Ref-Tar"), info.Get(InfoPref+"Ref-Key")
+	info.Del(InfoPref + "Ref-Tar")
+	info.Del(InfoPref + "Ref-Key")
+	for _, dir := range []string{conf.TarDir, conf.ColdDir} {
+		if dir == "" {
+			continue
+		}
+		if tarfn := tarPath(dir, refTar); tarExists(tarfn) {
+			return tarfn, nil
+		}
+	}
+	key, err := UUIDFromString(refKey)
+	if err != nil {
+		return "", &ErrCorruptIndex{File: from, Key: info.Key.String(), Err: err}
+	}
+	logger.Debug("referenced ", refTar, " of ", info.Key, " is gone")
+	return "", &refMovedError{Key: key}
+}
+
+// returns the info and the (decoded) data of uuid from the cdb of the realm
+// configured by conf
+func GetFromCdb(conf Config, uuid UUID, cdb_fn string) (info Info, reader io.Reader, err error) {
+	if info, reader, err = getFromCdb(conf, uuid, cdb_fn); err != nil {
+		return
+	}
+	reader, err = Decode(reader, info.Get("Content-Encoding"))
+	return
+}
+
+// returns the info and the data (as stored) of uuid from the cdb
+func getFromCdb(conf Config, uuid UUID, cdb_fn string) (info Info, reader io.Reader, err error) {
 	db, err := cdb.Open(cdb_fn)
-	defer db.Close()
 	if err != nil {
+		if os.IsNotExist(err) { // merged (MergeTars) since the cache fill
+			logger.Info("cdb ", cdb_fn, " is gone")
+			err = NotFound
+			return
+		}
 		logger.Error("cannot open ", cdb_fn, ": ", err)
 		return
 	}
+	defer db.Close()
 	data, err := db.Data(uuid.Bytes())
 	if err != nil {
 		if err == io.EOF || err == NotFound {
@@ -352,6 +511,17 @@ func GetFromCdb(uuid UUID, cdb_fn string) (info Info, reader io.Reader, err erro
 		logger.Error("cannot read info from ", data, ": ", err)
 		return
 	}
+	if inline := info.Get(InfoPref + "Inline"); inline != "" {
+		info.Del(InfoPref + "Inline")
+		data, err = base64.StdEncoding.DecodeString(inline)
+		if err != nil {
+			logger.Error("cannot decode inline data of ", uuid, " in ", cdb_fn, ": ", err)
+			return
+		}
+		logger.Debug("GetFromCdb found inline ", uuid, " in ", cdb_fn)
+		reader = bytes.NewReader(data)
+		return
+	}
 	if info.Dpos == 0 {
 		logger.Warn("got zero Dpos from ", cdb_fn, " for ", uuid)
 		err = NotFound
@@ -360,7 +530,17 @@ func GetFromCdb(uuid UUID, cdb_fn string) (info Info, reader io.Reader, err erro
 	ocdb := FindLinkOrigin(cdb_fn, true)
 	//logger.Printf("cdb_fn=%s == %s", cdb_fn, ocdb)
 	tarfn := ocdb[:len(ocdb)-4]
-	reader, err = ReadItem(tarfn, int64(info.Dpos))
+	if info.Get(InfoPref+"Ref-Tar") != "" {
+		// the data is in another tar (global deduplication)
+		if tarfn, err = refTarfn(&info, conf, cdb_fn); err != nil {
+			return
+		}
+	}
+	reader, err = readTarItem(tarfn, int64(info.Dpos))
+	if err != nil && os.IsNotExist(err) {
+		logger.Info("tar ", tarfn, " is gone")
+		return info, nil, NotFound
+	}
 	if err != nil {
 		logger.Error("GetFromCdb(", uuid, ", ", cdb_fn,
 			") -> ReadItem(", tarfn, ", ", info.Dpos, ") error: ", err)
@@ -382,7 +562,7 @@ func fileExists(fn string) bool {
 	return false
 }
 
-func findAtLevelZero(realm string, uuid UUID) (info Info, reader io.Reader, err error) {
+func findAtLevelZero(conf Config, realm string, uuid UUID) (info Info, reader io.Reader, err error) {
 	cacheLock.RLock()
 	defer cacheLock.RUnlock()
 	if cdbFiles[realm] == nil || len(cdbFiles[realm]) == 0 || len(cdbFiles[realm][0]) == 0 {
@@ -392,7 +572,7 @@ func findAtLevelZero(realm string, uuid UUID) (info Info, reader io.Reader, err
 	}
 	logger.Debugf("L00 files at %s: %d", realm, len(cdbFiles[realm][0]))
 	for _, cdb_fn := range cdbFiles[realm][0] {
-		info, reader, err = GetFromCdb(uuid, cdb_fn)
+		info, reader, err = getFromCdb(conf, uuid, cdb_fn)
 		switch err {
 		case nil:
 			logger.Debugf("L00 found %s in %s: %s", uuid, cdb_fn, info)
@@ -409,9 +589,9 @@ func findAtLevelZero(realm string, uuid UUID) (info Info, reader io.Reader, err
 	return info, nil, NotFound
 }
 
-func findAtStaging(uuid UUID, path string) (info Info, reader io.Reader, err error) {
+func findAtStaging(conf Config, uuid UUID) (info Info, reader io.Reader, err error) {
 	uuid_s := uuid.String()
-	ifn := filepath.Join(path, uuid_s[:2], uuid_s+SuffInfo)
+	ifn := filepath.Join(conf.StagingDir, uuid_s[:2], uuid_s+SuffInfo)
 	ifh, err := os.Open(ifn)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -420,17 +600,25 @@ func findAtStaging(uuid UUID, path string) (info Info, reader io.Reader, err err
 		}
 		return
 	}
-	logger.Debug("L-1 found ", uuid_s, " at ", path, " as ", ifh)
+	logger.Debug("L-1 found ", uuid_s, " at ", conf.StagingDir, " as ", ifh)
 	info, err = ReadInfo(ifh)
 	_ = ifh.Close()
 	if err != nil {
 		logger.Error("cannot read info file ", ifh, ": ", err)
 		return
 	}
+	if info.Get(InfoPref+"Ref-Tar") != "" && !fileExists(ifn[:len(ifn)-len(SuffInfo)]+SuffData) {
+		// deduplicated at upload into a reference to a tar
+		tarfn, err := refTarfn(&info, conf, ifn)
+		if err != nil {
+			return info, nil, err
+		}
+		reader, err = readTarItem(tarfn, int64(info.Dpos))
+		return info, reader, err
+	}
 	// var suffixes = []string{SuffData + "bz2", SuffData + "gz", SuffLink, SuffData}
 	var suffixes = []string{SuffData, SuffLink}
 	var fn string
-	ce := info.Get("Content-Encoding")
 	for _, suffix := range suffixes {
 		fn = ifn[:len(ifn)-len(SuffInfo)] + suffix
 		if fileExists(fn) {
@@ -449,27 +637,35 @@ func findAtStaging(uuid UUID, path string) (info Info, reader io.Reader, err err
 					logger.Error("cannot read symlink info ", ifh_o, ": ", err)
 					return info, nil, err
 				}
-				ce = info_o.Get("Content-Type")
+				// the data is encoded as the original's
+				if ce := info_o.Get("Content-Encoding"); ce != "" {
+					info.Add("Content-Encoding", ce)
+				} else {
+					info.Del("Content-Encoding")
+				}
 			}
 			fh, err := os.Open(fn)
 			if err != nil {
 				logger.Error("cannot open ", fn, ": ", err)
 				return Info{}, nil, err
 			}
-			switch ce {
-			case "bz2":
-				reader, err = bzip2.NewReader(fh), nil
-			case "gzip":
-				reader, err = gzip.NewReader(fh)
-			default:
-				reader, err = fh, nil
-			}
-			return info, reader, err
+			return info, fh, nil
 		}
 	}
 	return Info{}, nil, os.ErrNotExist
 }
 
+// wraps r with a decompressor, according to the given Content-Encoding
+func decodeReader(r io.Reader, ce string) (io.Reader, error) {
+	switch ce {
+	case "bzip2", "bz2":
+		return bzip2.NewReader(r), nil
+	case "gzip", "gz":
+		return gzip.NewReader(r)
+	}
+	return r, nil
+}
+
 var suffopeners = []suffOpener{
 	suffOpener{SuffData + "bz2",
 		func(r io.Reader) (io.Reader, error) {
@@ -26,6 +26,7 @@ import (
 	"os"
 	// "runtime/pprof"
 	"syscall"
+	"time"
 	"unosoft.hu/aostor"
 )
 
@@ -41,6 +42,15 @@ func main() {
 	flag.StringVar(&hostport, "http", "", "host:port")
 	todo_tar := flag.Bool("t", false, "shovel tar to dir")
 	todo_realm := flag.String("r", "", "compact realm")
+	dry_run := flag.Bool("n", false, "dry run: only report what would be done")
+	todo_merge := flag.Bool("m", false, "merge the undersized tars of the realm")
+	todo_all := flag.Bool("all", false, "compact all realms")
+	workers := flag.Int("w", 0, "number of realms compacted concurrently (with -all)")
+	todo_sign := flag.String("sign", "", "print a signed URL of the key (with -r realm)")
+	expire := flag.Duration("e", time.Hour, "expiry of the signed URL")
+	todo_usage := flag.Bool("usage", false, "recompute the usage of the realm")
+	todo_cold := flag.Duration("cold", 0, "move the tars older than this to the cold dir")
+	todo_check := flag.Bool("check", false, "check the consistency of the realm")
 	flag.Parse()
 
 	var onChange aostor.NotifyFunc
@@ -48,7 +58,11 @@ func main() {
 		process, err := os.FindProcess(pid)
 		if hostport != "" {
 			onChange = func() {
-				resp, _ := http.Get("http://" + hostport + "/_signal")
+				req, _ := http.NewRequest("POST", "http://"+hostport+"/_admin/caches", nil)
+				if conf, err := aostor.ReadConf("", ""); err == nil && len(conf.AdminTokens) > 0 {
+					req.Header.Set("Authorization", "Bearer "+conf.AdminTokens[0])
+				}
+				resp, _ := http.DefaultClient.Do(req)
 				if resp != nil && resp.Body != nil {
 					resp.Body.Close()
 				}
@@ -87,11 +101,73 @@ func main() {
 			fmt.Println("OK")
 			onChange()
 		}
+	} else if *todo_realm != "" && *todo_sign != "" {
+		u, err := aostor.SignURL(*todo_realm, "/"+*todo_realm+"/"+*todo_sign,
+			time.Now().Add(*expire))
+		if err != nil {
+			fmt.Printf("ERROR signing %s: %s", *todo_sign, err)
+		} else {
+			fmt.Println(u)
+		}
+	} else if *todo_realm != "" && *todo_usage {
+		usage, err := aostor.RecomputeUsage(*todo_realm)
+		if err != nil {
+			fmt.Printf("ERROR computing the usage of %s: %s", *todo_realm, err)
+		} else {
+			fmt.Printf("%s: %d objects, %d bytes\n", *todo_realm, usage.Objects, usage.Bytes)
+		}
+	} else if *todo_realm != "" && *todo_check {
+		report, err := aostor.Check(*todo_realm, nil)
+		if report != nil {
+			fmt.Print(report)
+		}
+		if err != nil {
+			fmt.Printf("ERROR checking %s: %s", *todo_realm, err)
+		} else if len(report.Problems) == 0 {
+			fmt.Println("OK")
+		}
+	} else if *todo_all {
+		reports, err := aostor.CompactAll(onChange,
+			&aostor.CompactOptions{DryRun: *dry_run, Workers: *workers})
+		for _, report := range reports {
+			if report != nil {
+				fmt.Print(report)
+			}
+		}
+		if errs, ok := err.(aostor.CompactErrors); ok {
+			for realm, e := range errs {
+				fmt.Printf("ERROR compacting %s: %s\n", realm, e)
+			}
+		} else if err != nil {
+			fmt.Printf("ERROR compacting: %s", err)
+		} else if !*dry_run {
+			fmt.Println("OK")
+		}
+	} else if *todo_realm != "" && *todo_cold > 0 {
+		realm := *todo_realm
+		moved, err := aostor.Tier(realm, *todo_cold, onChange)
+		for _, fn := range moved {
+			fmt.Println("moved", fn)
+		}
+		if err != nil {
+			fmt.Printf("ERROR moving the tars of %s: %s", realm, err)
+		} else {
+			fmt.Println("OK")
+		}
 	} else if *todo_realm != "" {
 		realm := *todo_realm
-		if err := aostor.Compact(realm, onChange); err != nil {
+		compact := aostor.Compact
+		if *todo_merge {
+			compact = aostor.MergeTars
+		}
+		report, err := compact(realm, onChange,
+			&aostor.CompactOptions{DryRun: *dry_run})
+		if report != nil {
+			fmt.Print(report)
+		}
+		if err != nil {
 			fmt.Printf("ERROR compacting %s: %s", realm, err)
-		} else {
+		} else if !*dry_run {
 			if changed {
 				fmt.Println("no change")
 			} else {
@@ -102,7 +178,17 @@ func main() {
 		fmt.Printf(`Usage:
 prg -t tar dir [-p pid]
   or
-prg -r realm [-p pid]
+prg -r realm [-p pid] [-n] [-m]
+  or
+prg -r realm -cold 720h [-p pid]
+  or
+prg -all [-w workers] [-p pid] [-n]
+  or
+prg -r realm -sign key [-e 1h]
+  or
+prg -r realm -usage
+  or
+prg -r realm -check
 `)
 	}
 
@@ -0,0 +1,285 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+// This file is part of aostor.
+
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tgulacsi/aostor"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the maintenance endpoints (bearer token of admin_tokens, or from localhost
+// if none is configured):
+//
+//	GET /_admin/jobs - the last job of each realm
+//	GET /_admin/realm - the last job of the realm
+//	POST /_admin/realm/kind - starts a job (compact, index, dedup or check)
+//	DELETE /_admin/realm - cancels the running job of the realm
+//	POST /_admin/caches - refills the caches (as SIGUSR1)
+type adminHandler struct{}
+
+// a maintenance job
+type adminJob struct {
+	ID        int
+	Realm     string
+	Kind      string
+	State     string // running, done, failed or canceled
+	Started   time.Time
+	Ended     time.Time   `json:",omitempty"`
+	Steps     int         // number of finished steps
+	LastStep  string      `json:",omitempty"`
+	Report    interface{} `json:",omitempty"`
+	Error     string      `json:",omitempty"`
+	Canceling bool        `json:",omitempty"` // cancel requested
+	cancel    chan struct{}
+}
+
+// the jobs, at most one running per realm
+type adminJobs struct {
+	sync.Mutex
+	lastID int
+	jobs   map[string]*adminJob // the last job of each realm
+}
+
+var jobs = &adminJobs{jobs: make(map[string]*adminJob, 4)}
+
+type jobFunc func(realm string, opts *aostor.CompactOptions) (interface{}, error)
+
+// the kinds of the jobs
+var jobKinds = map[string]jobFunc{
+	"compact": func(realm string, opts *aostor.CompactOptions) (interface{}, error) {
+		return aostor.Compact(realm, func() { aostor.FillCaches(true) }, opts)
+	},
+	"index": func(realm string, opts *aostor.CompactOptions) (interface{}, error) {
+		return aostor.CompactIndices(realm, 0, func() { aostor.FillCaches(true) }, false, opts)
+	},
+	"dedup": func(realm string, opts *aostor.CompactOptions) (interface{}, error) {
+		n, err := aostor.DeDupRealm(realm, opts)
+		return struct{ DedupLinks int }{n}, err
+	},
+	"check": func(realm string, opts *aostor.CompactOptions) (interface{}, error) {
+		return aostor.Check(realm, opts)
+	},
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("admin got %s %s", r.Method, r.URL)
+	if !adminAuthorized(w, r) {
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_admin/"), "/")
+	realm, kind := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		realm, kind = path[:i], path[i+1:]
+	}
+	switch {
+	case path == "jobs" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, jobs.List())
+		return
+	case path == "caches" && r.Method == "POST":
+		if err := aostor.FillCaches(true); err != nil {
+			httpError(w, http.StatusInternalServerError, "error filling caches: %s", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct{ Filled bool }{true})
+		return
+	}
+	realmsLock.RLock()
+	configured := realms[realm]
+	realmsLock.RUnlock()
+	if !configured {
+		httpError(w, http.StatusNotFound, "unknown realm %s", realm)
+		return
+	}
+	switch {
+	case r.Method == "GET" && kind == "":
+		job, ok := jobs.Get(realm)
+		if !ok {
+			httpError(w, http.StatusNotFound, "no job of %s", realm)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case r.Method == "POST" && kind != "":
+		fun, ok := jobKinds[kind]
+		if !ok {
+			httpError(w, http.StatusNotFound, "unknown job %s", kind)
+			return
+		}
+		job, err := jobs.Start(realm, kind, fun)
+		if err != nil {
+			httpError(w, http.StatusConflict, "%s", err)
+			return
+		}
+		w.Header().Set("Location", "/_admin/"+realm)
+		writeJSON(w, http.StatusAccepted, job)
+	case r.Method == "DELETE" && kind == "":
+		job, ok := jobs.Cancel(realm)
+		if !ok {
+			httpError(w, http.StatusConflict, "no running job of %s", realm)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		httpError(w, http.StatusMethodNotAllowed, "%s %s is not allowed", r.Method, r.URL.Path)
+	}
+}
+
+// checks the admin token (or that the request is from localhost, if no
+// admin_tokens are configured)
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	conf, err := aostor.ReadConf("", "")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "cannot read config: %s", err)
+		return false
+	}
+	if len(conf.AdminTokens) == 0 {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return true
+		}
+		httpError(w, http.StatusForbidden, "admin access is allowed only from localhost")
+		return false
+	}
+	token := bearerToken(r)
+	if conf.CanAdmin(token) {
+		return true
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="_admin"`)
+		httpError(w, http.StatusUnauthorized, "authorization required")
+		return false
+	}
+	httpError(w, http.StatusForbidden, "the token has no admin access")
+	return false
+}
+
+// writes v as JSON
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("cannot encode %v: %s", v, err)
+	}
+}
+
+// returns a copy of the jobs
+func (js *adminJobs) List() []adminJob {
+	js.Lock()
+	defer js.Unlock()
+	list := make([]adminJob, 0, len(js.jobs))
+	for _, job := range js.jobs {
+		list = append(list, *job)
+	}
+	return list
+}
+
+// returns a copy of the last job of the realm
+func (js *adminJobs) Get(realm string) (adminJob, bool) {
+	js.Lock()
+	defer js.Unlock()
+	job, ok := js.jobs[realm]
+	if !ok {
+		return adminJob{}, false
+	}
+	return *job, true
+}
+
+// the maintenance work (admin job or scheduled compaction) running on
+// each realm: at most one at a time
+var (
+	realmWork     = make(map[string]string, 4)
+	realmWorkLock = sync.Mutex{}
+)
+
+// marks the work as running on the realm, if nothing is running there;
+// otherwise returns false and what is running
+func acquireRealm(realm, work string) (string, bool) {
+	realmWorkLock.Lock()
+	defer realmWorkLock.Unlock()
+	if running, ok := realmWork[realm]; ok {
+		return running, false
+	}
+	realmWork[realm] = work
+	return "", true
+}
+
+// marks the work of the realm (see acquireRealm) as finished
+func releaseRealm(realm string) {
+	realmWorkLock.Lock()
+	delete(realmWork, realm)
+	realmWorkLock.Unlock()
+}
+
+// starts the job in the background, if no other job (or scheduled
+// compaction) of the realm is running
+func (js *adminJobs) Start(realm, kind string, fun jobFunc) (adminJob, error) {
+	if running, ok := acquireRealm(realm, kind+" job"); !ok {
+		return adminJob{}, fmt.Errorf("%s of %s is running", running, realm)
+	}
+	js.Lock()
+	defer js.Unlock()
+	js.lastID++
+	job := &adminJob{ID: js.lastID, Realm: realm, Kind: kind, State: "running",
+		Started: time.Now(), cancel: make(chan struct{})}
+	js.jobs[realm] = job
+	opts := &aostor.CompactOptions{Cancel: job.cancel,
+		Progress: func(step string) {
+			js.Lock()
+			job.Steps++
+			job.LastStep = step
+			js.Unlock()
+		}}
+	go func() {
+		logger.Printf("starting job %d: %s of %s", job.ID, kind, realm)
+		report, err := fun(realm, opts)
+		defer releaseRealm(realm)
+		js.Lock()
+		defer js.Unlock()
+		job.Ended, job.Report = time.Now(), report
+		switch {
+		case err == aostor.ErrCanceled:
+			job.State = "canceled"
+		case err != nil:
+			job.State, job.Error = "failed", err.Error()
+		default:
+			job.State = "done"
+		}
+		logger.Printf("job %d (%s of %s) %s in %s", job.ID, kind, realm, job.State,
+			job.Ended.Sub(job.Started))
+	}()
+	return *job, nil
+}
+
+// cancels the running job of the realm; it stops at its next safe point
+func (js *adminJobs) Cancel(realm string) (adminJob, bool) {
+	js.Lock()
+	defer js.Unlock()
+	job, ok := js.jobs[realm]
+	if !ok || job.State != "running" {
+		return adminJob{}, false
+	}
+	if !job.Canceling {
+		job.Canceling = true
+		close(job.cancel)
+	}
+	return *job, true
+}
@@ -0,0 +1,286 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+// This file is part of aostor.
+
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"github.com/tgulacsi/aostor"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// read-only WebDAV view of the realms under /dav/realm/: the objects are
+// files named by their key, and by their original filename, where that is
+// unique in the realm. Only OPTIONS, PROPFIND, GET and HEAD are allowed.
+type davHandler struct{}
+
+const (
+	davPrefix = "/dav/"
+	davAllow  = "OPTIONS, PROPFIND, GET, HEAD"
+	// the listing of a realm is rebuilt after this long
+	davListingTTL = 10 * time.Second
+)
+
+// an object as a file: only what PROPFIND and GET need from its info
+type davEntry struct {
+	name, size, contentType, storedAt string
+	key                               aostor.UUID
+}
+
+// the files of a realm, by name
+type davListing struct {
+	sync.Mutex
+	built    time.Time
+	building bool
+	entries  map[string]davEntry
+}
+
+var (
+	davListings     = make(map[string]*davListing, 4)
+	davListingsLock = sync.Mutex{} // guards only davListings, not its elements
+)
+
+func (h davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("DAV got %s %s", r.Method, r.URL)
+	switch r.Method {
+	case "OPTIONS", "PROPFIND", "GET", "HEAD":
+	default:
+		w.Header().Set("Allow", davAllow)
+		httpError(w, http.StatusMethodNotAllowed, "read-only: %s is not allowed", r.Method)
+		return
+	}
+	if r.Method == "OPTIONS" {
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", davAllow)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, davPrefix)
+	if path == "" {
+		h.propfindRoot(w, r)
+		return
+	}
+	realm, name := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		realm, name = path[:i], path[i+1:]
+	}
+	realmsLock.RLock()
+	configured := realms[realm]
+	realmsLock.RUnlock()
+	if !configured {
+		httpError(w, http.StatusNotFound, "unknown realm %s", realm)
+		return
+	}
+	if !(realmHandler{realm}).authorize(w, r) {
+		return
+	}
+	if name == "" {
+		if r.Method != "PROPFIND" {
+			w.Header().Set("Allow", "OPTIONS, PROPFIND")
+			httpError(w, http.StatusMethodNotAllowed, "%s is a collection", r.URL.Path)
+			return
+		}
+		h.propfindRealm(w, r, realm)
+		return
+	}
+	if strings.Contains(name, "/") {
+		httpError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+		return
+	}
+	if r.Method != "PROPFIND" {
+		if _, err := aostor.UUIDFromString(name); err == nil {
+			realmHandler{realm}.get(w, r, name)
+			return
+		}
+	}
+	entries, err := listDav(realm)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "cannot list %s: %s", realm, err)
+		return
+	}
+	entry, ok := entries[name]
+	if !ok {
+		httpError(w, http.StatusNotFound, "%s not found", r.URL.Path)
+		return
+	}
+	if r.Method == "PROPFIND" {
+		davMultistatus(w, []davResponse{davFile(realm, entry)})
+		return
+	}
+	realmHandler{realm}.get(w, r, entry.key.String())
+}
+
+// returns the (cached) listing of the realm. The listing is built without
+// holding any lock; while it is being rebuilt, the old one is returned.
+// The returned map must not be modified.
+func listDav(realm string) (map[string]davEntry, error) {
+	davListingsLock.Lock()
+	l, ok := davListings[realm]
+	if !ok {
+		l = &davListing{}
+		davListings[realm] = l
+	}
+	davListingsLock.Unlock()
+
+	l.Lock()
+	if l.entries != nil && (l.building || time.Since(l.built) < davListingTTL) {
+		entries := l.entries
+		l.Unlock()
+		return entries, nil
+	}
+	l.building = true
+	l.Unlock()
+
+	entries, err := buildDavListing(realm)
+	l.Lock()
+	l.building = false
+	if err == nil {
+		l.built, l.entries = time.Now(), entries
+	}
+	l.Unlock()
+	return entries, err
+}
+
+// walks the infos of the realm for the listing
+func buildDavListing(realm string) (map[string]davEntry, error) {
+	entries := make(map[string]davEntry, 1024)
+	filenames := make(map[string]int, 1024)
+	filenameEntries := make(map[string]davEntry, 1024)
+	err := aostor.WalkInfos(realm, func(info aostor.Info) error {
+		key := info.Key.String()
+		entry := davEntry{name: key, key: info.Key,
+			size:        info.Get(aostor.InfoPref + "Original-Size"),
+			contentType: info.Get("Content-Type"),
+			storedAt:    info.Get(aostor.InfoPref + "Stored-At")}
+		entries[key] = entry
+		fn := info.Get(aostor.InfoPref + "Original-Filename")
+		if _, err := aostor.UUIDFromString(fn); fn != "" && err != nil {
+			if filenames[fn]++; filenames[fn] == 1 {
+				entry.name = fn
+				filenameEntries[fn] = entry
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the filenames shared by more objects are reachable only by the keys
+	for fn, n := range filenames {
+		if n == 1 {
+			entries[fn] = filenameEntries[fn]
+		}
+	}
+	return entries, nil
+}
+
+type davProp struct {
+	DisplayName   string `xml:"D:displayname,omitempty"`
+	ContentLength string `xml:"D:getcontentlength,omitempty"`
+	ContentType   string `xml:"D:getcontenttype,omitempty"`
+	LastModified  string `xml:"D:getlastmodified,omitempty"`
+	ResourceType  struct {
+		Collection *struct{} `xml:"D:collection,omitempty"`
+	} `xml:"D:resourcetype"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+// writes the 207 Multi-Status answer
+func davMultistatus(w http.ResponseWriter, responses []davResponse) {
+	b, err := xml.Marshal(struct {
+		XMLName   xml.Name      `xml:"D:multistatus"`
+		Xmlns     string        `xml:"xmlns:D,attr"`
+		Responses []davResponse `xml:"D:response"`
+	}{Xmlns: "DAV:", Responses: responses})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "cannot marshal: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207) // Multi-Status
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+}
+
+func davCollection(href, name string) davResponse {
+	resp := davResponse{Href: href, Status: "HTTP/1.1 200 OK",
+		Prop: davProp{DisplayName: name}}
+	resp.Prop.ResourceType.Collection = &struct{}{}
+	return resp
+}
+
+// the properties of the file: size, content type and upload time from the info
+func davFile(realm string, entry davEntry) davResponse {
+	prop := davProp{DisplayName: entry.name, ContentLength: entry.size,
+		ContentType: entry.contentType, LastModified: entry.storedAt}
+	if prop.ContentLength == "" {
+		prop.ContentLength = "0"
+	}
+	return davResponse{Href: davPrefix + realm + "/" + url.PathEscape(entry.name),
+		Prop: prop, Status: "HTTP/1.1 200 OK"}
+}
+
+// lists the realms as collections
+func (h davHandler) propfindRoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PROPFIND" {
+		w.Header().Set("Allow", "OPTIONS, PROPFIND")
+		httpError(w, http.StatusMethodNotAllowed, "%s is a collection", r.URL.Path)
+		return
+	}
+	responses := []davResponse{davCollection(davPrefix, "dav")}
+	if r.Header.Get("Depth") != "0" {
+		realmsLock.RLock()
+		for realm, configured := range realms {
+			if configured {
+				responses = append(responses, davCollection(davPrefix+realm+"/", realm))
+			}
+		}
+		realmsLock.RUnlock()
+	}
+	davMultistatus(w, responses)
+}
+
+// lists the files of the realm (for Depth: 1 and infinity, too - the
+// collection is flat)
+func (h davHandler) propfindRealm(w http.ResponseWriter, r *http.Request, realm string) {
+	responses := []davResponse{davCollection(davPrefix+realm+"/", realm)}
+	if r.Header.Get("Depth") != "0" {
+		entries, err := listDav(realm)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "cannot list %s: %s", realm, err)
+			return
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			responses = append(responses, davFile(realm, entries[name]))
+		}
+	}
+	davMultistatus(w, responses)
+}
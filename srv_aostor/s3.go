@@ -0,0 +1,748 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+// This file is part of aostor.
+
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/tgulacsi/aostor"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3-compatible gateway: the buckets are the realms, the objects are stored
+// under new keys by PutNamed, and found by their names.
+//
+//	GET / - ListBuckets
+//	GET /bucket?list-type=2 - ListObjectsV2
+//	HEAD /bucket - HeadBucket
+//	PUT, GET, HEAD, DELETE /bucket/name - PutObject, GetObject, HeadObject, DeleteObject
+//	POST /bucket/name?uploads - CreateMultipartUpload
+//	PUT /bucket/name?partNumber=n&uploadId=id - UploadPart
+//	POST /bucket/name?uploadId=id - CompleteMultipartUpload
+//	DELETE /bucket/name?uploadId=id - AbortMultipartUpload
+type s3Gateway struct{}
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// the time format of the XML answers
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	maxS3Keys    = 1000
+	maxS3Parts   = 10000
+)
+
+var (
+	errNoSuchBucket = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey    = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchUpload = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist."}
+	errBadDigest    = &s3Error{http.StatusBadRequest, "BadDigest",
+		"The Content-MD5 you specified did not match what we received."}
+	errSha256Mismatch = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch",
+		"The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errInvalidPart = &s3Error{http.StatusBadRequest, "InvalidPart",
+		"One or more of the specified parts could not be found."}
+	errInvalidPartOrder = &s3Error{http.StatusBadRequest, "InvalidPartOrder",
+		"The list of parts was not in ascending order."}
+	errInvalidRange = &s3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange",
+		"The requested range is not satisfiable"}
+	errTooLarge = &s3Error{http.StatusBadRequest, "EntityTooLarge",
+		"Your proposed upload exceeds the maximum allowed object size."}
+	errQuotaExceeded = &s3Error{http.StatusInsufficientStorage, "QuotaExceeded",
+		"The quota of the bucket is exceeded."}
+	errOperationAborted = &s3Error{http.StatusConflict, "OperationAborted",
+		"A conflicting conditional operation is currently in progress against this resource. Try again."}
+	errNotImplemented = &s3Error{http.StatusNotImplemented, "NotImplemented",
+		"A header or query you provided implies functionality that is not implemented."}
+)
+
+// starts the S3 gateway, if configured
+func prepareS3(conf *aostor.Config) *http.Server {
+	if conf.S3Hostport == "" {
+		return nil
+	}
+	if len(conf.S3Credentials) == 0 {
+		logger.Printf("no S3 credentials configured, every S3 request will be denied")
+	}
+	return &http.Server{
+		Addr:           conf.S3Hostport,
+		Handler:        s3Gateway{},
+		ReadTimeout:    30 * time.Minute,
+		WriteTimeout:   30 * time.Minute,
+		MaxHeaderBytes: 1 << 20, // 1Mb
+	}
+}
+
+func (g s3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("S3 got %s %s", r.Method, r.URL)
+	conf, err := aostor.ReadConf("", "")
+	if err != nil {
+		s3Fail(w, r, fmt.Errorf("cannot read config: %s", err))
+		return
+	}
+	payloadHash, err := verifySigV4(r, conf.S3Credentials, conf.S3Region)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	if payloadHash != "" {
+		awaited, e := hex.DecodeString(payloadHash)
+		if e != nil {
+			s3Fail(w, r, errSha256Mismatch)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{newDigestReader(r.Body, sha256.New(), awaited, errSha256Mismatch), r.Body}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		if r.Method != "GET" {
+			s3Fail(w, r, errNotImplemented)
+			return
+		}
+		g.listBuckets(w, r, conf.Realms)
+		return
+	}
+	bucket, name := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, name = path[:i], path[i+1:]
+	}
+	configured := false
+	for _, realm := range conf.Realms {
+		if realm == bucket {
+			configured = true
+			break
+		}
+	}
+	if !configured {
+		s3Fail(w, r, errNoSuchBucket)
+		return
+	}
+	q := r.URL.Query()
+	if name == "" {
+		switch r.Method {
+		case "GET":
+			g.listObjects(w, r, bucket)
+		case "HEAD":
+			w.WriteHeader(http.StatusOK)
+		default:
+			s3Fail(w, r, errNotImplemented)
+		}
+		return
+	}
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+	switch {
+	case r.Method == "POST" && uploads:
+		g.createUpload(w, r, bucket, name)
+	case r.Method == "PUT" && uploadID != "":
+		g.uploadPart(w, r, bucket, name, uploadID)
+	case r.Method == "POST" && uploadID != "":
+		g.completeUpload(w, r, bucket, name, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		g.abortUpload(w, r, bucket, name, uploadID)
+	case r.Method == "PUT":
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			s3Fail(w, r, errNotImplemented)
+			return
+		}
+		g.putObject(w, r, bucket, name)
+	case r.Method == "GET" || r.Method == "HEAD":
+		g.getObject(w, r, bucket, name)
+	case r.Method == "DELETE":
+		g.deleteObject(w, r, bucket, name)
+	default:
+		s3Fail(w, r, errNotImplemented)
+	}
+}
+
+// writes the error as XML (only its status for HEAD requests)
+func s3Fail(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*s3Error)
+	if !ok {
+		switch err {
+		case aostor.ErrTooLarge:
+			e = errTooLarge
+		case aostor.ErrQuotaExceeded:
+			e = errQuotaExceeded
+		case aostor.ErrUploadBusy:
+			e = errOperationAborted
+		default:
+			logger.Printf("S3 %s %s: %s", r.Method, r.URL, err)
+			e = &s3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+		}
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(e.Status)
+		return
+	}
+	s3XML(w, e.Status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+// writes the answer as XML
+func s3XML(w http.ResponseWriter, status int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		logger.Printf("cannot marshal %v: %s", v, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(b)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+func (g s3Gateway) listBuckets(w http.ResponseWriter, r *http.Request, realms []string) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	answer := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID, DisplayName string
+		}
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace}
+	answer.Owner.ID, answer.Owner.DisplayName = "aostor", "aostor"
+	for _, realm := range realms {
+		created := time.Time{}
+		if conf, err := aostor.ReadConf("", realm); err == nil {
+			if fi, err := os.Stat(conf.IndexDir); err == nil {
+				created = fi.ModTime()
+			}
+		}
+		answer.Buckets = append(answer.Buckets,
+			bucket{realm, created.UTC().Format(s3TimeFormat)})
+	}
+	s3XML(w, http.StatusOK, answer)
+}
+
+// ListObjectsV2 (the continuation token is the last listed name or common prefix)
+func (g s3Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	if lt := q.Get("list-type"); lt != "2" {
+		s3Fail(w, r, errNotImplemented)
+		return
+	}
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := maxS3Keys
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			s3Fail(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "bad max-keys " + mk})
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	after := q.Get("start-after")
+	token := q.Get("continuation-token")
+	if token != "" {
+		b, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			s3Fail(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument", "bad continuation-token"})
+			return
+		}
+		after = string(b)
+	}
+	objs, err := aostor.ListNames(bucket, prefix)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+
+	type content struct {
+		Key, LastModified, ETag string
+		Size                    uint64
+		StorageClass            string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	answer := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name, Prefix          string
+		Delimiter             string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount, MaxKeys     int
+		IsTruncated           bool
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}{Xmlns: s3Namespace, Name: bucket, Prefix: prefix, Delimiter: delimiter,
+		StartAfter: q.Get("start-after"), ContinuationToken: token, MaxKeys: maxKeys}
+
+	last := ""
+	for _, obj := range objs {
+		if obj.Name <= after || after != "" && delimiter != "" &&
+			strings.HasSuffix(after, delimiter) && strings.HasPrefix(obj.Name, after) {
+			continue
+		}
+		cp := ""
+		if delimiter != "" {
+			if i := strings.Index(obj.Name[len(prefix):], delimiter); i >= 0 {
+				cp = obj.Name[:len(prefix)+i+len(delimiter)]
+				if cp == last {
+					continue
+				}
+			}
+		}
+		if answer.KeyCount == maxKeys {
+			answer.IsTruncated = true
+			answer.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		answer.KeyCount++
+		if cp != "" {
+			answer.CommonPrefixes = append(answer.CommonPrefixes, commonPrefix{cp})
+			last = cp
+			continue
+		}
+		answer.Contents = append(answer.Contents, content{Key: obj.Name,
+			LastModified: obj.Stored.UTC().Format(s3TimeFormat),
+			ETag:         `"` + obj.ETag + `"`, Size: obj.Size, StorageClass: "STANDARD"})
+		last = obj.Name
+	}
+	s3XML(w, http.StatusOK, answer)
+}
+
+// returns the info of the object to be stored, from the request headers
+// (Content-Type, Content-Disposition and the x-amz-meta-* user metadata)
+func s3Info(header http.Header, name string) aostor.Info {
+	info := aostor.Info{}
+	info.SetFilename(dispositionFilename(header), mediaType(header.Get("Content-Type")))
+	if info.Get(aostor.InfoPref+"Original-Filename") == "" {
+		info.SetFilename(name, "")
+	}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			info.Add(k, strings.Join(v, ","))
+		}
+	}
+	return info
+}
+
+// wraps the body to check its Content-MD5, if given
+func checkContentMD5(r *http.Request) (io.Reader, error) {
+	cmd5 := r.Header.Get("Content-MD5")
+	if cmd5 == "" {
+		return r.Body, nil
+	}
+	awaited, err := base64.StdEncoding.DecodeString(cmd5)
+	if err != nil || len(awaited) != md5.Size {
+		return nil, &s3Error{http.StatusBadRequest, "InvalidDigest",
+			"The Content-MD5 you specified is not valid."}
+	}
+	return newDigestReader(r.Body, md5.New(), awaited, errBadDigest), nil
+}
+
+func (g s3Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	body, err := checkContentMD5(r)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	obj, err := aostor.PutNamed(bucket, name, "", s3Info(r.Header, name), body)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	logger.Printf("S3 stored %s/%s as %s", bucket, name, obj.Key)
+	w.Header().Set("ETag", `"`+obj.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g s3Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	obj, ok, err := aostor.LookupName(bucket, name)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	} else if !ok {
+		s3Fail(w, r, errNoSuchKey)
+		return
+	}
+	var (
+		info aostor.Info
+		data io.Reader = strings.NewReader("") // empty objects are not stored
+	)
+	if !obj.Key.IsEmpty() {
+		if info, data, err = aostor.Get(bucket, obj.Key); err != nil {
+			if err == aostor.NotFound || os.IsNotExist(err) {
+				err = errNoSuchKey
+			}
+			s3Fail(w, r, err)
+			return
+		}
+	}
+	if closable, ok := data.(io.Closer); ok {
+		defer closable.Close()
+	}
+	etag := `"` + obj.ETag + `"`
+	if inm := r.Header.Get("If-None-Match"); inm != "" && (inm == etag || inm == "*") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header := make(http.Header, 8)
+	info.Copy(header)
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "Content-Disposition" {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", obj.Stored.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	status, start, length := http.StatusOK, uint64(0), obj.Size
+	if rng := r.Header.Get("Range"); rng != "" {
+		var ok bool
+		if start, length, ok = parseRange(rng, obj.Size); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", obj.Size))
+			s3Fail(w, r, errInvalidRange)
+			return
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d",
+			start, start+length-1, obj.Size))
+	}
+	w.Header().Set("Content-Length", strconv.FormatUint(length, 10))
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	if start > 0 {
+		if err = aostor.Skip(data, int64(start)); err != nil {
+			logger.Printf("error skipping %d bytes of %s/%s: %s", start, bucket, name, err)
+			return
+		}
+	}
+	if _, err = io.CopyN(w, data, int64(length)); err != nil {
+		logger.Printf("error sending %s/%s: %s", bucket, name, err)
+	}
+}
+
+// parses a single byte range ("bytes=a-b", "bytes=a-" or "bytes=-n"),
+// returns its start and length
+func parseRange(rng string, size uint64) (start, length uint64, ok bool) {
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return 0, 0, false
+	}
+	rng = strings.TrimSpace(rng[6:])
+	i := strings.Index(rng, "-")
+	if i < 0 {
+		return 0, 0, false
+	}
+	from, to := strings.TrimSpace(rng[:i]), strings.TrimSpace(rng[i+1:])
+	var err error
+	if from == "" { // suffix
+		var n uint64
+		if n, err = strconv.ParseUint(to, 10, 64); err != nil || n == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, size > 0
+	}
+	if start, err = strconv.ParseUint(from, 10, 64); err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if to != "" {
+		if end, err = strconv.ParseUint(to, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+func (g s3Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	if err := aostor.DeleteNamed(bucket, name); err != nil && err != aostor.NotFound {
+		s3Fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// returns the directory of the multipart upload's parts
+func s3UploadDir(bucket, uploadID string) (string, error) {
+	conf, err := aostor.ReadConf("", bucket)
+	if err != nil {
+		return "", err
+	}
+	if uploadID == "" || strings.Trim(uploadID, "0123456789abcdef") != "" {
+		return "", errNoSuchUpload
+	}
+	return filepath.Join(conf.StagingDir, aostor.PartsDir, uploadID), nil
+}
+
+// opens the multipart upload: checks that it belongs to the name
+func openS3Upload(bucket, name, uploadID string) (string, error) {
+	dir, err := s3UploadDir(bucket, uploadID)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "name"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errNoSuchUpload
+		}
+		return "", err
+	}
+	if string(b) != name {
+		return "", errNoSuchUpload
+	}
+	return dir, nil
+}
+
+// opens the multipart upload marked busy (see aostor.LockParts), so it is
+// not counted in the quota nor expired while it is completed or aborted
+func lockS3Upload(bucket, name, uploadID string) (string, func(), error) {
+	dir, err := s3UploadDir(bucket, uploadID)
+	if err != nil {
+		return "", nil, err
+	}
+	unlock, err := aostor.LockParts(dir)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = openS3Upload(bucket, name, uploadID); err != nil {
+		unlock()
+		return "", nil, err
+	}
+	return dir, unlock, nil
+}
+
+// the name and the info of the object are kept in the upload dir,
+// in the "name" and "info" files
+func (g s3Gateway) createUpload(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	uploadID := hex.EncodeToString(id[:])
+	dir, err := s3UploadDir(bucket, uploadID)
+	if err == nil {
+		err = os.MkdirAll(dir, 0750)
+	}
+	if err == nil {
+		info := s3Info(r.Header, name)
+		if err = ioutil.WriteFile(filepath.Join(dir, "info"), info.Bytes(), 0640); err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, "name"), []byte(name), 0640)
+		}
+	}
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	s3XML(w, http.StatusOK, struct {
+		XMLName     xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket, Key string
+		UploadId    string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: name, UploadId: uploadID})
+}
+
+// stores the part into the upload dir (as the part number), answers with its MD5.
+// The part is spooled with the bucket's size limit and quota enforced.
+func (g s3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, name, uploadID string) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxS3Parts {
+		s3Fail(w, r, &s3Error{http.StatusBadRequest, "InvalidArgument",
+			fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive", maxS3Parts)})
+		return
+	}
+	dir, err := openS3Upload(bucket, name, uploadID)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	body, err := checkContentMD5(r)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	md5h := md5.New()
+	fh, err := aostor.SpoolUpload(bucket, io.TeeReader(body, md5h))
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	defer os.Remove(fh.Name()) // if not renamed
+	if err = fh.Close(); err == nil {
+		err = os.Rename(fh.Name(), filepath.Join(dir, strconv.Itoa(partNumber)))
+		if os.IsNotExist(err) { // aborted or expired since
+			err = errNoSuchUpload
+		}
+	}
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5h.Sum(nil)))
+	w.WriteHeader(http.StatusOK)
+}
+
+// stores the listed parts as one object, with the MD5 of the parts' MD5s
+// (and "-" the number of parts) as its ETag
+func (g s3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, name, uploadID string) {
+	conf, err := aostor.ReadConf("", bucket)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	dir, unlock, err := lockS3Upload(bucket, name, uploadID)
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	defer unlock()
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err = xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		if se, ok := err.(*s3Error); ok { // x-amz-content-sha256 mismatch
+			s3Fail(w, r, se)
+		} else {
+			s3Fail(w, r, &s3Error{http.StatusBadRequest, "MalformedXML",
+				"The XML you provided was not well-formed: " + err.Error()})
+		}
+		return
+	}
+	if len(req.Parts) == 0 {
+		s3Fail(w, r, &s3Error{http.StatusBadRequest, "MalformedXML", "no parts given"})
+		return
+	}
+	files := make([]*os.File, 0, len(req.Parts))
+	defer func() {
+		for _, fh := range files {
+			fh.Close()
+		}
+	}()
+	readers := make([]io.Reader, 0, len(req.Parts))
+	md5s := md5.New()
+	var size uint64
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			s3Fail(w, r, errInvalidPartOrder)
+			return
+		}
+		fh, err := os.Open(filepath.Join(dir, strconv.Itoa(part.PartNumber)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = errInvalidPart
+			}
+			s3Fail(w, r, err)
+			return
+		}
+		files = append(files, fh)
+		partHash := md5.New()
+		n, err := io.Copy(partHash, fh)
+		if err == nil {
+			_, err = fh.Seek(0, 0)
+		}
+		if err != nil {
+			s3Fail(w, r, err)
+			return
+		}
+		if size += uint64(n); conf.MaxObjectSize > 0 && size > conf.MaxObjectSize {
+			s3Fail(w, r, errTooLarge)
+			return
+		}
+		sum := partHash.Sum(nil)
+		if strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum) {
+			s3Fail(w, r, errInvalidPart)
+			return
+		}
+		md5s.Write(sum)
+		readers = append(readers, fh)
+	}
+	etag := fmt.Sprintf("%x-%d", md5s.Sum(nil), len(req.Parts))
+
+	fh, err := os.Open(filepath.Join(dir, "info"))
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	info, err := aostor.ReadInfo(fh)
+	fh.Close()
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	obj, err := aostor.PutNamed(bucket, name, etag, info, io.MultiReader(readers...))
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	logger.Printf("S3 stored %s/%s (%d parts) as %s", bucket, name, len(req.Parts), obj.Key)
+	if err = os.RemoveAll(dir); err != nil {
+		logger.Printf("cannot remove %s: %s", dir, err)
+	}
+	s3XML(w, http.StatusOK, struct {
+		XMLName               xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Location, Bucket, Key string
+		ETag                  string
+	}{Xmlns: s3Namespace, Location: "/" + bucket + "/" + name,
+		Bucket: bucket, Key: name, ETag: `"` + etag + `"`})
+}
+
+func (g s3Gateway) abortUpload(w http.ResponseWriter, r *http.Request, bucket, name, uploadID string) {
+	dir, unlock, err := lockS3Upload(bucket, name, uploadID)
+	if err == nil {
+		err = os.RemoveAll(dir)
+		unlock()
+	}
+	if err != nil {
+		s3Fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,276 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+// This file is part of aostor.
+
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4 verification (header and presigned URL forms)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// the allowed clock skew of the signed requests
+	maxSigV4Skew = 15 * time.Minute
+)
+
+// an S3 error (answered as XML)
+type s3Error struct {
+	Status        int
+	Code, Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errNoAccessKey  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId",
+		"The AWS Access Key Id you provided does not exist in our records."}
+	errSignature = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch",
+		"The request signature we calculated does not match the signature you provided."}
+	errExpired = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errSkewed  = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed",
+		"The difference between the request time and the server's time is too large."}
+)
+
+// the parsed signature of a request
+type sigV4 struct {
+	accessKey, date, region, service string
+	signedHeaders                    []string
+	signature                        string
+	amzDate                          time.Time
+	expires                          time.Duration // of the presigned URLs
+	presigned                        bool
+}
+
+// verifies the request's signature against the credentials (access key -> secret).
+// Returns the payload hash the body must match ("" if not verifiable).
+func verifySigV4(r *http.Request, creds map[string]string, region string) (string, error) {
+	sig, err := parseSigV4(r)
+	if err != nil {
+		return "", err
+	}
+	secret, ok := creds[sig.accessKey]
+	if !ok {
+		return "", errNoAccessKey
+	}
+	if sig.service != "s3" || sig.region != region {
+		return "", &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed",
+			fmt.Sprintf("the region %q or service %q is wrong; expecting %q", sig.region, sig.service, region)}
+	}
+	now := time.Now()
+	if sig.presigned {
+		if now.After(sig.amzDate.Add(sig.expires)) {
+			return "", errExpired
+		}
+	} else if d := now.Sub(sig.amzDate); d > maxSigV4Skew || d < -maxSigV4Skew {
+		return "", errSkewed
+	}
+
+	payloadHash := unsignedPayload
+	if !sig.presigned {
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return "", &s3Error{http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256"}
+		}
+		if strings.HasPrefix(payloadHash, "STREAMING-") {
+			return "", &s3Error{http.StatusNotImplemented, "NotImplemented", "streaming (chunked) signatures are not supported"}
+		}
+	}
+	canonical := strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.Query(), sig.presigned),
+		canonicalHeaders(r, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		payloadHash}, "\n")
+	scope := strings.Join([]string{sig.date, sig.region, sig.service, "aws4_request"}, "/")
+	h := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{sigV4Algorithm, sig.amzDate.Format(sigV4TimeFormat),
+		scope, hex.EncodeToString(h[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), sig.date)
+	for _, part := range []string{sig.region, sig.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	awaited := hex.EncodeToString(hmacSHA256(key, toSign))
+	if !hmac.Equal([]byte(awaited), []byte(sig.signature)) {
+		logger.Printf("signature mismatch, canonical request:\n%s", canonical)
+		return "", errSignature
+	}
+	if payloadHash == unsignedPayload {
+		return "", nil
+	}
+	return payloadHash, nil
+}
+
+// parses the Authorization header, or the X-Amz-* query parameters
+func parseSigV4(r *http.Request) (sig sigV4, err error) {
+	var credential, signedHeaders, amzDate string
+	q := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+			return sig, &s3Error{http.StatusBadRequest, "InvalidRequest", "only " + sigV4Algorithm + " is supported"}
+		}
+		for _, part := range strings.Split(auth[len(sigV4Algorithm)+1:], ",") {
+			part = strings.TrimSpace(part)
+			i := strings.Index(part, "=")
+			if i < 0 {
+				continue
+			}
+			switch part[:i] {
+			case "Credential":
+				credential = part[i+1:]
+			case "SignedHeaders":
+				signedHeaders = part[i+1:]
+			case "Signature":
+				sig.signature = part[i+1:]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = r.Header.Get("Date")
+		}
+	} else if q.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		sig.presigned = true
+		credential, signedHeaders = q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders")
+		sig.signature, amzDate = q.Get("X-Amz-Signature"), q.Get("X-Amz-Date")
+		var secs int
+		if _, err = fmt.Sscanf(q.Get("X-Amz-Expires"), "%d", &secs); err != nil || secs <= 0 {
+			return sig, &s3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "bad X-Amz-Expires"}
+		}
+		sig.expires = time.Duration(secs) * time.Second
+	} else {
+		return sig, errAccessDenied
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || signedHeaders == "" || sig.signature == "" {
+		return sig, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed credential or signature"}
+	}
+	sig.accessKey, sig.date, sig.region, sig.service = parts[0], parts[1], parts[2], parts[3]
+	sig.signedHeaders = strings.Split(signedHeaders, ";")
+	if sig.amzDate, err = time.Parse(sigV4TimeFormat, amzDate); err != nil {
+		if sig.amzDate, err = http.ParseTime(amzDate); err != nil {
+			return sig, &s3Error{http.StatusForbidden, "AccessDenied", "bad or missing X-Amz-Date"}
+		}
+	}
+	if sig.amzDate.UTC().Format("20060102") != sig.date {
+		return sig, &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "the credential date does not match X-Amz-Date"}
+	}
+	return sig, nil
+}
+
+// returns the canonical query string (without X-Amz-Signature for presigned URLs)
+func canonicalQuery(q url.Values, presigned bool) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// returns the canonical headers (each line ending with "\n")
+func canonicalHeaders(r *http.Request, signed []string) string {
+	var buf strings.Builder
+	for _, name := range signed {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else if name == "content-length" && r.Header.Get("Content-Length") == "" {
+			value = fmt.Sprintf("%d", r.ContentLength)
+		} else {
+			vals := make([]string, 0, 1)
+			for _, v := range r.Header[http.CanonicalHeaderKey(name)] {
+				vals = append(vals, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(vals, ",")
+		}
+		buf.WriteString(name + ":" + value + "\n")
+	}
+	return buf.String()
+}
+
+// URI-encodes s as AWS does: every byte except the unreserved characters
+// (and "/", if not encodeSlash)
+func awsURIEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// reads through the hash, and returns err (instead of io.EOF) if the
+// digest of the data does not match
+type digestReader struct {
+	io.Reader
+	hash    hash.Hash
+	awaited []byte
+	err     error
+}
+
+func newDigestReader(r io.Reader, h hash.Hash, awaited []byte, err error) *digestReader {
+	return &digestReader{Reader: io.TeeReader(r, h), hash: h, awaited: awaited, err: err}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err == io.EOF && !bytes.Equal(d.hash.Sum(nil), d.awaited) {
+		return n, d.err
+	}
+	return n, err
+}
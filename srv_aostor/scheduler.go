@@ -0,0 +1,238 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+// This file is part of aostor.
+
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tgulacsi/aostor"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// compaction state of a realm
+type compactState struct {
+	Realm      string
+	Running    bool
+	Reason     string                `json:",omitempty"`
+	Runs       int                   // number of finished runs
+	LastStart  time.Time             `json:",omitempty"`
+	LastEnd    time.Time             `json:",omitempty"`
+	LastError  string                `json:",omitempty"`
+	LastReport *aostor.CompactReport `json:",omitempty"`
+	Staging    aostor.StagingStat
+	CheckError string `json:",omitempty"`
+	watched    bool   // has a checker goroutine
+}
+
+// runs compaction in the background, on schedule and on thresholds,
+// at most one per realm at a time
+type compactScheduler struct {
+	sync.Mutex
+	states map[string]*compactState
+}
+
+var compactions *compactScheduler
+
+func newCompactScheduler(realms []string) *compactScheduler {
+	s := &compactScheduler{states: make(map[string]*compactState, len(realms))}
+	s.AddRealms(realms)
+	return s
+}
+
+// adds the states of the new realms
+func (s *compactScheduler) AddRealms(realms []string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, realm := range realms {
+		if _, ok := s.states[realm]; !ok {
+			s.states[realm] = &compactState{Realm: realm}
+		}
+	}
+}
+
+// starts a checker goroutine for each served realm with any compaction
+// trigger configured (if not started already)
+func (s *compactScheduler) Start() {
+	s.Lock()
+	defer s.Unlock()
+	for realm, state := range s.states {
+		if state.watched || !isServed(realm) {
+			continue
+		}
+		conf, err := aostor.ReadConf("", realm)
+		if err != nil {
+			logger.Printf("cannot read configuration of %s: %s", realm, err)
+			continue
+		}
+		if !hasTrigger(conf) {
+			continue
+		}
+		logger.Printf("starting compaction scheduler for %s", realm)
+		state.watched = true
+		go s.watch(realm)
+	}
+}
+
+// returns whether any compaction trigger is configured
+func hasTrigger(conf aostor.Config) bool {
+	return conf.CompactInterval > 0 || conf.CompactMaxAge > 0 ||
+		conf.CompactStagingBytes > 0 || conf.CompactStagingCount > 0
+}
+
+// returns whether the realm is served - it is not after it has been
+// removed from the config (see registerRealms)
+func isServed(realm string) bool {
+	realmsLock.RLock()
+	defer realmsLock.RUnlock()
+	return realms[realm]
+}
+
+// checks the triggers periodically - the config is read at each check,
+// so the changes (reloads) are followed; stops if no trigger remains,
+// or the realm is not served anymore
+func (s *compactScheduler) watch(realm string) {
+	started := time.Now()
+	for {
+		conf, err := aostor.ReadConf("", realm)
+		if err == nil && !isServed(realm) {
+			err = errors.New("realm is not served")
+		}
+		if err == nil && !hasTrigger(conf) {
+			err = errors.New("no compaction trigger")
+		}
+		if err != nil {
+			logger.Printf("stopping compaction scheduler for %s: %s", realm, err)
+			s.Lock()
+			s.states[realm].watched = false
+			s.Unlock()
+			return
+		}
+		period := conf.CompactCheckPeriod
+		if period <= 0 {
+			period = aostor.DefaultCompactCheckPeriod
+		}
+		if conf.CompactInterval > 0 && conf.CompactInterval < period {
+			period = conf.CompactInterval
+		}
+		time.Sleep(period)
+		if !isServed(realm) { // removed while sleeping
+			continue
+		}
+		if reason := s.check(realm, conf, started); reason != "" {
+			s.TryRun(realm, reason)
+		}
+	}
+}
+
+// returns the reason for compaction, if any
+func (s *compactScheduler) check(realm string, conf aostor.Config, started time.Time) string {
+	stat, err := aostor.StagingStats(realm)
+	s.Lock()
+	state := s.states[realm]
+	state.Staging = stat
+	state.CheckError = ""
+	if err != nil {
+		state.CheckError = err.Error()
+	}
+	last := state.LastEnd
+	s.Unlock()
+	if err != nil {
+		logger.Printf("cannot get staging stats of %s: %s", realm, err)
+		return ""
+	}
+
+	now := time.Now()
+	if last.IsZero() {
+		last = started
+	}
+	switch {
+	case conf.CompactInterval > 0 && now.Sub(last) >= conf.CompactInterval:
+		return "schedule"
+	case stat.Count == 0:
+		return ""
+	case conf.CompactStagingBytes > 0 && stat.Bytes >= conf.CompactStagingBytes:
+		return "staging bytes"
+	case conf.CompactStagingCount > 0 && stat.Count >= conf.CompactStagingCount:
+		return "staging count"
+	case conf.CompactMaxAge > 0 && now.Sub(stat.Oldest) >= conf.CompactMaxAge:
+		return "staging age"
+	}
+	return ""
+}
+
+// starts compaction of the realm in the background, if not running already
+// (and no admin job of the realm is running - see acquireRealm).
+// Returns false if a compaction (or an admin job) is already running.
+// Compact itself locks the index and staging dirs (locking.FLockDirs),
+// so this waits for an external shovel running on the same realm.
+func (s *compactScheduler) TryRun(realm, reason string) bool {
+	if running, ok := acquireRealm(realm, "compaction"); !ok {
+		if running != "compaction" {
+			logger.Printf("not compacting %s (%s): %s is running", realm, reason, running)
+		}
+		return false
+	}
+	s.Lock()
+	state, ok := s.states[realm]
+	if !ok {
+		state = &compactState{Realm: realm}
+		s.states[realm] = state
+	}
+	state.Running, state.Reason, state.LastStart = true, reason, time.Now()
+	s.Unlock()
+
+	go func() {
+		defer releaseRealm(realm)
+		logger.Printf("compacting %s (%s)", realm, reason)
+		report, err := aostor.Compact(realm, func() { aostor.FillCaches(true) }, nil)
+		s.Lock()
+		state.Running, state.LastEnd = false, time.Now()
+		took := state.LastEnd.Sub(state.LastStart)
+		state.Runs++
+		state.LastError = ""
+		state.LastReport = report
+		if err != nil {
+			state.LastError = err.Error()
+		}
+		s.Unlock()
+		if err != nil {
+			logger.Printf("error compacting %s: %s", realm, err)
+		} else {
+			logger.Printf("compacted %s in %s", realm, took)
+		}
+	}()
+	return true
+}
+
+// returns the realms' compaction states as JSON
+func (s *compactScheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	s.Lock()
+	states := make(map[string]compactState, len(s.states))
+	for realm, state := range s.states {
+		states[realm] = *state
+	}
+	s.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(states); err != nil {
+		logger.Printf("cannot encode compaction states: %s", err)
+	}
+}
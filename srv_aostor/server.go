@@ -21,7 +21,9 @@ import _ "net/http/pprof" // pprof
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/tgulacsi/aostor"
@@ -31,7 +33,9 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -40,14 +44,16 @@ var logger = log.New(os.Stderr, "server ", log.LstdFlags|log.Lshortfile)
 var MaxRequestMemory = 20 * int64(1<<20)
 
 func main() {
-	defer aostor.FlushLog()
 	configfile := flag.String("c", aostor.ConfigFile, "config file")
 	hostport := flag.String("http", "",
 		"host:port, default="+aostor.DefaultHostport)
+	shutdownTimeout := flag.Duration("shutdown", 30*time.Second,
+		"wait this long for the requests in progress on shutdown")
 	flag.Parse()
 	conf, err := aostor.ReadConf(*configfile, "")
 	if err != nil {
-		logger.Fatalf("cannot read configuration %s: %s", *configfile, err)
+		logger.Printf("cannot read configuration %s: %s", *configfile, err)
+		exit(1)
 	} else {
 		aostor.ConfigFile = *configfile
 		logger.Printf("set configfile: %s", aostor.ConfigFile)
@@ -55,28 +61,106 @@ func main() {
 	if *hostport != "" {
 		conf.Hostport = *hostport
 	}
+	for _, realm := range conf.Realms {
+		if err = aostor.RecoverCompaction(realm); err != nil {
+			logger.Printf("cannot recover compaction of %s: %s", realm, err)
+			exit(1)
+		}
+	}
 
 	s := prepareServer(&conf)
+	s3 := prepareS3(&conf)
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGUSR1)
-
 	go recvChangeSig(sigchan)
 
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
+	go func() {
+		for _ = range hupchan {
+			reload()
+		}
+	}()
+
+	stopchan := make(chan os.Signal, 1)
+	signal.Notify(stopchan, syscall.SIGTERM, syscall.SIGINT)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-stopchan
+		logger.Printf("received %s, shutting down", sig)
+		var wg sync.WaitGroup
+		for _, srv := range []*http.Server{s, s3} {
+			if srv == nil {
+				continue
+			}
+			wg.Add(1)
+			go func(srv *http.Server) {
+				defer wg.Done()
+				shutdown(srv, *shutdownTimeout)
+			}(srv)
+		}
+		wg.Wait()
+		// the handlers of the closed connections may still be putting
+		if !aostor.WaitPuts(*shutdownTimeout) {
+			logger.Printf("puts still in progress after %s", *shutdownTimeout)
+		}
+		close(stopped)
+	}()
+
+	compactions.Start()
+	go expireUploads()
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// runtime.GOMAXPROCS(1)
 
+	if s3 != nil {
+		go func() {
+			logger.Printf("starting S3 gateway on %s", s3.Addr)
+			if err := s3.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Printf("error serving S3: %s", err)
+				exit(1)
+			}
+		}()
+	}
 	logger.Printf("starting server on %s", *s)
-	logger.Fatal(s.ListenAndServe())
+	if err = s.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Printf("error serving: %s", err)
+		exit(1)
+	}
+	<-stopped
+	exit(0)
+}
+
+// flushes the logs and exits
+func exit(code int) {
+	aostor.FlushLog()
+	os.Exit(code)
+}
+
+// stops accepting connections and waits for the requests in progress
+// (at most timeout long), then closes the remaining connections.
+// The puts in progress must be waited for (aostor.WaitPuts) after all the
+// servers are stopped, so no half-written file remains in staging.
+func shutdown(s *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Printf("requests still in progress on %s after %s (%s), closing",
+			s.Addr, timeout, err)
+		s.Close()
+	}
+	logger.Printf("server on %s stopped", s.Addr)
 }
 
 func prepareServer(conf *aostor.Config) *http.Server {
 	http.HandleFunc("/", indexHandler)
-	for _, realm := range conf.Realms {
-		http.HandleFunc("/"+realm+"/", baseHandler)
-		http.HandleFunc("/"+realm+"/up", upHandler)
-	}
-	http.HandleFunc("/_signal", sigHandler)
+	compactions = newCompactScheduler(conf.Realms)
+	registerRealms(conf.Realms)
+	http.Handle("/_admin/", adminHandler{})
+	http.Handle("/_compaction", compactions)
+	http.HandleFunc("/_metrics", metricsHandler)
+	http.Handle(davPrefix, davHandler{})
 
 	s := &http.Server{
 		Addr:           conf.Hostport,
@@ -87,6 +171,50 @@ func prepareServer(conf *aostor.Config) *http.Server {
 	return s
 }
 
+var (
+	// the realms with registered handlers, and whether they are configured
+	realms     = make(map[string]bool, 4)
+	realmsLock = sync.RWMutex{}
+)
+
+// registers the handlers of the new realms (and forgets the removed ones:
+// their handlers answer 404)
+func registerRealms(configured []string) {
+	realmsLock.Lock()
+	defer realmsLock.Unlock()
+	for realm := range realms {
+		realms[realm] = false
+	}
+	for _, realm := range configured {
+		if _, ok := realms[realm]; !ok {
+			logger.Printf("serving realm %s", realm)
+			http.Handle("/"+realm+"/", realmHandler{realm})
+		}
+		realms[realm] = true
+	}
+	compactions.AddRealms(configured)
+}
+
+// re-reads the config: serves the new realms, applies the changed settings
+func reload() {
+	logger.Printf("reloading %s", aostor.ConfigFile)
+	conf, err := aostor.ReloadConf()
+	if err != nil {
+		logger.Printf("cannot reload %s: %s", aostor.ConfigFile, err)
+		return
+	}
+	for _, realm := range conf.Realms {
+		if err = aostor.RecoverCompaction(realm); err != nil {
+			logger.Printf("cannot recover compaction of %s: %s", realm, err)
+		}
+	}
+	registerRealms(conf.Realms)
+	compactions.Start()
+	if err = aostor.FillCaches(true); err != nil {
+		logger.Printf("error filling caches: %s", err)
+	}
+}
+
 func recvChangeSig(sigchan <-chan os.Signal) {
 	// aostor.FillCaches(true)
 	for _ = range sigchan {
@@ -95,157 +223,414 @@ func recvChangeSig(sigchan <-chan os.Signal) {
 		logger.Printf("\n***\n\n")
 	}
 }
-func sigHandler(w http.ResponseWriter, r *http.Request) {
-	logger.Printf("SIGNAL")
-	aostor.FillCaches(true)
-	w.Write([]byte("OK"))
+
+// serves the objects of a realm:
+//
+//	GET, HEAD /realm/key - the object (HEAD: only its headers)
+//	PUT /realm/key - stores the body under the given key (409 if it exists)
+//	DELETE /realm/key - deletes the object
+//	POST /realm/up - stores the uploaded file(s) under new keys
+//	/realm/uploads/ - resumable uploads (see resumable)
+type realmHandler struct {
+	realm string
+}
+
+func (h realmHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger.Printf("%s got %s %s", h.realm, r.Method, r.URL)
+	realmsLock.RLock()
+	configured := realms[h.realm]
+	realmsLock.RUnlock()
+	if !configured {
+		httpError(w, http.StatusNotFound, "unknown realm %s", h.realm)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/"+h.realm+"/")
+	if path == "uploads" || strings.HasPrefix(path, "uploads/") {
+		h.resumable(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "uploads"), "/"))
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		h.get(w, r, path)
+	case "PUT":
+		h.put(w, r, path)
+	case "DELETE":
+		h.del(w, r, path)
+	case "POST":
+		h.up(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, POST")
+		httpError(w, http.StatusMethodNotAllowed, "unknown method %s", r.Method)
+	}
 }
 
-func baseHandler(w http.ResponseWriter, r *http.Request) {
-	logger.Printf("base got %s", r)
-	tmp := strings.SplitN(r.URL.Path, "/", 3)[1:]
-	realm, path := tmp[0], tmp[1]
-	// logger.Printf("realm=%s path=%s", realm, path)
-
-	if r.Method == "GET" || r.Method == "HEAD" {
-		key, err := aostor.UUIDFromString(path)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("404 Bad key %s", path), 404)
-			return
+// checks the bearer token (or the signature of a signed URL, for reading),
+// answers with 401 (no credentials) or 403 (bad credentials) if not allowed
+func (h realmHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	conf, err := aostor.ReadConf("", h.realm)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "cannot read config of %s: %s", h.realm, err)
+		return false
+	}
+	token := bearerToken(r)
+	read := r.Method == "GET" || r.Method == "HEAD" || r.Method == "PROPFIND"
+	if read && conf.CanRead(token) || !read && conf.CanWrite(token) {
+		return true
+	}
+	if read && r.URL.Query().Get("signature") != "" {
+		if err = conf.CheckSignedURL(r.URL.Path, r.URL.Query()); err == nil {
+			return true
 		}
-		info, data, err := aostor.Get(realm, key)
-		if err != nil {
-			logger.Print(err)
-			http.Error(w, fmt.Sprintf("404 Page Not Found (%s): %s", path, err), 404)
-		} else if !(!info.Key.IsEmpty() && data != nil) {
-			logger.Printf("NULL answer")
-			http.Error(w, fmt.Sprintf("404 Page Not Found (%s)", path), 404)
+		httpError(w, http.StatusForbidden, "%s", err)
+		return false
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+h.realm+`"`)
+		httpError(w, http.StatusUnauthorized, "authorization required")
+		return false
+	}
+	httpError(w, http.StatusForbidden, "the token has no %s access to %s",
+		map[bool]string{true: "read", false: "write"}[read], h.realm)
+	return false
+}
+
+// returns the token of the Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(token[7:])
+}
+
+// writes a JSON error body ({"status": code, "error": message})
+func httpError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{code, fmt.Sprintf(format, args...)})
+}
+
+// parses the key from the path, writes the error if it is invalid
+func parseKey(w http.ResponseWriter, path string) (aostor.UUID, bool) {
+	key, err := aostor.UUIDFromString(path)
+	if err != nil {
+		httpError(w, http.StatusNotFound, "bad key %s: %s", path, err)
+		return key, false
+	}
+	return key, true
+}
+
+func (h realmHandler) get(w http.ResponseWriter, r *http.Request, path string) {
+	key, ok := parseKey(w, path)
+	if !ok {
+		return
+	}
+	info, data, encoding, err := aostor.GetRaw(h.realm, key)
+	if err != nil {
+		logger.Print(err)
+		if err == aostor.NotFound || os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, "%s not found", path)
 		} else {
-			info.Copy(w.Header())
-			//logger.Printf("copying from %s to %s", data, err)
-			n, err := io.Copy(w, data)
-			if err != nil {
-				logger.Printf("Error copying from %s to %s: %s", data, w, err)
-			} else {
-				logger.Printf("written %d bytes", n)
-			}
-			if closable, ok := data.(io.Closer); ok {
-				// logger.Printf("closing %s", closable)
-				closable.Close()
+			httpError(w, http.StatusInternalServerError, "error reading %s: %s", path, err)
+		}
+		return
+	}
+	if closable, ok := data.(io.Closer); ok {
+		defer closable.Close()
+	}
+	if info.Key.IsEmpty() || data == nil {
+		logger.Printf("NULL answer")
+		httpError(w, http.StatusNotFound, "%s not found", path)
+		return
+	}
+	info.Copy(w.Header())
+	if encoding != "" {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	// gzip is sent as is, if the client accepts it
+	encoded := encoding == "gzip" && acceptsEncoding(r, encoding)
+	if notModified(w, r, h.realm, info, encoded) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if encoded {
+		w.Header().Set("Content-Encoding", encoding)
+	} else {
+		if encoding != "" {
+			if data, err = aostor.Decode(data, encoding); err != nil {
+				httpError(w, http.StatusInternalServerError, "error decoding %s: %s", path, err)
+				return
 			}
-			return
 		}
-	} else if r.Method == "POST" {
-		r.URL.Path = "/" + realm + "/up/" + path
-		upHandler(w, r)
+		if size := info.Get(aostor.InfoPref + "Original-Size"); size != "" {
+			w.Header().Set("Content-Length", size)
+		}
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	//logger.Printf("copying from %s to %s", data, err)
+	n, err := io.Copy(w, data)
+	if err != nil {
+		logger.Printf("Error copying from %s to %s: %s", data, w, err)
 	} else {
-		http.Error(w, fmt.Sprintf("400 Bad Request: unknown method %s", r.Method), 400)
+		logger.Printf("written %d bytes", n)
 	}
-	return
 }
 
-func upHandler(w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Fatalf("work failed:", err)
-			panic(fmt.Sprintf("work failed: %s", err))
+// returns whether the client accepts the given Content-Encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, q := strings.TrimSpace(part), ""
+		if p := strings.Index(coding, ";"); p >= 0 {
+			coding, q = strings.TrimSpace(coding[:p]), strings.TrimSpace(coding[p+1:])
 		}
-	}()
-	logger.Printf("got %s", r)
-	tmp := strings.SplitN(r.URL.Path, "/", 3)[1:]
-	realm, path := tmp[0], tmp[1]
-	// logger.Printf("realm=%s path=%s", realm, path)
-	if r.Method != "POST" {
-		http.Error(w, fmt.Sprintf("400 Bad Request: unknown method %s", r.Method), 400)
-		return
+		if coding != encoding && coding != "*" &&
+			!(encoding == "gzip" && coding == "x-gzip") {
+			continue
+		}
+		if strings.HasPrefix(q, "q=") {
+			if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
 	}
-	tmp = strings.SplitN(r.URL.Path, "/", 4)[1:]
-	realm, up, path := tmp[0], "up", ""
-	if len(tmp) > 1 {
-		up = tmp[1]
+	return false
+}
+
+// sets the caching headers (ETag from the content hash, Last-Modified from
+// the upload time, Cache-Control), and returns whether the client's copy
+// is still valid (If-None-Match, If-Modified-Since)
+func notModified(w http.ResponseWriter, r *http.Request, realm string, info aostor.Info, encoded bool) bool {
+	conf, err := aostor.ReadConf("", realm)
+	if err != nil {
+		logger.Printf("cannot read config of %s: %s", realm, err)
+		return false
 	}
-	if len(tmp) > 2 {
-		path = tmp[2]
+	return checkNotModified(w, r, conf, info, encoded)
+}
+
+// returns the Cache-Control of the answer: the configured one, but for the
+// realms with read_tokens or sign_key it is private (no shared cache may
+// store it), and for a signed URL it is not fresh after its expiry
+func cacheControl(conf aostor.Config, r *http.Request) string {
+	if len(conf.ReadTokens) == 0 && conf.SignKey == "" {
+		return conf.CacheControl
 	}
-	ct := r.Header.Get("Content-Type")
-	p := strings.Index(ct, ";")
-	if p >= 0 {
-		ct = ct[:p]
+	maxAge := int64(-1)
+	if exp := r.URL.Query().Get("expires"); exp != "" && r.URL.Query().Get("signature") != "" {
+		if expires, err := strconv.ParseInt(exp, 10, 64); err == nil {
+			if maxAge = expires - time.Now().Unix(); maxAge < 0 {
+				maxAge = 0
+			}
+		}
 	}
-	logger.Printf("realm=%s path=%s up=%s content-type=%s", realm, path, up, ct)
-	if up != "up" {
-		http.Error(w, "400 Bad Request: unknown path "+up, 400)
-		return
+	directives := []string{"private"}
+	for _, d := range strings.Split(conf.CacheControl, ",") {
+		d = strings.TrimSpace(d)
+		name, value := strings.ToLower(d), ""
+		if i := strings.Index(d, "="); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.TrimSpace(d[i+1:])
+		}
+		switch name {
+		case "", "public", "private", "s-maxage":
+			continue
+		case "max-age":
+			if maxAge >= 0 {
+				if age, err := strconv.ParseInt(value, 10, 64); err == nil && age < maxAge {
+					maxAge = age
+				}
+				continue
+			}
+		}
+		directives = append(directives, d)
+	}
+	if maxAge >= 0 {
+		directives = append(directives, "max-age="+strconv.FormatInt(maxAge, 10))
 	}
-	var (
-		err      error
-		file     io.Reader
-		headers  map[string][]string
-		filename string
-	)
-	if ct == "multipart/form-data" || ct == "application/x-www-form-urlencoded" {
-		if err = r.ParseMultipartForm(MaxRequestMemory); err != nil {
-			http.Error(w, fmt.Sprintf("400 Bad Request: cannot parse as multipart"), 400)
-			return
+	return strings.Join(directives, ", ")
+}
+
+// notModified with the realm's config
+func checkNotModified(w http.ResponseWriter, r *http.Request, conf aostor.Config, info aostor.Info, encoded bool) bool {
+	var err error
+	if cc := cacheControl(conf, r); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	etag := info.Get(aostor.InfoPref + "Content-" + conf.ContentHash)
+	if etag != "" {
+		// the encoded representation differs
+		if encoded {
+			etag += "-gz"
+		}
+		etag = `"` + etag + `"`
+		w.Header().Set("ETag", etag)
+	}
+	var modified time.Time
+	if storedAt := info.Get(aostor.InfoPref + "Stored-At"); storedAt != "" {
+		if modified, err = http.ParseTime(storedAt); err == nil {
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
 		}
-		if r.MultipartForm == nil || r.MultipartForm.File == nil || 0 == len(r.MultipartForm.File) {
-			http.Error(w, fmt.Sprintf("400 Bad Request: no file in POST upload"), 400)
-			return
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag == "" {
+			return false
 		}
-		k := "upfile"
-		if _, ok := r.MultipartForm.File[k]; !ok {
-			for k = range r.MultipartForm.File {
-				break
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
 			}
 		}
-		f, hdr, e := r.FormFile(k)
-		if e != nil {
-			logger.Printf("error getting upfile from form: %s", e)
-			err = e
-		} else {
-			file = f
-			headers = hdr.Header
-			ct = hdr.Header.Get("Content-Type")
-			filename = hdr.Filename
-			logger.Printf("FORM f=%v headers=%s ct=%s", file, headers, ct)
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !modified.Truncate(time.Second).After(t)
 		}
-	} else {
-		file = base64.NewDecoder(base64.URLEncoding, r.Body)
-		headers = r.Header
-		// Content-Disposition: attachment; filename="inline; filename="test-67""
-		// ->
-		// test-67
-		filename = r.Header.Get("Content-Disposition")
-		p = strings.LastIndex(filename, "filename=")
-		if p >= 0 {
-			filename = strings.Trim(filename[p+9:], ` "'`)
+	}
+	return false
+}
+
+// stores the (raw) body under the given key - as with If-None-Match: *,
+// an already used key is a conflict, as the objects are immutable
+func (h realmHandler) put(w http.ResponseWriter, r *http.Request, path string) {
+	key, ok := parseKey(w, path)
+	if !ok {
+		return
+	}
+	ct := mediaType(r.Header.Get("Content-Type"))
+	info := aostor.Info{}
+	info.CopyFrom(r.Header)
+	info.SetFilename(dispositionFilename(r.Header), ct)
+	info.Key = key
+	h.store(w, info, r.Body, true)
+}
+
+func (h realmHandler) del(w http.ResponseWriter, r *http.Request, path string) {
+	key, ok := parseKey(w, path)
+	if !ok {
+		return
+	}
+	if err := aostor.Delete(h.realm, key); err != nil {
+		if err == aostor.NotFound || os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, "%s not found", path)
+		} else {
+			httpError(w, http.StatusInternalServerError, "error deleting %s: %s", path, err)
 		}
-		logger.Printf("RAW f=%v headers=%s ct=%s", file, headers, ct)
+		return
 	}
-	if err != nil {
-		http.Error(w, fmt.Sprintf("400 Bad Request: upfile missing: %s", err), 400)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stores the file (multipart form or base64-encoded body) under a new key
+func (h realmHandler) up(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Fatalf("work failed:", err)
+			panic(fmt.Sprintf("work failed: %s", err))
+		}
+	}()
+	ct := mediaType(r.Header.Get("Content-Type"))
+	logger.Printf("realm=%s path=%s content-type=%s", h.realm, r.URL.Path, ct)
+	switch ct {
+	case "multipart/form-data":
+		h.upMulti(w, r)
+		return
+	case "application/x-www-form-urlencoded":
+		httpError(w, http.StatusBadRequest, "cannot parse as multipart")
 		return
 	}
+	file := base64.NewDecoder(base64.URLEncoding, r.Body)
+	filename := dispositionFilename(r.Header)
+	logger.Printf("RAW f=%v headers=%s ct=%s", file, r.Header, ct)
 	info := aostor.Info{}
-	info.CopyFrom(headers)
+	info.CopyFrom(r.Header)
 	info.SetFilename(filename, ct)
-	logger.Printf("filename: %s info: %s", filename, info)
+	h.store(w, info, file, false)
+}
+
+// stores the file, answers with its key
+func (h realmHandler) store(w http.ResponseWriter, info aostor.Info, file io.Reader, create bool) {
+	logger.Printf("info: %s", info)
 	fbuf := bufio.NewReader(file)
 	if _, e := fbuf.Peek(1); e != nil {
-		http.Error(w, fmt.Sprintf("400 Bad Request: empty body"), 400)
+		httpError(w, http.StatusBadRequest, "empty body")
 		return
 	}
-	key, err := aostor.Put(realm, info, fbuf)
+	put := aostor.PutDedup
+	if create {
+		put = aostor.PutNew
+	}
+	key, deduplicated, err := put(h.realm, info, fbuf)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("ERROR: %s", err), 500)
+		putError(w, key, err)
 		return
 	}
 	w.Header().Add(aostor.InfoPref+"Key", key.String())
-	w.Header().Add("Content-Location", "/"+realm+"/"+key.String())
+	if deduplicated {
+		w.Header().Add(aostor.InfoPref+"Deduplicated", "true")
+	}
+	w.Header().Add("Content-Location", "/"+h.realm+"/"+key.String())
+	if create {
+		w.Header().Add("Location", "/"+h.realm+"/"+key.String())
+		w.WriteHeader(http.StatusCreated)
+	}
 	// logger.Printf("response headers: %s", w.Header())
 	w.Write([]byte(key.String()))
 }
 
+// answers the error of a put
+func putError(w http.ResponseWriter, key aostor.UUID, err error) {
+	switch err {
+	case aostor.ErrExists:
+		httpError(w, http.StatusConflict, "%s already exists", key)
+	case aostor.ErrTooLarge:
+		httpError(w, http.StatusRequestEntityTooLarge, "%s", err)
+	case aostor.ErrQuotaExceeded:
+		httpError(w, http.StatusInsufficientStorage, "%s", err)
+	default:
+		httpError(w, http.StatusInternalServerError, "ERROR: %s", err)
+	}
+}
+
+// returns the media type of the Content-Type (without the parameters)
+func mediaType(ct string) string {
+	if p := strings.Index(ct, ";"); p >= 0 {
+		return ct[:p]
+	}
+	return ct
+}
+
+// returns the filename from the Content-Disposition header
+func dispositionFilename(header http.Header) string {
+	// Content-Disposition: attachment; filename="inline; filename="test-67""
+	// ->
+	// test-67
+	filename := header.Get("Content-Disposition")
+	if p := strings.LastIndex(filename, "filename="); p >= 0 {
+		filename = strings.Trim(filename[p+9:], ` "'`)
+	}
+	return filename
+}
+
+// serves the metrics in Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := aostor.WriteMetrics(w); err != nil {
+		logger.Printf("error writing metrics: %s", err)
+	}
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	logger.Printf("got %s", r)
 }
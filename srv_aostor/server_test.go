@@ -20,7 +20,14 @@ package main
 import (
 	"./testhlp"
 	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 	"unosoft.hu/aostor"
 )
 
@@ -49,3 +56,178 @@ func TestParallelStore(t *testing.T) {
 		t.Errorf("error with shovel: %s", err)
 	}
 }
+
+func TestAcceptsEncoding(t *testing.T) {
+	for i, tc := range []struct {
+		accept  string
+		awaited bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"x-gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"identity, gzip;q=0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"br, deflate", false},
+	} {
+		r, _ := http.NewRequest("GET", "/test/key", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		if got := acceptsEncoding(r, "gzip"); got != tc.awaited {
+			t.Errorf("%d. %q: got %t, awaited %t", i, tc.accept, got, tc.awaited)
+		}
+	}
+}
+
+func TestCheckNotModified(t *testing.T) {
+	conf := aostor.Config{ContentHash: "sha1", CacheControl: aostor.DefaultCacheControl}
+	stored := time.Date(2012, 10, 19, 12, 30, 45, 0, time.UTC)
+	info := aostor.Info{}
+	info.Add(aostor.InfoPref+"Content-sha1", "abc")
+	info.Add(aostor.InfoPref+"Stored-At", stored.Format(http.TimeFormat))
+	for i, tc := range []struct {
+		inm, ims string
+		encoded  bool
+		etag     string
+		awaited  bool
+	}{
+		{"", "", false, `"abc"`, false},
+		{"", "", true, `"abc-gz"`, false},
+		{`"abc"`, "", false, `"abc"`, true},
+		{`"abc"`, "", true, `"abc-gz"`, false},
+		{`"abc-gz"`, "", true, `"abc-gz"`, true},
+		{`"abc-gz"`, "", false, `"abc"`, false},
+		{`"x", "abc"`, "", false, `"abc"`, true},
+		{`W/"abc"`, "", false, `"abc"`, true},
+		{`W/"x", W/"abc-gz"`, "", true, `"abc-gz"`, true},
+		{"*", "", false, `"abc"`, true},
+		// If-None-Match takes precedence
+		{`"x"`, stored.Add(time.Hour).Format(http.TimeFormat), false, `"abc"`, false},
+		// compared in whole seconds
+		{"", stored.Format(http.TimeFormat), false, `"abc"`, true},
+		{"", stored.Add(time.Hour).Format(http.TimeFormat), false, `"abc"`, true},
+		{"", stored.Add(-time.Second).Format(http.TimeFormat), false, `"abc"`, false},
+		{"", "yesterday", false, `"abc"`, false},
+	} {
+		r, _ := http.NewRequest("GET", "/test/key", nil)
+		if tc.inm != "" {
+			r.Header.Set("If-None-Match", tc.inm)
+		}
+		if tc.ims != "" {
+			r.Header.Set("If-Modified-Since", tc.ims)
+		}
+		w := httptest.NewRecorder()
+		if got := checkNotModified(w, r, conf, info, tc.encoded); got != tc.awaited {
+			t.Errorf("%d. %+v: got %t, awaited %t", i, tc, got, tc.awaited)
+		}
+		if got := w.Header().Get("ETag"); got != tc.etag {
+			t.Errorf("%d. ETag: got %s, awaited %s", i, got, tc.etag)
+		}
+		if got := w.Header().Get("Last-Modified"); got != stored.Format(http.TimeFormat) {
+			t.Errorf("%d. Last-Modified: got %s", i, got)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	conf := aostor.Config{CacheControl: "public, max-age=3600, s-maxage=7200, immutable"}
+	r, _ := http.NewRequest("GET", "/test/key", nil)
+	if got := cacheControl(conf, r); got != conf.CacheControl {
+		t.Errorf("public realm: got %q, awaited %q", got, conf.CacheControl)
+	}
+	conf.ReadTokens = []string{"secret"}
+	if got, awaited := cacheControl(conf, r), "private, max-age=3600, immutable"; got != awaited {
+		t.Errorf("realm with read tokens: got %q, awaited %q", got, awaited)
+	}
+	conf.ReadTokens, conf.SignKey = nil, "key"
+	for _, left := range []int64{60, 7200, -60} {
+		expires := time.Now().Unix() + left
+		r, _ = http.NewRequest("GET", "/test/key?expires="+strconv.FormatInt(expires, 10)+
+			"&signature=x", nil)
+		got := cacheControl(conf, r)
+		i := strings.Index(got, "max-age=")
+		if !strings.HasPrefix(got, "private, immutable") || i < 0 {
+			t.Errorf("signed URL: got %q", got)
+			continue
+		}
+		age, _ := strconv.ParseInt(got[i+8:], 10, 64)
+		awaited := left
+		if awaited > 3600 {
+			awaited = 3600
+		} else if awaited < 0 {
+			awaited = 0
+		}
+		if age > awaited || age < awaited-5 {
+			t.Errorf("signed URL expiring in %ds: got %q", left, got)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for i, tc := range []struct {
+		rng           string
+		size          uint64
+		start, length uint64
+		ok            bool
+	}{
+		{"bytes=0-9", 100, 0, 10, true},
+		{"bytes=90-", 100, 90, 10, true},
+		{"bytes=50-200", 100, 50, 50, true},
+		{"bytes=99-99", 100, 99, 1, true},
+		{"bytes=-10", 100, 90, 10, true},
+		{"bytes=-200", 100, 0, 100, true},
+		{"bytes=-0", 100, 0, 0, false},
+		{"bytes=100-", 100, 0, 0, false},
+		{"bytes=150-200", 100, 0, 0, false},
+		{"bytes=10-5", 100, 0, 0, false},
+		{"bytes=0-1,3-4", 100, 0, 0, false},
+		{"items=0-9", 100, 0, 0, false},
+		{"bytes=abc", 100, 0, 0, false},
+		{"bytes=-5", 0, 0, 0, false},
+		{"bytes=0-", 0, 0, 0, false},
+	} {
+		start, length, ok := parseRange(tc.rng, tc.size)
+		if ok != tc.ok || ok && (start != tc.start || length != tc.length) {
+			t.Errorf("%d. %q of %d: got %d, %d, %t, awaited %d, %d, %t", i, tc.rng, tc.size,
+				start, length, ok, tc.start, tc.length, tc.ok)
+		}
+	}
+}
+
+func TestSchedulerSkipsDroppedRealm(t *testing.T) {
+	fh, err := ioutil.TempFile("", "aostor-conf-")
+	if err != nil {
+		t.Fatalf("cannot create temp file: %s", err)
+	}
+	defer os.Remove(fh.Name())
+	_, err = fh.WriteString(strings.Replace(aostor.TestConfig,
+		"[compact]\n", "[compact]\ninterval = 1h\n", 1))
+	fh.Close()
+	if err != nil {
+		t.Fatalf("cannot write %s: %s", fh.Name(), err)
+	}
+	defer func(fn string) { aostor.ConfigFile = fn }(aostor.ConfigFile)
+	aostor.ConfigFile = fh.Name()
+
+	realmsLock.Lock()
+	realms["served"], realms["dropped"] = true, false
+	realmsLock.Unlock()
+	defer func() {
+		realmsLock.Lock()
+		delete(realms, "served")
+		delete(realms, "dropped")
+		realmsLock.Unlock()
+	}()
+	s := newCompactScheduler([]string{"served", "dropped"})
+	s.Start()
+	s.Lock()
+	defer s.Unlock()
+	if !s.states["served"].watched {
+		t.Errorf("the compaction of a served realm is not watched")
+	}
+	if s.states["dropped"].watched {
+		t.Errorf("the compaction of a dropped realm is watched")
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+// This file is part of aostor.
+
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/tgulacsi/aostor"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a file of a multipart upload, spooled into the realm's staging dir
+type upPart struct {
+	info aostor.Info
+	file *os.File
+}
+
+// the answer for a file of a multipart upload
+type upResult struct {
+	Key          string `json:"key"`
+	Filename     string `json:"filename"`
+	Location     string `json:"location"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+}
+
+// stores all the files of the multipart form, in order. Every part is read
+// (and checked against the size limit) before storing any; if a file cannot
+// be stored, the already stored ones are unstaged, so the upload fails as a whole.
+//
+// Answers with the list of the keys as JSON, or, for one file (if the client
+// does not ask for JSON), as the single file upload does.
+func (h realmHandler) upMulti(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "cannot parse as multipart: %s", err)
+		return
+	}
+	parts := make([]upPart, 0, 4)
+	defer func() {
+		for _, p := range parts {
+			if p.file != nil {
+				p.file.Close()
+				os.Remove(p.file.Name())
+			}
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			httpError(w, http.StatusBadRequest, "cannot parse as multipart: %s", err)
+			return
+		}
+		filename := part.FileName()
+		if filename == "" { // not a file
+			part.Close()
+			continue
+		}
+		fh, err := aostor.SpoolUpload(h.realm, part)
+		part.Close()
+		switch err {
+		case nil:
+		case aostor.ErrTooLarge, aostor.ErrQuotaExceeded:
+			putError(w, aostor.UUID{}, err)
+			return
+		default:
+			httpError(w, http.StatusBadRequest, "cannot read %s: %s", filename, err)
+			return
+		}
+		parts = append(parts, upPart{file: fh})
+		if fi, e := fh.Stat(); e == nil && fi.Size() == 0 {
+			httpError(w, http.StatusBadRequest, "empty file %s", filename)
+			return
+		}
+		info := aostor.Info{}
+		info.CopyFrom(part.Header)
+		info.SetFilename(filename, mediaType(part.Header.Get("Content-Type")))
+		parts[len(parts)-1].info = info
+		logger.Printf("FORM %s headers=%s", filename, part.Header)
+	}
+	if len(parts) == 0 {
+		httpError(w, http.StatusBadRequest, "no file in POST upload")
+		return
+	}
+
+	results := make([]upResult, 0, len(parts))
+	for _, p := range parts {
+		key, deduplicated, err := aostor.PutDedup(h.realm, p.info, p.file)
+		if err == nil {
+			results = append(results, upResult{Key: key.String(),
+				Filename:     p.info.Get(aostor.InfoPref + "Original-Filename"),
+				Location:     "/" + h.realm + "/" + key.String(),
+				Deduplicated: deduplicated})
+			continue
+		}
+		for _, res := range results {
+			key, _ := aostor.UUIDFromString(res.Key)
+			e := aostor.Unstage(h.realm, key)
+			if e == aostor.NotFound { // compacted since: only a tombstone can be written
+				e = aostor.Delete(h.realm, key)
+			}
+			if e != nil {
+				logger.Printf("cannot remove %s: %s", res.Key, e)
+			}
+		}
+		putError(w, p.info.Key, err)
+		return
+	}
+
+	if len(results) == 1 && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		res := results[0]
+		w.Header().Add(aostor.InfoPref+"Key", res.Key)
+		if res.Deduplicated {
+			w.Header().Add(aostor.InfoPref+"Deduplicated", "true")
+		}
+		w.Header().Add("Content-Location", res.Location)
+		w.Write([]byte(res.Key))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(results)
+}
+
+// resumable uploads:
+//
+//	POST /realm/uploads - creates an upload (Upload-Length: the size, if known;
+//	  Content-Type, Content-Disposition: of the file)
+//	HEAD, GET /realm/uploads/id - the received bytes in Upload-Offset
+//	PATCH /realm/uploads/id - appends the body at Upload-Offset
+//	POST /realm/uploads/id - stores the received data, answers with its key
+//	DELETE /realm/uploads/id - aborts the upload
+func (h realmHandler) resumable(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if id == "" {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			httpError(w, http.StatusMethodNotAllowed, "unknown method %s", r.Method)
+			return
+		}
+		h.createUpload(w, r)
+		return
+	}
+	var (
+		up  aostor.Upload
+		err error
+	)
+	switch r.Method {
+	case "HEAD", "GET":
+		up, err = aostor.GetUpload(h.realm, id)
+	case "PATCH":
+		offset, e := strconv.ParseUint(r.Header.Get("Upload-Offset"), 10, 64)
+		if e != nil {
+			httpError(w, http.StatusBadRequest, "bad Upload-Offset %q", r.Header.Get("Upload-Offset"))
+			return
+		}
+		up, err = aostor.AppendUpload(h.realm, id, offset, r.Body)
+		if err == nil || err == aostor.ErrOffsetMismatch {
+			setUploadHeaders(w, up)
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case "POST":
+		h.finishUpload(w, r, id)
+		return
+	case "DELETE":
+		if err = aostor.AbortUpload(h.realm, id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "HEAD, GET, PATCH, POST, DELETE")
+		httpError(w, http.StatusMethodNotAllowed, "unknown method %s", r.Method)
+		return
+	}
+	if err != nil {
+		uploadError(w, id, err)
+		return
+	}
+	setUploadHeaders(w, up)
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, up)
+	}
+}
+
+func (h realmHandler) createUpload(w http.ResponseWriter, r *http.Request) {
+	length := int64(-1)
+	if ul := r.Header.Get("Upload-Length"); ul != "" {
+		var err error
+		if length, err = strconv.ParseInt(ul, 10, 64); err != nil || length < 0 {
+			httpError(w, http.StatusBadRequest, "bad Upload-Length %q", ul)
+			return
+		}
+	}
+	info := aostor.Info{}
+	info.CopyFrom(r.Header)
+	info.SetFilename(dispositionFilename(r.Header), mediaType(r.Header.Get("Content-Type")))
+	up, err := aostor.CreateUpload(h.realm, info, length)
+	if err != nil {
+		uploadError(w, "", err)
+		return
+	}
+	setUploadHeaders(w, up)
+	w.Header().Set("Location", "/"+h.realm+"/uploads/"+up.ID)
+	writeJSON(w, http.StatusCreated, up)
+}
+
+func (h realmHandler) finishUpload(w http.ResponseWriter, r *http.Request, id string) {
+	up, err := aostor.GetUpload(h.realm, id)
+	if err != nil {
+		uploadError(w, id, err)
+		return
+	}
+	key, deduplicated, err := aostor.FinishUpload(h.realm, id)
+	if err != nil {
+		uploadError(w, id, err)
+		return
+	}
+	location := "/" + h.realm + "/" + key.String()
+	w.Header().Set(aostor.InfoPref+"Key", key.String())
+	if deduplicated {
+		w.Header().Set(aostor.InfoPref+"Deduplicated", "true")
+	}
+	w.Header().Set("Location", location)
+	writeJSON(w, http.StatusCreated, upResult{Key: key.String(),
+		Filename: up.Info.Get(aostor.InfoPref + "Original-Filename"),
+		Location: location, Deduplicated: deduplicated})
+}
+
+// sets the Upload-Offset, Upload-Length and Upload-Expires headers
+func setUploadHeaders(w http.ResponseWriter, up aostor.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatUint(up.Offset, 10))
+	if up.Length >= 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	}
+	w.Header().Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+}
+
+// answers the error of a resumable upload
+func uploadError(w http.ResponseWriter, id string, err error) {
+	switch err {
+	case aostor.ErrNoUpload:
+		httpError(w, http.StatusNotFound, "no upload %s", id)
+	case aostor.ErrOffsetMismatch, aostor.ErrUploadBusy, aostor.ErrIncomplete:
+		httpError(w, http.StatusConflict, "upload %s: %s", id, err)
+	default:
+		putError(w, aostor.UUID{}, err)
+	}
+}
+
+// removes the expired resumable uploads of the served realms, hourly
+func expireUploads() {
+	for {
+		time.Sleep(time.Hour)
+		realmsLock.RLock()
+		served := make([]string, 0, len(realms))
+		for realm, configured := range realms {
+			if configured {
+				served = append(served, realm)
+			}
+		}
+		realmsLock.RUnlock()
+		for _, realm := range served {
+			if _, err := aostor.ExpireUploads(realm); err != nil {
+				logger.Printf("cannot expire the uploads of %s: %s", realm, err)
+			}
+		}
+	}
+}
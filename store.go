@@ -20,6 +20,7 @@
 package aostor
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
@@ -31,21 +32,70 @@ import (
 	// "io/ioutil"
 	// "./compressor"
 	"github.com/tgulacsi/aostor/compressor"
+	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var UUIDMaker = uuid.NewUUID4
 
+// the puts in progress (see WaitPuts)
+var putsInFlight sync.WaitGroup
+
+// waits for the puts in progress to finish, at most timeout long.
+// Returns false on timeout.
+func WaitPuts(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		putsInFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 // puts file (info + data) into the given realm - returns the key
 // if the key is in info, then uses that
 func Put(realm string, info Info, data io.Reader) (key UUID, err error) {
+	key, _, err = PutDedup(realm, info, data)
+	return
+}
+
+// Put which returns whether the data has been deduplicated at upload
+// (only the info and a link to the already stored data have been written)
+func PutDedup(realm string, info Info, data io.Reader) (key UUID, deduplicated bool, err error) {
+	putsInFlight.Add(1)
+	defer putsInFlight.Done()
+	defer func(start time.Time) {
+		size, _ := strconv.ParseUint(info.Get(InfoPref+"Original-Size"), 10, 64)
+		realmStats(realm).put(start, size, err)
+	}(time.Now())
 	if err = info.Prepare(); err != nil {
-		return UUID{}, err
+		return UUID{}, false, err
 	}
 	conf, err := ReadConf("", realm)
 	if err != nil {
 		return
 	}
+	// the size limit is enforced (and the quota reserved) while reading
+	var res *quotaReservation
+	if data, res, err = limitData(conf, data); err != nil {
+		return
+	}
+	defer func() {
+		if err == nil {
+			size, _ := strconv.ParseUint(info.Get(InfoPref+"Original-Size"), 10, 64)
+			addUsage(conf, size, res)
+		} else {
+			res.release()
+		}
+	}()
 
 	if info.Key.IsEmpty() {
 		info.Key, err = NewUUID()
@@ -71,29 +121,65 @@ func Put(realm string, info Info, data io.Reader) (key UUID, err error) {
 		return
 	}
 	info.Ipos, info.Dpos = 0, 0
-	if conf.CompressMethod != "" {
-		info.Add("Content-Encoding", conf.CompressMethod)
-	}
+	info.Add(InfoPref+"Stored-At", time.Now().UTC().Format(http.TimeFormat))
 
 	// end := compressor.ShorterMethod(StoreCompressMethod)
 	dfn := ifn[:len(ifn)-len(SuffInfo)] + SuffData
-	dfh, err := os.OpenFile(dfn, os.O_WRONLY|os.O_CREATE, 0640)
-	if err != nil {
-		return
+	if conf.UploadDedup {
+		var tempfn string
+		if tempfn, deduplicated, err = putDedup(conf, &info, ifn, data); err != nil || deduplicated {
+			return
+		}
+		// not stored yet: store it from the temp file
+		defer os.Remove(tempfn)
+		fh, e := os.Open(tempfn)
+		if e != nil {
+			err = e
+			return
+		}
+		defer fh.Close()
+		data = fh
 	}
+	var (
+		chunks []UUID
+		fs     int64
+	)
+	defer func() {
+		// no half-written file (nor orphaned chunk) may remain in the staging dir
+		if err != nil {
+			_ = os.Remove(dfn)
+			_ = os.Remove(ifn)
+			removeChunks(conf.StagingDir, chunks)
+		}
+	}()
 	hsh := conf.ContentHashFunc()
 	cnt := NewCounter()
-	r := io.TeeReader(data, io.MultiWriter(hsh, cnt))
-	n, err := compressor.CompressCopy(dfh, r, conf.CompressMethod)
-	_ = dfh.Close()
-	_ = dfh.Sync()
-
-	fs := fileSize(dfh.Name())
+	r := bufio.NewReader(io.TeeReader(data, io.MultiWriter(hsh, cnt)))
+	if conf.ChunkSize > 0 {
+		chunks, fs, err = putChunks(conf, info.Key, dfn, r)
+	} else {
+		_, err = compressFile(dfn, r, conf.CompressMethod)
+	}
+	if err != nil {
+		return
+	}
+	if len(chunks) > 0 {
+		if err = writeManifest(dfn, chunks); err != nil {
+			return
+		}
+		info.Add(InfoPref+"Chunks", fmt.Sprintf("%d", len(chunks)))
+		info.Add(InfoPref+"Chunk-Size", fmt.Sprintf("%d", conf.ChunkSize))
+	} else {
+		if conf.CompressMethod != "" {
+			info.Add("Content-Encoding", conf.CompressMethod)
+		}
+		fs = fileSize(dfn)
+	}
 	if fs <= 0 {
 		err = errors.New("Empty compressed file!")
 		return
-	} else if n <= 0 || cnt.Num <= 0 {
-		err = fmt.Errorf("Empty data (n=%d, cnt=%d)", n, cnt.Num)
+	} else if cnt.Num <= 0 {
+		err = fmt.Errorf("Empty data (cnt=%d)", cnt.Num)
 		return
 	} else {
 		// logger.Printf("%s size=%d", dfh.Name(), fs)
@@ -103,15 +189,37 @@ func Put(realm string, info Info, data io.Reader) (key UUID, err error) {
 	info.Add(InfoPref+"Content-"+conf.ContentHash,
 		fmt.Sprintf("%x", hsh.Sum(nil)))
 
+	if err = writeInfoFile(ifn, info); err != nil {
+		return
+	}
+	if conf.UploadDedup {
+		addStagingHash(conf.StagingDir, info.Get(InfoPref+"Content-"+conf.ContentHash), dfn)
+	}
+	return
+}
+
+// writes the info into ifn
+func writeInfoFile(ifn string, info Info) error {
 	ifh, err := os.OpenFile(ifn, os.O_WRONLY|os.O_CREATE, 0640)
 	if err != nil {
-		return
+		return err
 	}
 	_, err = ifh.Write(info.Bytes())
 	_ = ifh.Close()
+	return err
+}
+
+// writes the compressed data read from r into dfn
+func compressFile(dfn string, r io.Reader, compressMethod string) (n int64, err error) {
+	dfh, err := os.OpenFile(dfn, os.O_WRONLY|os.O_CREATE, 0640)
 	if err != nil {
 		return
 	}
+	n, err = compressor.CompressCopy(dfh, r, compressMethod)
+	_ = dfh.Sync()
+	if e := dfh.Close(); e != nil && err == nil {
+		err = e
+	}
 	return
 }
 
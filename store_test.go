@@ -20,13 +20,21 @@
 package aostor
 
 import (
+	"bytes"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"github.com/tgulacsi/go-cdb"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var conf Config
@@ -89,6 +97,185 @@ func TestGet(c *testing.T) {
 	}
 }
 
+func TestChunked(c *testing.T) {
+	initConfig()
+	if conf.ChunkSize == 0 {
+		c.Skip("chunking is disabled")
+	}
+	data := make([]byte, 3*conf.ChunkSize+17)
+	for i := range data {
+		data[i] = byte(rand.Intn(256))
+	}
+	info := Info{}
+	info.SetFilename("chunked.bin", "application/octet-stream")
+	key, err := Put("test", info, bytes.NewReader(data))
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	info, r, err := Get("test", key)
+	if err != nil {
+		c.Fatalf("cannot get %s: %s", key, err)
+	}
+	if info.Get(InfoPref+"Chunks") != "4" {
+		c.Errorf("awaited 4 chunks, got %q", info.Get(InfoPref+"Chunks"))
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		c.Fatalf("cannot read %s: %s", key, err)
+	}
+	if !bytes.Equal(got, data) {
+		c.Fatalf("data mismatch: got %d bytes, awaited %d", len(got), len(data))
+	}
+
+	// the skipped whole chunks are not read
+	if _, r, err = Get("test", key); err != nil {
+		c.Fatalf("cannot get %s: %s", key, err)
+	}
+	start := 2*conf.ChunkSize + 5
+	cr, ok := asChunkReader(r)
+	if !ok {
+		c.Fatalf("%s is read by %T, not by a chunkReader", key, r)
+	}
+	if left := cr.skip(int64(start)); left != 5 || len(cr.keys) != 2 {
+		c.Errorf("skipping %d bytes: %d left with %d chunks, awaited 5 with 2",
+			start, left, len(cr.keys))
+	}
+	if err = Skip(r, 5); err != nil {
+		c.Fatalf("cannot skip 5 bytes of %s: %s", key, err)
+	}
+	if got, err = ioutil.ReadAll(r); err != nil {
+		c.Fatalf("cannot read %s: %s", key, err)
+	}
+	if !bytes.Equal(got, data[start:]) {
+		c.Errorf("data mismatch after skipping %d bytes: got %d bytes, awaited %d",
+			start, len(got), len(data)-int(start))
+	}
+}
+
+func TestChunkSizeConfig(c *testing.T) {
+	fh, err := ioutil.TempFile("", "aostor-conf-")
+	if err != nil {
+		c.Fatalf("cannot create temp file: %s", err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+	for i, tc := range []struct {
+		tar, chunk string
+		awaited    uint64
+		bad        bool
+	}{
+		{"512", "65536", 512, false},
+		{"65536", "512", 512, false},
+		{"65536", "", 65536, false}, // the default is capped, too
+		{"0", "1024", 1024, false},
+		{"512", "-1", 0, true},
+		{"-1", "512", 0, true},
+	} {
+		text := strings.Replace(TestConfig, "tar = 512\n", "tar = "+tc.tar+"\n", 1)
+		if tc.chunk == "" {
+			text = strings.Replace(text, "chunk = 512\n", "", 1)
+		} else {
+			text = strings.Replace(text, "chunk = 512\n", "chunk = "+tc.chunk+"\n", 1)
+		}
+		if err = ioutil.WriteFile(fh.Name(), []byte(text), 0640); err != nil {
+			c.Fatalf("cannot write %s: %s", fh.Name(), err)
+		}
+		got, err := readConf(fh.Name(), "", Config{})
+		if tc.bad {
+			if err == nil {
+				c.Errorf("%d. tar=%s chunk=%s: awaited error, got chunk size %d",
+					i, tc.tar, tc.chunk, got.ChunkSize)
+			}
+			continue
+		}
+		if err != nil {
+			c.Errorf("%d. tar=%s chunk=%s: %s", i, tc.tar, tc.chunk, err)
+		} else if got.ChunkSize != tc.awaited {
+			c.Errorf("%d. tar=%s chunk=%s: got chunk size %d, awaited %d",
+				i, tc.tar, tc.chunk, got.ChunkSize, tc.awaited)
+		}
+	}
+}
+
+func TestInline(c *testing.T) {
+	initConfig()
+	if conf.InlineThreshold == 0 {
+		c.Skip("inlining is disabled")
+	}
+	// unique, so it is not deduplicated against an earlier run's data
+	data := []byte(fmt.Sprintf("tiny %d", time.Now().UnixNano()))
+	info := Info{}
+	info.SetFilename("tiny.txt", "text/plain")
+	key, err := Put("test", info, bytes.NewReader(data))
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	if _, err = Compact("test", nil, nil); err != nil {
+		c.Fatalf("compact staging error: %s", err)
+	}
+	// wipe the data in the tar, so it can be read only from the inline copy
+	tarfn, stored := findTar(c, conf.TarDir, key)
+	if tarfn == "" || stored.Dpos == 0 {
+		c.Fatalf("cannot find the data of %s in the tars", key)
+	}
+	fh, err := os.OpenFile(tarfn, os.O_WRONLY, 0)
+	if err != nil {
+		c.Fatalf("cannot open %s: %s", tarfn, err)
+	}
+	// Dpos points to the tar header of the data
+	size, _ := strconv.Atoi(stored.Get(InfoPref + "Stored-Size"))
+	_, err = fh.WriteAt(make([]byte, size), int64(stored.Dpos)+512)
+	fh.Close()
+	if err != nil {
+		c.Fatalf("cannot wipe %s in %s: %s", key, tarfn, err)
+	}
+	FillCaches(true)
+	info, r, err := Get("test", key)
+	if err != nil {
+		c.Fatalf("cannot get %s: %s", key, err)
+	}
+	if info.Get(InfoPref+"Inline") != "" {
+		c.Errorf("inline data leaked into info of %s", key)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		c.Fatalf("cannot read %s: %s", key, err)
+	}
+	if !bytes.Equal(got, data) {
+		c.Fatalf("data mismatch: got %q, awaited %q", got, data)
+	}
+	err = walkInfos("test", conf, func(info Info) error {
+		if info.Get(InfoPref+"Inline") != "" {
+			c.Errorf("inline data leaked into the info of %s by walkInfos", info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		c.Errorf("cannot walk infos: %s", err)
+	}
+}
+
+// returns the tar (in dir) of key, and key's info stored in its cdb
+func findTar(c *testing.T, dir string, key UUID) (tarfn string, info Info) {
+	walkTarFiles("test", dir, func(uuid, fn string) error {
+		db, err := cdb.Open(fn + ".cdb")
+		if err != nil {
+			return nil
+		}
+		data, err := db.Data(key.Bytes())
+		db.Close()
+		if err != nil {
+			return nil
+		}
+		if info, err = ReadInfo(bytes.NewReader(data)); err != nil {
+			c.Fatalf("cannot read info of %s: %s", key, err)
+		}
+		tarfn = fn
+		return StopIteration
+	})
+	return
+}
+
 func TestCompact(c *testing.T) {
 	for j := uint(0); j < conf.IndexThreshold; j++ {
 		for i := 0; i < 1000+rand.Intn(100); i++ {
@@ -97,7 +284,7 @@ func TestCompact(c *testing.T) {
 			}
 		}
 		//logger.Printf("MAX_CDB_SIZE: %d", MAX_CDB_SIZE)
-		if err := Compact("test", nil); err != nil {
+		if _, err := Compact("test", nil, nil); err != nil {
 			c.Fatalf("compact staging error: %s", err)
 		}
 		dh, err := os.Open(conf.StagingDir)
@@ -120,17 +307,345 @@ func TestCompact(c *testing.T) {
 			c.Fatalf("cannot list staging dir %s: %s", conf.StagingDir, err)
 		}
 	}
-	if err := CompactIndices("test", 0, nil, false); err != nil {
+	if _, err := CompactIndices("test", 0, nil, false, nil); err != nil {
 		c.Fatalf("compact indices error: %s", err)
 	}
 	FillCaches(true)
 	testPut()
 }
 
+func TestSlashKey(c *testing.T) {
+	initConfig()
+	key, err := NewUUID()
+	if err != nil {
+		c.Fatalf("cannot create uuid: %s", err)
+	}
+	key[0] = '/'
+	info := Info{Key: key}
+	info.SetFilename("slash.txt", "text/plain")
+	if _, _, err = PutNew("test", info, bytes.NewReader([]byte("slash"))); err != nil {
+		c.Fatalf("cannot put %s: %s", key, err)
+	}
+	// compact till L01 is merged into L02 (or higher)
+	merged := false
+	for i := uint(0); i < 4*conf.IndexThreshold && !merged; i++ {
+		var reports [2]*CompactReport
+		if reports[0], err = Compact("test", nil, nil); err != nil {
+			c.Fatalf("compact staging error: %s", err)
+		}
+		if reports[1], err = CompactIndices("test", 0, nil, false, nil); err != nil {
+			c.Fatalf("compact indices error: %s", err)
+		}
+		for _, report := range reports {
+			for _, m := range report.IndexMerges {
+				merged = merged || m.Level >= 1
+			}
+		}
+		if _, err = testPut(); err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+	}
+	if !merged {
+		c.Fatalf("L01 has not been merged")
+	}
+	FillCaches(true)
+	if _, _, err = Get("test", key); err != nil {
+		c.Fatalf("cannot get %s after compaction: %s", key, err)
+	}
+}
+
+func TestCompactDryRun(c *testing.T) {
+	initConfig()
+	for i := 0; i < 10; i++ {
+		if _, err := testPut(); err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+	}
+	before, err := StagingStats("test")
+	if err != nil {
+		c.Fatalf("cannot get staging stats: %s", err)
+	}
+	report, err := Compact("test", nil, &CompactOptions{DryRun: true})
+	if err != nil {
+		c.Fatalf("dry-run compact error: %s", err)
+	}
+	c.Logf("report: %s", report)
+	if !report.DryRun || len(report.Tars) == 0 {
+		c.Errorf("awaited some tars in dry-run report, got %s", report)
+	}
+	after, err := StagingStats("test")
+	if err != nil {
+		c.Fatalf("cannot get staging stats: %s", err)
+	}
+	if before.Count != after.Count || before.Bytes != after.Bytes {
+		c.Errorf("dry-run changed staging: before=%+v after=%+v", before, after)
+	}
+}
+
+// simulates the compaction interrupted after each journaled step: it must be
+// rolled back before the tar is written, and forward after that
+func TestRecoverCompaction(c *testing.T) {
+	initConfig()
+	hashes, err := openHashIndex(conf)
+	if err != nil {
+		c.Fatalf("cannot open the hash index: %s", err)
+	}
+	jfn := filepath.Join(conf.IndexDir, JournalFile)
+	// "cdb-renamed": interrupted between the renames of the cdb and the tar
+	for _, step := range []string{stepBegin, stepWritten, "cdb-renamed", stepRenamed, stepLinked, stepDone} {
+		data := []byte(fmt.Sprintf("journal %s %d\n", step, time.Now().UnixNano()))
+		info := Info{}
+		info.SetFilename("journal.txt", "text/plain")
+		key, err := Put("test", info, bytes.NewReader(data))
+		if err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+		tarfn, err := newTarName(conf, "test")
+		if err != nil {
+			c.Fatalf("cannot create tar name: %s", err)
+		}
+		tempfn := tarfn + SuffTemp
+		linkfn := filepath.Join(conf.IndexDir, "L00", filepath.Base(tarfn)+".cdb")
+		j, err := openJournal(conf.IndexDir)
+		if err != nil {
+			c.Fatalf("cannot open journal: %s", err)
+		}
+		if step == stepDone {
+			if _, err = buildTar(conf, j, hashes, tarfn); err != nil {
+				c.Fatalf("cannot build %s: %s", tarfn, err)
+			}
+			if last, fn, err := readJournal(jfn); err != nil || last != stepDone || fn != tarfn {
+				c.Errorf("journal after build: got %s %s (%v), awaited %s %s",
+					last, fn, err, stepDone, tarfn)
+			}
+		} else {
+			if err = j.Log(stepBegin, tarfn); err == nil {
+				// every staged object goes into the tar
+				_, err = createTar(tempfn, conf.StagingDir, 1<<40,
+					int64(conf.InlineThreshold), hashes, false)
+			}
+			hashes.Rollback()
+			if err == nil && step != stepBegin {
+				if err = syncFiles(tempfn, tempfn+".cdb"); err == nil {
+					err = j.Log(stepWritten, tarfn)
+				}
+			}
+			if err == nil && step == "cdb-renamed" {
+				err = os.Rename(tempfn+".cdb", tarfn+".cdb")
+			}
+			if err == nil && (step == stepRenamed || step == stepLinked) {
+				if err = os.Rename(tempfn+".cdb", tarfn+".cdb"); err == nil {
+					if err = os.Rename(tempfn, tarfn); err == nil {
+						err = j.Log(stepRenamed, tarfn)
+					}
+				}
+			}
+			if err == nil && step == stepLinked {
+				if err = os.Symlink(tarfn+".cdb", linkfn); err == nil {
+					err = j.Log(stepLinked, tarfn)
+				}
+			}
+			if err != nil {
+				c.Fatalf("%s: cannot simulate the compaction: %s", step, err)
+			}
+		}
+		_ = j.Close(false)
+
+		if err = RecoverCompaction("test"); err != nil {
+			c.Fatalf("%s: cannot recover: %s", step, err)
+		}
+		if fileExists(jfn) {
+			c.Errorf("%s: the journal remained after recovery", step)
+		}
+		if fileExists(tempfn) || fileExists(tempfn+".cdb") {
+			c.Errorf("%s: the temporary files of %s remained", step, tarfn)
+		}
+		k := key.String()
+		staged := fileExists(filepath.Join(conf.StagingDir, k[:2], k+SuffInfo))
+		switch step {
+		case stepBegin:
+			if !staged || fileExists(tarfn) || fileExists(tarfn+".cdb") || fileIsSymlink(linkfn) {
+				c.Errorf("%s: %s has not been rolled back (staged=%t)", step, tarfn, staged)
+			}
+		case stepDone: // the tar is limited by TarThreshold, key may be left staged
+			if !fileExists(tarfn) || !fileIsSymlink(linkfn) {
+				c.Errorf("%s: %s has not been finished", step, tarfn)
+			}
+		default:
+			if staged || !fileExists(tarfn) || !fileExists(tarfn+".cdb") || !fileIsSymlink(linkfn) {
+				c.Errorf("%s: %s has not been rolled forward (staged=%t)", step, tarfn, staged)
+			}
+		}
+		FillCaches(true)
+		_, r, err := Get("test", key)
+		if err != nil {
+			c.Errorf("%s: cannot get %s: %s", step, key, err)
+			continue
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+			c.Errorf("%s: %s mismatch: got %q (%v)", step, key, got, err)
+		}
+	}
+}
+
+func TestStagingStats(c *testing.T) {
+	initConfig()
+	if _, err := testPut(); err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	stat, err := StagingStats("test")
+	if err != nil {
+		c.Fatalf("cannot get staging stats: %s", err)
+	}
+	// only the files of the staged objects count
+	var size uint64
+	dirs, _ := filepath.Glob(filepath.Join(conf.StagingDir, "??"))
+	for _, dn := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dn, "*"))
+		for _, fn := range files {
+			if fi, err := os.Lstat(fn); err == nil && !fi.IsDir() {
+				size += uint64(fi.Size())
+			}
+		}
+	}
+	if stat.Bytes != size {
+		c.Errorf("staging stats: got %d bytes, awaited %d", stat.Bytes, size)
+	}
+}
+
+func TestMergeTars(c *testing.T) {
+	initConfig()
+	keys := make([]UUID, 3)
+	var err error
+	for i := range keys {
+		if keys[i], err = testPut(); err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+	}
+	if _, err = Compact("test", nil, nil); err != nil {
+		c.Fatalf("compact error: %s", err)
+	}
+	// the compacted tars, as the tars linked into L00 cannot be merged with them
+	sources := make([]string, 0, 4)
+	walkTarFiles("test", conf.TarDir, func(uuid, fn string) error {
+		if !isLinkedIntoL00(conf, fn) {
+			sources = append(sources, fn)
+		}
+		return nil
+	})
+	if len(sources) < 2 {
+		c.Skipf("only %d tars", len(sources))
+	}
+	dest, err := newTarName(conf, "test")
+	if err != nil {
+		c.Fatalf("cannot create tar name: %s", err)
+	}
+	// the content hashes must be redirected, too
+	hashes, err := openHashIndex(conf)
+	if err != nil {
+		c.Fatalf("cannot open hash index: %s", err)
+	}
+	if _, err = mergeTars(conf, dest, sources, hashes, nil); err != nil {
+		c.Fatalf("cannot merge %s: %s", sources, err)
+	}
+	for _, fn := range sources {
+		if fileExists(fn) {
+			c.Errorf("%s still exists after merge", fn)
+		}
+	}
+	FillCaches(true)
+	for _, key := range keys {
+		checkTestGet(c, key)
+	}
+}
+
+func TestTarPath(c *testing.T) {
+	bn := "test-20121224T180000-Zq-JcSqvQu2Ke0SL-t2yHA.tar"
+	if fn, awaited := tarPath("/tars", bn), "/tars/Zq/"+bn; fn != awaited {
+		c.Errorf("tarPath of %s: got %s, awaited %s", bn, fn, awaited)
+	}
+}
+
+func TestGlobalDedup(c *testing.T) {
+	initConfig()
+	keys := make([]UUID, 2)
+	var err error
+	for i := range keys {
+		if keys[i], err = testPut(); err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+		if _, err = Compact("test", nil, nil); err != nil {
+			c.Fatalf("compact error: %s", err)
+		}
+	}
+	FillCaches(true)
+	for _, key := range keys {
+		checkTestGet(c, key)
+	}
+}
+
+func TestUploadDedup(c *testing.T) {
+	initConfig()
+	keys := make([]UUID, 2)
+	for i := range keys {
+		fh, err := os.Open("store_test.go")
+		if err != nil {
+			c.Fatalf("cannot open store_test.go: %s", err)
+		}
+		info := Info{}
+		info.SetFilename("store_test.go", "text/go")
+		var deduplicated bool
+		keys[i], deduplicated, err = PutDedup("test", info, fh)
+		fh.Close()
+		if err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+		if i > 0 && !deduplicated {
+			c.Errorf("the second upload of the same content is not deduplicated")
+		}
+	}
+	for _, key := range keys {
+		checkTestGet(c, key)
+	}
+	if _, err := Compact("test", nil, nil); err != nil {
+		c.Fatalf("compact error: %s", err)
+	}
+	FillCaches(true)
+	for _, key := range keys {
+		checkTestGet(c, key)
+	}
+}
+
+// checks that key has the content of testPut
+func checkTestGet(c *testing.T, key UUID) {
+	awaited, err := ioutil.ReadFile("store_test.go")
+	if err != nil {
+		c.Fatalf("cannot read store_test.go: %s", err)
+	}
+	_, r, err := Get("test", key)
+	if err != nil {
+		c.Fatalf("cannot get %s: %s", key, err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		c.Fatalf("cannot read %s: %s", key, err)
+	}
+	if !bytes.Equal(data, awaited) {
+		c.Errorf("%s mismatch", key)
+	}
+}
+
 func TestDeDup(c *testing.T) {
 	testPut()
 	testPut()
-	DeDup(conf.StagingDir, conf.ContentHash, false)
+	if _, err := DeDup(conf.StagingDir, conf.ContentHash, false); err != nil {
+		c.Fatalf("dedup error: %s", err)
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := DeDupRealm("test", &CompactOptions{Cancel: cancel}); err != ErrCanceled {
+		c.Errorf("canceled dedup: got %v, awaited %s", err, ErrCanceled)
+	}
 }
 
 func TestCdbMerge(c *testing.T) {
@@ -181,7 +696,7 @@ func TestCdbMerge(c *testing.T) {
 			break
 		}
 		//logger.Printf("elt: %s", elt)
-		if elt.Key[0] != '/' {
+		if !isBookKey(elt.Key) {
 			found = append(found, BytesToStr(elt.Key))
 		}
 	}
@@ -189,3 +704,734 @@ func TestCdbMerge(c *testing.T) {
 		c.Fatalf("found=%s != keys=%s", found, keys)
 	}
 }
+
+func TestTier(c *testing.T) {
+	initConfig()
+	key, err := testPut()
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	// neither inlined nor chunked, so it can be deduplicated globally
+	mid := []byte(fmt.Sprintf("%d\n", time.Now().UnixNano()))
+	mid = append(mid, bytes.Repeat([]byte{'m'}, 400-len(mid))...)
+	if conf.InlineThreshold >= uint64(len(mid)) || conf.ChunkSize > 0 && conf.ChunkSize <= uint64(len(mid)) {
+		c.Fatalf("%d bytes are inlined or chunked", len(mid))
+	}
+	midInfo := Info{}
+	midInfo.SetFilename("mid.txt", "text/plain")
+	if _, err = Put("test", midInfo, bytes.NewReader(mid)); err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	if _, err = Compact("test", nil, nil); err != nil {
+		c.Fatalf("compact error: %s", err)
+	}
+	tarfn, _ := findTar(c, conf.TarDir, key)
+	if tarfn == "" {
+		c.Fatalf("cannot find the tar of %s in %s", key, conf.TarDir)
+	}
+	moved, err := Tier("test", 0, nil)
+	if err != nil {
+		c.Fatalf("tier error: %s", err)
+	}
+	if len(moved) == 0 {
+		c.Fatalf("no tar has been moved")
+	}
+	if fileExists(tarfn) || fileExists(tarfn+".cdb") {
+		c.Errorf("%s is still in %s", tarfn, conf.TarDir)
+	}
+	coldfn := filepath.Join(conf.ColdDir, strings.TrimPrefix(tarfn, conf.TarDir))
+	if !tarExists(coldfn) || !fileExists(coldfn+".cdb") {
+		c.Errorf("%s is not in %s", filepath.Base(tarfn), conf.ColdDir)
+	}
+	FillCaches(true)
+	checkTestGet(c, key)
+	refreeze("test", conf.ColdDir)
+	checkTestGet(c, key)
+
+	// the thawed copy is not removed between thawing and opening it
+	awaited, _ := ioutil.ReadFile("store_test.go")
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, r, err := Get("test", key)
+			if err == nil {
+				var data []byte
+				if data, err = ioutil.ReadAll(r); err == nil && !bytes.Equal(data, awaited) {
+					err = fmt.Errorf("%s mismatch", key)
+				}
+			}
+			errs <- err
+		}()
+		refreeze("test", conf.ColdDir)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err = <-errs; err != nil {
+			c.Errorf("get while refreezing: %s", err)
+		}
+	}
+
+	// the same data is deduplicated into a reference to a (now cold) tar
+	key2, err := Put("test", midInfo, bytes.NewReader(mid))
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	k := key2.String()
+	ifn := filepath.Join(conf.StagingDir, k[:2], k+SuffInfo)
+	fh, err := os.Open(ifn)
+	if err != nil {
+		c.Fatalf("cannot open %s: %s", ifn, err)
+	}
+	info, err := ReadInfo(fh)
+	fh.Close()
+	if err != nil {
+		c.Fatalf("cannot read %s: %s", ifn, err)
+	}
+	if info.Get(InfoPref+"Ref-Tar") == "" {
+		c.Fatalf("%s is not a reference", key2)
+	}
+	if reffn, err := refTarfn(&info, conf, ifn); err != nil {
+		c.Errorf("cannot find the referenced tar of %s: %s", key2, err)
+	} else if !strings.HasPrefix(reffn, conf.ColdDir) {
+		c.Errorf("referenced tar %s is not in %s", reffn, conf.ColdDir)
+	}
+	_, r, err := Get("test", key2)
+	if err != nil {
+		c.Fatalf("cannot get %s: %s", key2, err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, mid) {
+		c.Errorf("%s mismatch (%v)", key2, err)
+	}
+}
+
+func TestCompactAll(c *testing.T) {
+	initConfig()
+	key, err := testPut()
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	reports, err := CompactAll(nil, &CompactOptions{Workers: 2})
+	if err != nil {
+		c.Fatalf("compact all error: %s", err)
+	}
+	if reports["test"] == nil {
+		c.Errorf("no report for test: %+v", reports)
+	}
+	FillCaches(true)
+	checkTestGet(c, key)
+
+	// two realms concurrently, one of them failing
+	started := make(chan string, 2)
+	injected := errors.New("injected failure")
+	reports, err = compactRealms([]string{"a", "b"}, 2, func(realm string) (*CompactReport, error) {
+		started <- realm
+		// wait for the other realm to start, too
+		deadline := time.Now().Add(5 * time.Second)
+		for len(started) < 2 {
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("%s: the other realm has not started", realm)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if realm == "b" {
+			return &CompactReport{Realm: realm}, injected
+		}
+		return &CompactReport{Realm: realm}, nil
+	})
+	if len(reports) != 2 || reports["a"] == nil || reports["b"] == nil {
+		c.Errorf("awaited reports for a and b, got %+v", reports)
+	}
+	errs, ok := err.(CompactErrors)
+	if !ok {
+		c.Fatalf("awaited CompactErrors, got %#v", err)
+	}
+	if len(errs) != 1 || errs["b"] != injected {
+		c.Errorf("awaited only the injected error of b, got %s", errs)
+	}
+}
+
+func TestPutNewDelete(c *testing.T) {
+	initConfig()
+	key, err := NewUUID()
+	if err != nil {
+		c.Fatalf("cannot create key: %s", err)
+	}
+	info := Info{}
+	info.SetFilename("store_test.go", "text/go")
+	info.Key = key
+	put := func() error {
+		data, err := os.Open("store_test.go")
+		if err != nil {
+			c.Fatalf("cannot open store_test.go: %s", err)
+		}
+		defer data.Close()
+		_, _, err = PutNew("test", info, data)
+		return err
+	}
+	if err = put(); err != nil {
+		c.Fatalf("cannot put %s: %s", key, err)
+	}
+	checkTestGet(c, key)
+	if err = put(); err != ErrExists {
+		c.Errorf("second put of %s: got %v, awaited %s", key, err, ErrExists)
+	}
+	if err = Delete("test", key); err != nil {
+		c.Fatalf("cannot delete %s: %s", key, err)
+	}
+	if _, _, err = Get("test", key); err != NotFound {
+		c.Errorf("get of deleted %s: got %v, awaited %s", key, err, NotFound)
+	}
+	if err = put(); err != ErrExists {
+		c.Errorf("put of deleted %s: got %v, awaited %s", key, err, ErrExists)
+	}
+}
+
+func TestLineFile(c *testing.T) {
+	fh, err := ioutil.TempFile("", "aostor-linefile-")
+	if err != nil {
+		c.Fatalf("cannot create temp file: %s", err)
+	}
+	fh.Close()
+	defer os.Remove(fh.Name())
+	lf := lineFile{fn: fh.Name()}
+	var got []string
+	read := func() {
+		err := lf.read(func() { got = append(got, "reset") }, func(fields []string) error {
+			got = append(got, strings.Join(fields, "="))
+			return nil
+		})
+		if err != nil {
+			c.Fatalf("cannot read %s: %s", lf.fn, err)
+		}
+	}
+	// the partial last line is read only when it is complete
+	for _, step := range []struct{ appended, awaited string }{
+		{"a 1\nb 2\nc", "a=1 b=2"},
+		{" 3\n", "a=1 b=2 c=3"},
+		{"", "a=1 b=2 c=3"},
+	} {
+		if err = lf.append([]byte(step.appended)); err != nil {
+			c.Fatalf("cannot append to %s: %s", lf.fn, err)
+		}
+		if read(); strings.Join(got, " ") != step.awaited {
+			c.Errorf("after appending %q: got %q, awaited %q", step.appended, got, step.awaited)
+		}
+	}
+	// recreated
+	if err = ioutil.WriteFile(lf.fn, []byte("d 4\n"), 0640); err != nil {
+		c.Fatalf("cannot rewrite %s: %s", lf.fn, err)
+	}
+	if read(); strings.Join(got, " ") != "a=1 b=2 c=3 reset d=4" {
+		c.Errorf("after recreation: got %q", got)
+	}
+}
+
+func TestPutNewConcurrent(c *testing.T) {
+	initConfig()
+	keys := make([]UUID, 2)
+	for i := range keys {
+		var err error
+		if keys[i], err = NewUUID(); err != nil {
+			c.Fatalf("cannot create key: %s", err)
+		}
+	}
+	putNew := func(key UUID, data io.Reader) error {
+		info := Info{Key: key}
+		info.SetFilename("concurrent.txt", "text/plain")
+		_, _, err := PutNew("test", info, data)
+		return err
+	}
+	// the first put blocks while reading its data
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- putNew(keys[0], pr) }()
+	for i := 0; i < 100; i++ {
+		putNewLock.Lock()
+		reserved := putNewKeys["test/"+keys[0].String()]
+		putNewLock.Unlock()
+		if reserved {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := putNew(keys[0], bytes.NewReader([]byte("second"))); err != ErrExists {
+		c.Errorf("concurrent put of %s: got %v, awaited %s", keys[0], err, ErrExists)
+	}
+	if err := putNew(keys[1], bytes.NewReader([]byte("other"))); err != nil {
+		c.Errorf("cannot put %s while %s is being put: %s", keys[1], keys[0], err)
+	}
+	pw.Write([]byte("first"))
+	pw.Close()
+	if err := <-done; err != nil {
+		c.Fatalf("cannot put %s: %s", keys[0], err)
+	}
+
+	if _, err := Compact("test", nil, nil); err != nil {
+		c.Fatalf("compact error: %s", err)
+	}
+	for _, key := range keys {
+		if ok, err := Exists("test", key); err != nil || !ok {
+			c.Errorf("%s does not exist after compaction (%v)", key, err)
+		}
+	}
+}
+
+func TestGetRaw(c *testing.T) {
+	initConfig()
+	key, err := testPut()
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	awaited, err := ioutil.ReadFile("store_test.go")
+	if err != nil {
+		c.Fatalf("cannot read store_test.go: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, r, encoding, err := GetRaw("test", key)
+		if err != nil {
+			c.Fatalf("cannot get %s: %s", key, err)
+		}
+		if encoding != conf.CompressMethod {
+			c.Errorf("encoding of %s: got %q, awaited %q", key, encoding, conf.CompressMethod)
+		}
+		if r, err = Decode(r, encoding); err != nil {
+			c.Fatalf("cannot decode %s: %s", key, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			c.Fatalf("cannot read %s: %s", key, err)
+		}
+		if !bytes.Equal(data, awaited) {
+			c.Errorf("%s mismatch", key)
+		}
+		if i == 0 {
+			if _, err = Compact("test", nil, nil); err != nil {
+				c.Fatalf("compact error: %s", err)
+			}
+			FillCaches(true)
+		}
+	}
+}
+
+func TestSignedURL(c *testing.T) {
+	cf := Config{SignKey: "secret", ReadTokens: []string{"r"}}
+	if cf.CanRead("") || cf.CanRead("w") || !cf.CanRead("r") || !cf.CanWrite("") {
+		c.Errorf("bad token check")
+	}
+	path := "/test/key"
+	exp := time.Now().Add(time.Minute).Unix()
+	q := url.Values{}
+	q.Set("expires", fmt.Sprintf("%d", exp))
+	q.Set("signature", signature(cf.SignKey, path, exp))
+	if err := cf.CheckSignedURL(path, q); err != nil {
+		c.Errorf("signed URL: %s", err)
+	}
+	if err := cf.CheckSignedURL("/test/other", q); err != ErrBadSignature {
+		c.Errorf("other path: got %v, awaited %s", err, ErrBadSignature)
+	}
+	exp = time.Now().Add(-time.Minute).Unix()
+	q.Set("expires", fmt.Sprintf("%d", exp))
+	q.Set("signature", signature(cf.SignKey, path, exp))
+	if err := cf.CheckSignedURL(path, q); err != ErrExpired {
+		c.Errorf("expired: got %v, awaited %s", err, ErrExpired)
+	}
+}
+
+func TestMetrics(c *testing.T) {
+	initConfig()
+	key, err := testPut()
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	checkTestGet(c, key)
+	buf := bytes.NewBuffer(nil)
+	if err = WriteMetrics(buf); err != nil {
+		c.Fatalf("cannot write metrics: %s", err)
+	}
+	for _, line := range []string{"aostor_puts_total{realm=\"test\"} ",
+		"aostor_get_duration_seconds_count{realm=\"test\"} ",
+		"aostor_staging_objects{realm=\"test\"} "} {
+		if !strings.Contains(buf.String(), "\n"+line) {
+			c.Errorf("no %s in %s", line, buf)
+		}
+	}
+	if realmStats("test").Gets == 0 || realmStats("test").BytesOut == 0 {
+		c.Errorf("get has not been counted: %+v", realmStats("test"))
+	}
+}
+
+// returns 0 bytes (and no error) at every other read
+type stutterReader struct {
+	r       io.Reader
+	stutter bool
+}
+
+func (s *stutterReader) Read(p []byte) (int, error) {
+	if s.stutter = !s.stutter; s.stutter {
+		return 0, nil
+	}
+	return s.r.Read(p)
+}
+
+func TestQuota(c *testing.T) {
+	initConfig()
+	for data, awaited := range map[string]error{"0123456789": nil, "0123456789A": ErrTooLarge} {
+		lr := &limitedReader{r: strings.NewReader(data), left: 10, err: ErrTooLarge}
+		if _, err := ioutil.ReadAll(lr); err != awaited {
+			c.Errorf("reading %q: got %v, awaited %v", data, err, awaited)
+		}
+		// a reader returning 0 bytes without an error at the limit
+		lr = &limitedReader{r: &stutterReader{r: strings.NewReader(data)}, left: 10, err: ErrTooLarge}
+		if _, err := ioutil.ReadAll(lr); err != awaited {
+			c.Errorf("reading %q with stutters: got %v, awaited %v", data, err, awaited)
+		}
+	}
+	if _, err := testPut(); err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	u, err := RecomputeUsage("test")
+	if err != nil {
+		c.Fatalf("cannot compute usage: %s", err)
+	}
+	if u.Objects == 0 || u.Bytes == 0 {
+		c.Errorf("zero usage: %+v", u)
+	}
+	qc := conf
+	qc.MaxObjects = u.Objects
+	if _, _, _, err = checkQuota(qc); err != ErrQuotaExceeded {
+		c.Errorf("object quota: got %v, awaited %s", err, ErrQuotaExceeded)
+	}
+	qc.MaxObjects, qc.MaxObjectSize, qc.MaxBytes = 0, 1<<20, u.Bytes+10
+	limit, quota, res, err := checkQuota(qc)
+	if err != nil || limit != 10 || !quota {
+		c.Errorf("bytes quota: got %d, %t, %v, awaited 10, true, nil", limit, quota, err)
+	}
+	// the parallel puts share the budget
+	if err = res.take(6); err != nil {
+		c.Errorf("cannot reserve 6 bytes of 10: %s", err)
+	}
+	limit, _, res2, err := checkQuota(qc)
+	if err != nil || limit != 4 {
+		c.Errorf("bytes quota beside a reservation: got %d, %v, awaited 4, nil", limit, err)
+	}
+	if err = res2.take(6); err != ErrQuotaExceeded {
+		c.Errorf("reserving 6 more bytes of 10: got %v, awaited %s", err, ErrQuotaExceeded)
+	}
+	res2.release()
+	res.release()
+	qc.MaxObjects, qc.MaxBytes = u.Objects+1, 0
+	if _, _, res, err = checkQuota(qc); err != nil {
+		c.Errorf("object quota with one left: %s", err)
+	}
+	if _, _, _, err = checkQuota(qc); err != ErrQuotaExceeded {
+		c.Errorf("object quota beside a reservation: got %v, awaited %s", err, ErrQuotaExceeded)
+	}
+	res.release()
+	if _, _, res, err = checkQuota(qc); err != nil {
+		c.Errorf("object quota after the release: %s", err)
+	}
+	res.release()
+
+	// rewritten by another process (shovel -usage)
+	fn := filepath.Join(conf.IndexDir, UsageFile)
+	if err = ioutil.WriteFile(fn, []byte(fmt.Sprintf("%d %d\n", u.Objects+1000, u.Bytes)), 0640); err != nil {
+		c.Fatalf("cannot write %s: %s", fn, err)
+	}
+	if got, err := RealmUsage("test"); err != nil || got.Objects != u.Objects+1000 {
+		c.Errorf("changed usage file: got %+v (%v), awaited %d objects", got, err, u.Objects+1000)
+	}
+	if _, err = RecomputeUsage("test"); err != nil {
+		c.Errorf("cannot recompute usage: %s", err)
+	}
+}
+
+func TestNamed(c *testing.T) {
+	initConfig()
+	prefix := fmt.Sprintf("named-%d/", time.Now().UnixNano())
+	keys := make([]UUID, 0, 2)
+	for i, text := range []string{"first", "second"} {
+		obj, err := PutNamed("test", prefix+"a.txt", "", Info{}, strings.NewReader(text))
+		if err != nil {
+			c.Fatalf("cannot put %d: %s", i, err)
+		}
+		if awaited := fmt.Sprintf("%x", md5.Sum([]byte(text))); obj.ETag != awaited {
+			c.Errorf("etag: got %s, awaited %s", obj.ETag, awaited)
+		}
+		keys = append(keys, obj.Key)
+	}
+	// the overwritten object is removed
+	if _, _, err := Get("test", keys[0]); err != NotFound {
+		c.Errorf("get of overwritten %s: got %v, awaited %s", keys[0], err, NotFound)
+	}
+	if _, err := PutNamed("test", prefix+"b/c.txt", "x-1", Info{}, strings.NewReader("c")); err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	obj, ok, err := LookupName("test", prefix+"a.txt")
+	if err != nil || !ok {
+		c.Fatalf("cannot find %sa.txt: %v", prefix, err)
+	}
+	_, r, err := Get("test", obj.Key)
+	if err != nil {
+		c.Fatalf("cannot get %s: %s", obj.Key, err)
+	}
+	if b, _ := ioutil.ReadAll(r); string(b) != "second" || obj.Size != 6 {
+		c.Errorf("got %q (size %d), awaited the second", b, obj.Size)
+	}
+	objs, err := ListNames("test", prefix)
+	if err != nil {
+		c.Fatalf("cannot list: %s", err)
+	}
+	if len(objs) != 2 || objs[0].Name != prefix+"a.txt" || objs[1].ETag != "x-1" {
+		c.Errorf("list: got %v", objs)
+	}
+	if err = DeleteNamed("test", prefix+"a.txt"); err != nil {
+		c.Fatalf("cannot delete: %s", err)
+	}
+	if _, ok, _ = LookupName("test", prefix+"a.txt"); ok {
+		c.Errorf("deleted name still found")
+	}
+	if _, _, err = Get("test", obj.Key); err != NotFound {
+		c.Errorf("get of deleted %s: got %v, awaited %s", obj.Key, err, NotFound)
+	}
+
+	// an empty object ("directory" marker) is only named
+	if obj, err = PutNamed("test", prefix+"d/", "", Info{}, strings.NewReader("")); err != nil {
+		c.Fatalf("cannot put empty: %s", err)
+	}
+	if !obj.Key.IsEmpty() || obj.Size != 0 || obj.ETag != fmt.Sprintf("%x", md5.Sum(nil)) {
+		c.Errorf("empty object: got %+v", obj)
+	}
+	if obj, ok, err = LookupName("test", prefix+"d/"); err != nil || !ok || !obj.Key.IsEmpty() {
+		c.Errorf("lookup of empty object: got %+v, %t, %v", obj, ok, err)
+	}
+	if err = DeleteNamed("test", prefix+"d/"); err != nil {
+		c.Errorf("cannot delete empty object: %s", err)
+	}
+}
+
+func TestWalkInfos(c *testing.T) {
+	initConfig()
+	key, err := testPut()
+	if err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	found := func() bool {
+		ok := false
+		if err := WalkInfos("test", func(info Info) error {
+			if info.Key == key {
+				ok = true
+				return StopIteration
+			}
+			return nil
+		}); err != nil {
+			c.Fatalf("cannot walk: %s", err)
+		}
+		return ok
+	}
+	if !found() {
+		c.Errorf("%s not found", key)
+	}
+	if err = Delete("test", key); err != nil {
+		c.Fatalf("cannot delete %s: %s", key, err)
+	}
+	if found() {
+		c.Errorf("deleted %s found", key)
+	}
+}
+
+func TestCheck(c *testing.T) {
+	initConfig()
+	if _, err := testPut(); err != nil {
+		c.Fatalf("cannot put: %s", err)
+	}
+	if _, err := Compact("test", nil, nil); err != nil {
+		c.Fatalf("cannot compact: %s", err)
+	}
+	steps := 0
+	report, err := Check("test", &CompactOptions{Progress: func(string) { steps++ }})
+	if err != nil {
+		c.Fatalf("cannot check: %s", err)
+	}
+	if len(report.Problems) > 0 {
+		c.Errorf("problems: %s", report)
+	}
+	if steps != report.Tars {
+		c.Errorf("got %d progress steps for %d tars", steps, report.Tars)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err = Check("test", &CompactOptions{Cancel: cancel}); report.Tars > 0 && err != ErrCanceled {
+		c.Errorf("canceled check: got %v, awaited %s", err, ErrCanceled)
+	}
+}
+
+func TestResumableUpload(c *testing.T) {
+	initConfig()
+	data, err := ioutil.ReadFile("store_test.go")
+	if err != nil {
+		c.Fatalf("cannot read store_test.go: %s", err)
+	}
+	info := Info{}
+	info.SetFilename("store_test.go", "text/go")
+	up, err := CreateUpload("test", info, int64(len(data)))
+	if err != nil {
+		c.Fatalf("cannot create upload: %s", err)
+	}
+	half := uint64(len(data) / 2)
+	if up, err = AppendUpload("test", up.ID, 0, bytes.NewReader(data[:half])); err != nil {
+		c.Fatalf("cannot append: %s", err)
+	}
+	if _, err = AppendUpload("test", up.ID, 0, bytes.NewReader(data[half:])); err != ErrOffsetMismatch {
+		c.Errorf("append at bad offset: got %v, awaited %s", err, ErrOffsetMismatch)
+	}
+	if _, _, err = FinishUpload("test", up.ID); err != ErrIncomplete {
+		c.Errorf("finish of incomplete: got %v, awaited %s", err, ErrIncomplete)
+	}
+	if up, err = GetUpload("test", up.ID); err != nil || up.Offset != half {
+		c.Fatalf("get upload: got %+v (%v), awaited offset %d", up, err, half)
+	}
+	if _, err = AppendUpload("test", up.ID, half, bytes.NewReader(data[half:])); err != nil {
+		c.Fatalf("cannot append: %s", err)
+	}
+	key, _, err := FinishUpload("test", up.ID)
+	if err != nil {
+		c.Fatalf("cannot finish upload: %s", err)
+	}
+	checkTestGet(c, key)
+	if _, err = GetUpload("test", up.ID); err != ErrNoUpload {
+		c.Errorf("get of finished upload: got %v, awaited %s", err, ErrNoUpload)
+	}
+}
+
+func TestUnstage(c *testing.T) {
+	initConfig()
+	data, err := ioutil.ReadFile("store_test.go")
+	if err != nil {
+		c.Fatalf("cannot read store_test.go: %s", err)
+	}
+	// unique and chunked
+	data = bytes.Repeat(append(data, []byte(fmt.Sprintf("%d\n", time.Now().UnixNano()))...), 3)
+	keys := make([]UUID, 2)
+	for i := range keys {
+		fh, err := SpoolUpload("test", bytes.NewReader(data))
+		if err != nil {
+			c.Fatalf("cannot spool: %s", err)
+		}
+		if filepath.Dir(fh.Name()) != filepath.Join(conf.StagingDir, SpoolDir) {
+			c.Errorf("spooled into %s", fh.Name())
+		}
+		info := Info{}
+		info.SetFilename("unstage.txt", "text/plain")
+		keys[i], _, err = PutDedup("test", info, fh)
+		fh.Close()
+		os.Remove(fh.Name())
+		if err != nil {
+			c.Fatalf("cannot put: %s", err)
+		}
+	}
+	for i, key := range keys {
+		if err = Unstage("test", key); err != nil {
+			c.Fatalf("cannot unstage %s: %s", key, err)
+		}
+		key_s := key.String()
+		base := filepath.Join(conf.StagingDir, key_s[:2], key_s)
+		if fileExists(base+SuffInfo) || fileExists(base+SuffData) {
+			c.Errorf("%s remained in the staging dir", key)
+		}
+		if _, _, err = Get("test", key); err != NotFound {
+			c.Errorf("get of unstaged %s: got %v, awaited %s", key, err, NotFound)
+		}
+		if i == len(keys)-1 {
+			break
+		}
+		// the deduplicated copy shares the chunks
+		_, r, err := Get("test", keys[i+1])
+		if err != nil {
+			c.Fatalf("cannot get %s: %s", keys[i+1], err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+			c.Errorf("%s mismatch after unstaging %s (%v)", keys[i+1], key, err)
+		}
+	}
+	if err = Unstage("test", keys[0]); err != NotFound {
+		c.Errorf("unstage of unstaged: got %v, awaited %s", err, NotFound)
+	}
+}
+
+func TestUploadQuota(c *testing.T) {
+	initConfig()
+	info := Info{}
+	info.SetFilename("quota.txt", "text/plain")
+	up, err := CreateUpload("test", info, -1)
+	if err != nil {
+		c.Fatalf("cannot create upload: %s", err)
+	}
+	if up, err = AppendUpload("test", up.ID, 0, strings.NewReader("0123456789")); err != nil {
+		c.Fatalf("cannot append: %s", err)
+	}
+	base, _ := uploadBase(conf, up.ID)
+	n, uploaded, err := openUploads(conf)
+	if err != nil {
+		c.Fatalf("cannot list the uploads: %s", err)
+	}
+	u, err := RecomputeUsage("test")
+	if err != nil {
+		c.Fatalf("cannot compute usage: %s", err)
+	}
+	qc := conf
+	qc.MaxObjects = u.Objects + n
+	if _, _, _, err = checkQuota(qc); err != ErrQuotaExceeded {
+		c.Errorf("object quota with open uploads: got %v, awaited %s", err, ErrQuotaExceeded)
+	}
+	qc.MaxObjects, qc.MaxObjectSize, qc.MaxBytes = 0, 1<<20, u.Bytes+uploaded+10
+	limit, quota, res, err := checkQuota(qc)
+	if err != nil || limit != 10 || !quota {
+		c.Errorf("bytes quota with open uploads: got %d, %t, %v, awaited 10, true, nil",
+			limit, quota, err)
+	}
+	res.release()
+
+	// a busy upload is not counted (its bytes are reserved by its holder),
+	// and it is not removed, even if it has expired
+	qc.UploadExpiry = time.Nanosecond
+	unlock, err := lockUpload(base)
+	if err != nil {
+		c.Fatalf("cannot lock the upload: %s", err)
+	}
+	if others, _, _ := openUploads(conf); n == 0 || uploaded < 10 || others != n-1 {
+		c.Errorf("open uploads: %d with %d bytes, %d not busy", n, uploaded, others)
+	}
+	if removeExpiredUpload(qc, up.ID) || !fileExists(base+".part") {
+		c.Errorf("busy upload %s has been removed", up.ID)
+	}
+	unlock()
+	if !removeExpiredUpload(qc, up.ID) || fileExists(base+".part") {
+		c.Errorf("expired upload %s has not been removed", up.ID)
+	}
+
+	// the parts of a multipart upload count as an open upload
+	dn := filepath.Join(conf.StagingDir, PartsDir, up.ID)
+	if err = os.MkdirAll(dn, 0750); err != nil {
+		c.Fatalf("cannot create %s: %s", dn, err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dn, "1"), []byte("0123456789"), 0640); err != nil {
+		c.Fatalf("cannot write part: %s", err)
+	}
+	if parts, partBytes, _ := openUploads(conf); parts != n || partBytes != uploaded {
+		c.Errorf("open uploads with parts: got %d with %d bytes, awaited %d with %d",
+			parts, partBytes, n, uploaded)
+	}
+	if unlock, err = LockParts(dn); err != nil {
+		c.Fatalf("cannot lock the parts: %s", err)
+	}
+	if parts, _, _ := openUploads(conf); parts != n-1 {
+		c.Errorf("busy parts are counted: got %d open uploads, awaited %d", parts, n-1)
+	}
+	if removeExpiredParts(qc, dn) || !fileExists(dn) {
+		c.Errorf("busy parts %s have been removed", dn)
+	}
+	unlock()
+	if !removeExpiredParts(qc, dn) || fileExists(dn) {
+		c.Errorf("expired parts %s have not been removed", dn)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// names of the index compaction strategies (index_strategy in the [compact] section)
+const (
+	StrategyThreshold  = "threshold"   // the default
+	StrategySizeTiered = "size-tiered" // merges cdbs of similar size
+	StrategyTimeWindow = "time-window" // merges cdbs of the same time window
+)
+
+// the default window of the time-window strategy
+const DefaultIndexWindow = 24 * time.Hour
+
+// a cdb of an index level
+type CdbFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// CompactionStrategy decides which cdbs of an index level are merged
+// together, each group into one cdb of the next level
+type CompactionStrategy interface {
+	Plan(level uint, files []CdbFile, threshold uint) [][]string
+}
+
+// returns the index compaction strategy by name
+func NewCompactionStrategy(name string, window time.Duration) (CompactionStrategy, error) {
+	switch name {
+	case "", StrategyThreshold:
+		return ThresholdStrategy{}, nil
+	case StrategySizeTiered:
+		return SizeTieredStrategy{}, nil
+	case StrategyTimeWindow:
+		if window <= 0 {
+			window = DefaultIndexWindow
+		}
+		return TimeWindowStrategy{Window: window}, nil
+	}
+	return nil, fmt.Errorf("unknown index compaction strategy %q", name)
+}
+
+// merges the biggest cdbs, threshold of them at once (up to MAX_CDB_SIZE),
+// when the level holds more than threshold cdbs
+type ThresholdStrategy struct{}
+
+func (s ThresholdStrategy) Plan(level uint, cdbs []CdbFile, threshold uint) [][]string {
+	files := make(sizedFilenames, 0, len(cdbs))
+	for _, f := range cdbs {
+		files = append(files, &sizedFilename{f.Name, f.Size})
+	}
+	length := uint(len(files))
+	if length <= threshold {
+		return nil
+	}
+	sort.Sort(bySizeReversed{files})
+	groups := make([][]string, 0, length/threshold+1)
+	lskip := uint(0)
+	for lskip < length {
+		fbuf := make([]string, threshold)
+		j := 0
+		size := int64(0)
+		askip := uint(0)
+		for i, sizedfn := range files[lskip:] {
+			if size+sizedfn.size < MAX_CDB_SIZE {
+				fbuf[j] = sizedfn.filename
+				j++
+				size += sizedfn.size
+				if uint(j) >= threshold {
+					fbuf = fbuf[:j]
+					break
+				}
+			} else {
+				if askip == 0 {
+					askip = uint(i)
+				}
+			}
+		}
+		if askip == 0 {
+			askip = uint(len(fbuf))
+		}
+		lskip += askip
+		groups = append(groups, fbuf)
+	}
+	return groups
+}
+
+// merges cdbs of similar size (within the half and the double of their
+// bucket's average), threshold of them at once
+type SizeTieredStrategy struct{}
+
+func (s SizeTieredStrategy) Plan(level uint, cdbs []CdbFile, threshold uint) [][]string {
+	if threshold < 2 {
+		threshold = 2
+	}
+	files := make([]CdbFile, len(cdbs))
+	copy(files, cdbs)
+	sort.Sort(cdbsBySize(files))
+	var (
+		groups [][]string
+		bucket []CdbFile
+		sum    int64
+	)
+	flush := func() {
+		groups = append(groups, splitGroup(bucket, threshold, false)...)
+		bucket, sum = bucket[:0], 0
+	}
+	for _, f := range files {
+		if len(bucket) > 0 {
+			avg := sum / int64(len(bucket))
+			if f.Size > 2*avg || f.Size < avg/2 {
+				flush()
+			}
+		}
+		bucket = append(bucket, f)
+		sum += f.Size
+	}
+	flush()
+	return groups
+}
+
+// merges the cdbs of the same (already closed) time window, by their
+// modification time. The window is multiplied by threshold at each level.
+type TimeWindowStrategy struct {
+	Window time.Duration
+}
+
+func (s TimeWindowStrategy) Plan(level uint, cdbs []CdbFile, threshold uint) [][]string {
+	window := s.Window
+	for i := uint(0); i < level && threshold > 1; i++ {
+		window *= time.Duration(threshold)
+	}
+	current := time.Now().Truncate(window)
+	windows := make(map[int64][]CdbFile, 4)
+	starts := make([]int64, 0, 4)
+	for _, f := range cdbs {
+		start := f.ModTime.Truncate(window)
+		if !start.Before(current) { // still open
+			continue
+		}
+		k := start.Unix()
+		if _, ok := windows[k]; !ok {
+			starts = append(starts, k)
+		}
+		windows[k] = append(windows[k], f)
+	}
+	sort.Sort(int64s(starts))
+	var groups [][]string
+	for _, k := range starts {
+		groups = append(groups, splitGroup(windows[k], uint(len(windows[k])), true)...)
+	}
+	return groups
+}
+
+// splits the files into groups of at most n files and MAX_CDB_SIZE bytes;
+// groups of one file are dropped, as are (unless partial is true)
+// the groups of less than n files
+func splitGroup(files []CdbFile, n uint, partial bool) [][]string {
+	var (
+		groups [][]string
+		group  []string
+		size   int64
+	)
+	for _, f := range files {
+		if len(group) > 0 && (uint(len(group)) >= n || size+f.Size >= MAX_CDB_SIZE) {
+			if len(group) > 1 && (partial || uint(len(group)) >= n) {
+				groups = append(groups, group)
+			}
+			group, size = nil, 0
+		}
+		group = append(group, f.Name)
+		size += f.Size
+	}
+	if len(group) > 1 && (partial || uint(len(group)) >= n) {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+type cdbsBySize []CdbFile
+
+func (s cdbsBySize) Len() int           { return len(s) }
+func (s cdbsBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s cdbsBySize) Less(i, j int) bool { return s[i].Size < s[j].Size }
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
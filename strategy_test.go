@@ -0,0 +1,229 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"fmt"
+	"github.com/tgulacsi/go-cdb"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	benchCdbs      = 60 // number of tar cdbs at L00
+	benchThreshold = 4
+)
+
+// creates an index dir with benchCdbs cdbs of various sizes and ages at L00,
+// compacts it with the strategy, and returns the cdbs by level and the keys
+func prepareIndex(tb testing.TB, strategy CompactionStrategy) (string, [][]string, [][]byte) {
+	index_dir, err := ioutil.TempDir("", "aostor-strategy-")
+	if err != nil {
+		tb.Fatalf("cannot create temp dir: %s", err)
+	}
+	l00 := filepath.Join(index_dir, "L00")
+	if err = os.MkdirAll(l00, 0755); err != nil {
+		tb.Fatalf("cannot create %s: %s", l00, err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	keys := make([][]byte, 0, benchCdbs*100)
+	value := make([]byte, 100)
+	for i := 0; i < benchCdbs; i++ {
+		fn := filepath.Join(l00, fmt.Sprintf("%03d.cdb", i))
+		cw, err := cdb.NewWriter(fn)
+		if err != nil {
+			tb.Fatalf("cannot create %s: %s", fn, err)
+		}
+		for j := 20 + rnd.Intn(400); j > 0; j-- {
+			key, _ := NewUUID()
+			keys = append(keys, key.Bytes())
+			cw.PutPair(key.Bytes(), value)
+		}
+		if err = cw.Close(); err != nil {
+			tb.Fatalf("cannot close %s: %s", fn, err)
+		}
+		mtime := time.Now().Add(-time.Duration(benchCdbs-i) * 6 * time.Hour)
+		_ = os.Chtimes(fn, mtime, mtime)
+	}
+
+	for level := uint(0); level < 100; level++ {
+		if !fileExists(filepath.Join(index_dir, fmt.Sprintf("L%02d", level))) {
+			break
+		}
+		if _, err = compactLevel(level, index_dir, benchThreshold, strategy, false); err != nil {
+			tb.Fatalf("cannot compact L%02d: %s", level, err)
+		}
+	}
+
+	var levels [][]string
+	err = walkCdbFiles("", index_dir, func(level int, fn string) error {
+		for len(levels) <= level {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], fn)
+		return nil
+	})
+	if err != nil {
+		tb.Fatalf("cannot list %s: %s", index_dir, err)
+	}
+	return index_dir, levels, keys
+}
+
+// looks up the key as Get does: through all the cdbs of L00, then the
+// higher levels. Returns the number of cdbs probed.
+func lookupKey(tb testing.TB, levels [][]string, key []byte) int {
+	probes := 0
+	for _, files := range levels {
+		for _, fn := range files {
+			db, err := cdb.Open(fn)
+			if err != nil {
+				tb.Fatalf("cannot open %s: %s", fn, err)
+			}
+			_, err = db.Data(key)
+			_ = db.Close()
+			probes++
+			if err == nil {
+				return probes
+			}
+		}
+	}
+	tb.Fatalf("cannot find %x", key)
+	return probes
+}
+
+// returns the groups as a string, without the empty names (compactLevel
+// ignores those)
+func planString(groups [][]string) string {
+	parts := make([]string, 0, len(groups))
+	for _, group := range groups {
+		names := make([]string, 0, len(group))
+		for _, fn := range group {
+			if fn != "" {
+				names = append(names, fn)
+			}
+		}
+		parts = append(parts, strings.Join(names, " "))
+	}
+	return "[" + strings.Join(parts, "][") + "]"
+}
+
+func TestPlans(t *testing.T) {
+	sized := func(sizes ...int64) []CdbFile {
+		files := make([]CdbFile, len(sizes))
+		for i, size := range sizes {
+			files[i] = CdbFile{Name: string(rune('a' + i)), Size: size}
+		}
+		return files
+	}
+	for i, tc := range []struct {
+		strategy  CompactionStrategy
+		files     []CdbFile
+		threshold uint
+		awaited   string
+	}{
+		// the biggest ones first, the rest in a last, partial group
+		{ThresholdStrategy{}, sized(10, 40, 20, 30, 5), 2, "[b d][c a][e]"},
+		{ThresholdStrategy{}, sized(10, 40, 20, 30, 5), 4, "[b d c a][e]"},
+		{ThresholdStrategy{}, sized(10, 40), 2, "[]"},
+		// the buckets of similar sizes, only the full groups
+		{SizeTieredStrategy{}, sized(100, 1000, 110, 5000, 120, 1100), 2, "[a c][b f]"},
+		{SizeTieredStrategy{}, sized(100, 1000, 110, 5000, 120, 1100), 3, "[a c e]"},
+		{SizeTieredStrategy{}, sized(100, 1000, 110, 5000, 120, 1100), 1, "[a c][b f]"},
+		{SizeTieredStrategy{}, sized(100, 1000, 5000), 2, "[]"},
+	} {
+		if got := planString(tc.strategy.Plan(0, tc.files, tc.threshold)); got != tc.awaited {
+			t.Errorf("%d. %T(%d): got %s, awaited %s", i, tc.strategy, tc.threshold, got, tc.awaited)
+		}
+	}
+
+	// the closed windows, the oldest first; the window grows by threshold at each level
+	s := TimeWindowStrategy{Window: time.Hour}
+	for {
+		base := time.Now().Truncate(2 * time.Hour)
+		at := func(name string, d time.Duration) CdbFile {
+			return CdbFile{Name: name, ModTime: base.Add(d)}
+		}
+		files := []CdbFile{at("p", -10*time.Minute), at("q", -50*time.Minute),
+			at("r", -70*time.Minute), at("s", 61*time.Minute), // s is in an open window
+			at("t", -130*time.Minute), at("u", -170*time.Minute)}
+		level0, level1 := planString(s.Plan(0, files, 2)), planString(s.Plan(1, files, 2))
+		if !time.Now().Truncate(2 * time.Hour).Equal(base) { // closed meanwhile
+			continue
+		}
+		// r is alone in its window at level 0
+		if level0 != "[t u][p q]" {
+			t.Errorf("time window at level 0: got %s, awaited [t u][p q]", level0)
+		}
+		if level1 != "[t u][p q r]" {
+			t.Errorf("time window at level 1: got %s, awaited [t u][p q r]", level1)
+		}
+		break
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building the large index is slow")
+	}
+	for _, name := range []string{StrategyThreshold, StrategySizeTiered, StrategyTimeWindow} {
+		strategy, err := NewCompactionStrategy(name, 24*time.Hour)
+		if err != nil {
+			t.Fatalf("cannot create %s: %s", name, err)
+		}
+		index_dir, levels, keys := prepareIndex(t, strategy)
+		defer os.RemoveAll(index_dir)
+		probes := 0
+		for _, key := range keys {
+			probes += lookupKey(t, levels, key)
+		}
+		counts, total := make([]int, len(levels)), 0
+		for i, files := range levels {
+			counts[i] = len(files)
+			total += counts[i]
+		}
+		if len(levels) < 2 || total >= benchCdbs {
+			t.Errorf("%s: nothing has been merged: cdbs per level: %v", name, counts)
+		}
+		t.Logf("%s: cdbs per level: %v, average probes: %.02f", name, counts,
+			float64(probes)/float64(len(keys)))
+	}
+}
+
+func benchmarkLookup(b *testing.B, name string) {
+	strategy, err := NewCompactionStrategy(name, 24*time.Hour)
+	if err != nil {
+		b.Fatalf("cannot create %s: %s", name, err)
+	}
+	index_dir, levels, keys := prepareIndex(b, strategy)
+	defer os.RemoveAll(index_dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookupKey(b, levels, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkLookupThreshold(b *testing.B)  { benchmarkLookup(b, StrategyThreshold) }
+func BenchmarkLookupSizeTiered(b *testing.B) { benchmarkLookup(b, StrategySizeTiered) }
+func BenchmarkLookupTimeWindow(b *testing.B) { benchmarkLookup(b, StrategyTimeWindow) }
@@ -69,6 +69,7 @@ func ReadItem(tarfn string, pos int64) (ret io.Reader, err error) {
 	f, err := os.Open(tarfn)
 	if err != nil {
 		logger.Errorf("cannot open %s: %s", tarfn, err)
+		return nil, err
 	}
 	c := new(closer)
 	c.AddClose(func() { _ = f.Close() }) //defer f.Close()
@@ -76,6 +77,7 @@ func ReadItem(tarfn string, pos int64) (ret io.Reader, err error) {
 	p, err := f.Seek(pos, 0)
 	if err != nil {
 		logger.Errorf("cannot seek in %s to %d: %s", f, pos, err)
+		c.Close()
 		return nil, err
 	} else if p != pos {
 		logger.Errorf("cannot seek in %s to %d: got %d", f, pos, p)
@@ -84,6 +86,8 @@ func ReadItem(tarfn string, pos int64) (ret io.Reader, err error) {
 	hdr, err := tr.Next()
 	if err != nil {
 		logger.Errorf("cannot go to next tar header: %s", err)
+		c.Close()
+		return nil, err
 	}
 	logger.Debugf("ReadItem(%s, %d) hdr=%s", tarfn, pos, hdr)
 	switch {
@@ -259,7 +263,7 @@ func OpenForAppend(tarfn string) (
 	tw = tar.NewWriter(fh)
 	if err == nil && tw == nil {
 		logger.Criticalf("couldn't open %+v!", tarfn)
-		os.Exit(1)
+		err = &ErrTarWrite{File: tarfn, Err: errors.New("cannot create tar writer")}
 	}
 	fobj = fh
 	logger.Debugf("opened %s (err=%s): tw=%+v, fh=%+v, pos=%d",
@@ -0,0 +1,302 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"github.com/tgulacsi/aostor/compressor"
+	"github.com/tgulacsi/go-locking"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the compress methods of the cold tars
+var coldMethods = []string{"gzip", "bzip2", "xz"}
+
+// the thawing (and opening) of a cold tar and the removal of its thawed
+// copy by refreeze are serialized per tar
+var (
+	thawLocks    = make(map[string]*tarLock, 4)
+	thawLocksMtx = sync.Mutex{}
+)
+
+// the lock of a tar, with the number of its holders and waiters
+type tarLock struct {
+	sync.Mutex
+	users int
+}
+
+// Tier moves the realm's tars (with their cdbs) older than olderThan to the
+// cold dir (compressing them as a whole with ColdCompress), and updates the
+// L00 symlinks and the tar cache. The compressed cold tars are decompressed
+// when they are read, and these thawed copies are removed by the next Tier.
+//
+// Returns the moved tars (their new, uncompressed names).
+func Tier(realm string, olderThan time.Duration, onChange NotifyFunc) (moved []string, err error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return nil, err
+	}
+	if conf.ColdDir == "" {
+		logger.Warnf("no cold dir for %s", realm)
+		return nil, nil
+	}
+	if locks, err := locking.FLockDirs(conf.IndexDir, conf.StagingDir); err != nil {
+		logger.Error("cannot lock dir: ", err)
+		return nil, err
+	} else {
+		defer locks.Unlock()
+	}
+	// an interrupted compaction would link the tar to its original place
+	if err = recoverCompaction(conf); err != nil {
+		return nil, err
+	}
+	if conf.ColdCompress != "" {
+		refreeze(realm, conf.ColdDir)
+	}
+
+	limit := time.Now().Add(-olderThan)
+	tars := make([]string, 0, 16)
+	err = walkTarFiles(realm, conf.TarDir, func(uuid, fn string) error {
+		if fileExists(fn+".cdb") && fileModTime(fn).Before(limit) {
+			tars = append(tars, fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, tarfn := range tars {
+		coldfn, err := moveToCold(conf, realm, tarfn)
+		if err != nil {
+			logger.Errorf("cannot move %s to %s: %s", tarfn, conf.ColdDir, err)
+			return moved, err
+		}
+		logger.Infof("moved %s to %s", tarfn, coldfn)
+		moved = append(moved, coldfn)
+	}
+	if len(moved) > 0 && onChange != nil {
+		onChange()
+	}
+	return moved, nil
+}
+
+// moves the tar and its cdb to the cold dir, returns the new tar name
+func moveToCold(conf Config, realm, tarfn string) (string, error) {
+	rel, err := filepath.Rel(conf.TarDir, tarfn)
+	if err != nil {
+		return "", err
+	}
+	coldfn := filepath.Join(conf.ColdDir, rel)
+	if err = os.MkdirAll(filepath.Dir(coldfn), 0755); err != nil {
+		return "", err
+	}
+	if err = copyFile(tarfn+".cdb", coldfn+".cdb", ""); err != nil {
+		return "", err
+	}
+	dest := coldfn
+	if conf.ColdCompress != "" {
+		dest = coldfn + "." + compressor.ShorterMethod(conf.ColdCompress)
+	}
+	if err = copyFile(tarfn, dest, conf.ColdCompress); err != nil {
+		_ = os.Remove(coldfn + ".cdb")
+		return "", err
+	}
+	if err = syncDir(filepath.Dir(coldfn)); err != nil {
+		return "", err
+	}
+
+	bn := filepath.Base(tarfn)
+	linkfn := filepath.Join(conf.IndexDir, "L00", bn+".cdb")
+	if fileIsSymlink(linkfn) {
+		if err = replaceSymlink(coldfn+".cdb", linkfn); err != nil {
+			return "", err
+		}
+	}
+	cacheLock.Lock()
+	if tf, ok := tarFiles[realm]; ok && tf != nil {
+		tf[bn] = coldfn
+		tf[tarUUID(bn)] = coldfn
+	}
+	cacheLock.Unlock()
+
+	for _, fn := range []string{tarfn + ".cdb", tarfn} {
+		if err = os.Remove(fn); err != nil {
+			logger.Errorf("cannot remove %s: %s", fn, err)
+		}
+	}
+	return coldfn, nil
+}
+
+// copies src to dst (through a temp file), compressing with compressMethod
+func copyFile(src, dst, compressMethod string) error {
+	sfh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sfh.Close()
+	tempfn := dst + SuffTemp
+	dfh, err := os.OpenFile(tempfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = compressor.CompressCopy(dfh, sfh, compressMethod)
+	if err == nil {
+		err = dfh.Sync()
+	}
+	if e := dfh.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tempfn, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tempfn)
+	}
+	return err
+}
+
+// reports whether tarfn exists, maybe only compressed (see thawTar)
+func tarExists(tarfn string) bool {
+	if fileExists(tarfn) {
+		return true
+	}
+	for _, method := range coldMethods {
+		if fileExists(tarfn + "." + compressor.ShorterMethod(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+// locks the tar (see thawLocks), returns the function unlocking it
+func lockTar(tarfn string) func() {
+	thawLocksMtx.Lock()
+	l, ok := thawLocks[tarfn]
+	if !ok {
+		l = &tarLock{}
+		thawLocks[tarfn] = l
+	}
+	l.users++
+	thawLocksMtx.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		thawLocksMtx.Lock()
+		if l.users--; l.users == 0 {
+			delete(thawLocks, tarfn)
+		}
+		thawLocksMtx.Unlock()
+	}
+}
+
+// reads the item at pos of the tar, thawing the tar if it is a compressed
+// cold one. The tar is opened before refreeze can remove the thawed copy,
+// and the opened copy remains readable after its removal.
+func readTarItem(tarfn string, pos int64) (io.Reader, error) {
+	unlock := lockTar(tarfn)
+	defer unlock()
+	if err := thawTar(tarfn); err != nil {
+		return nil, err
+	}
+	return ReadItem(tarfn, pos)
+}
+
+// decompresses the cold tar, if only its compressed version exists.
+// The tar must be locked (see lockTar).
+func thawTar(tarfn string) error {
+	if fileExists(tarfn) {
+		return nil
+	}
+	for _, method := range coldMethods {
+		cfn := tarfn + "." + compressor.ShorterMethod(method)
+		if !fileExists(cfn) {
+			continue
+		}
+		logger.Infof("thawing %s", cfn)
+		return decompressFile(cfn, tarfn, method)
+	}
+	return nil
+}
+
+// decompresses src into dst (through a temp file)
+func decompressFile(src, dst, method string) error {
+	sfh, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sfh.Close()
+	tempfn := dst + SuffTemp
+	dfh, err := os.OpenFile(tempfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	switch method {
+	case "gzip", "bzip2":
+		var r io.Reader
+		if r, err = decodeReader(sfh, method); err == nil {
+			_, err = io.Copy(dfh, r)
+		}
+	default:
+		err = compressor.ExternalDecompressCopy(dfh, sfh, method)
+	}
+	if e := dfh.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tempfn, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tempfn)
+	}
+	return err
+}
+
+// removes the thawed copies of the compressed cold tars
+func refreeze(realm, colddir string) {
+	_ = walkTarFiles(realm, colddir, func(uuid, fn string) error {
+		if !fileExists(fn) {
+			return nil
+		}
+		for _, method := range coldMethods {
+			if fileExists(fn + "." + compressor.ShorterMethod(method)) {
+				logger.Debugf("removing thawed %s", fn)
+				unlock := lockTar(fn)
+				_ = os.Remove(fn)
+				unlock()
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// returns the logical (uncompressed) name of the cold tar fn
+func coldTarName(fn string) string {
+	for _, method := range coldMethods {
+		if ext := ".tar." + compressor.ShorterMethod(method); strings.HasSuffix(fn, ext) {
+			return fn[:len(fn)-len(ext)+4]
+		}
+	}
+	return fn
+}
@@ -0,0 +1,543 @@
+// Copyright 2012 Tamás Gulácsi, UNO-SOFT Computing Ltd.
+//
+// All rights reserved.
+//
+// This file is part of aostor.
+//
+// Aostor is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Aostor is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Aostor.  If not, see <http://www.gnu.org/licenses/>.
+
+package aostor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the resumable uploads are kept in this directory of the staging dir:
+// the received data in id.part, the info in id.meta
+const UploadsDir = "_uploads"
+
+// the data spooled by SpoolUpload is kept in this directory of the staging dir
+const SpoolDir = "_spool"
+
+// the parts of the multipart (S3) uploads are kept in this directory of the
+// staging dir, one directory per upload. Those count as open uploads, too.
+const PartsDir = "_s3uploads"
+
+var (
+	// ErrNoUpload is returned for unknown (finished, aborted or expired) uploads
+	ErrNoUpload = errors.New("no such upload")
+	// ErrOffsetMismatch is returned by AppendUpload if the offset is not
+	// the number of bytes received
+	ErrOffsetMismatch = errors.New("offset mismatch")
+	// ErrUploadBusy is returned if the upload is being appended to or finished
+	ErrUploadBusy = errors.New("upload is busy")
+	// ErrIncomplete is returned by FinishUpload if less data is received
+	// than announced
+	ErrIncomplete = errors.New("upload is incomplete")
+)
+
+// a resumable upload
+type Upload struct {
+	ID      string
+	Offset  uint64    // number of bytes received
+	Length  int64     // the announced length (-1: unknown)
+	Info    Info      `json:"-"`
+	Updated time.Time // of the last append
+	Expires time.Time
+}
+
+var (
+	uploadsBusy     = make(map[string]bool, 16)
+	uploadsBusyLock = sync.Mutex{}
+)
+
+// CreateUpload starts a resumable upload of an object with the info, and
+// the length, if known (-1 if not). The open uploads count in the quota.
+func CreateUpload(realm string, info Info, length int64) (Upload, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return Upload{}, err
+	}
+	limit, quota, res, err := checkQuota(conf)
+	if err != nil {
+		return Upload{}, err
+	}
+	res.release() // counted as an open upload from now on
+	if limit > 0 && length > 0 && uint64(length) > limit {
+		if quota {
+			return Upload{}, ErrQuotaExceeded
+		}
+		return Upload{}, ErrTooLarge
+	}
+	var b [16]byte
+	if _, err = io.ReadFull(rand.Reader, b[:]); err != nil {
+		return Upload{}, err
+	}
+	up := Upload{ID: hex.EncodeToString(b[:]), Length: length, Info: info,
+		Updated: time.Now()}
+	up.Expires = up.Updated.Add(conf.UploadExpiry)
+	dn := filepath.Join(conf.StagingDir, UploadsDir)
+	if err = os.MkdirAll(dn, 0755); err != nil {
+		return up, err
+	}
+	base := filepath.Join(dn, up.ID)
+	if length >= 0 {
+		info.Add(InfoPref+"Upload-Length", strconv.FormatInt(length, 10))
+	}
+	if err = ioutil.WriteFile(base+".meta", info.Bytes(), 0640); err != nil {
+		return up, err
+	}
+	if err = ioutil.WriteFile(base+".part", nil, 0640); err != nil {
+		_ = os.Remove(base + ".meta")
+		return up, err
+	}
+	logger.Infof("created upload %s of %s", up.ID, realm)
+	return up, nil
+}
+
+// returns the path of the upload's files (without the suffix)
+func uploadBase(conf Config, id string) (string, error) {
+	if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		return "", ErrNoUpload
+	}
+	return filepath.Join(conf.StagingDir, UploadsDir, id), nil
+}
+
+// GetUpload returns the state of the upload (ErrNoUpload if it has expired)
+func GetUpload(realm, id string) (Upload, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return Upload{}, err
+	}
+	up, err := getUpload(conf, id)
+	if err == ErrNoUpload && uploadExpired(conf, up) {
+		removeExpiredUpload(conf, id)
+	}
+	return up, err
+}
+
+// returns whether the upload (as returned by getUpload) has expired
+func uploadExpired(conf Config, up Upload) bool {
+	return conf.UploadExpiry > 0 && !up.Updated.IsZero() && time.Now().After(up.Expires)
+}
+
+// returns the locked (see lockUpload) upload, removing it if it has expired
+func getLockedUpload(conf Config, base, id string) (Upload, error) {
+	up, err := getUpload(conf, id)
+	if err == ErrNoUpload && uploadExpired(conf, up) {
+		removeUpload(base)
+	}
+	return up, err
+}
+
+// removes the upload if it has expired and it is not busy (then its holder
+// removes it), returns whether it has been removed
+func removeExpiredUpload(conf Config, id string) bool {
+	base, err := uploadBase(conf, id)
+	if err != nil {
+		return false
+	}
+	unlock, err := lockUpload(base)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+	// checked again, with the upload locked
+	_, err = getLockedUpload(conf, base, id)
+	return err == ErrNoUpload && !fileExists(base+".part")
+}
+
+// returns the number of the open (not expired) uploads and the bytes
+// received by them - but the busy ones: the bytes of those are reserved by
+// the append or finish holding them (see checkQuota)
+func openUploads(conf Config) (n, bytes uint64, err error) {
+	files, err := filepath.Glob(filepath.Join(conf.StagingDir, UploadsDir, "*.part"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, fn := range files {
+		if isBusy(fn[:len(fn)-5]) {
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			if os.IsNotExist(err) { // finished since
+				continue
+			}
+			return 0, 0, err
+		}
+		if conf.UploadExpiry > 0 && time.Since(fi.ModTime()) > conf.UploadExpiry {
+			continue
+		}
+		n++
+		bytes += uint64(fi.Size())
+	}
+	dirs, err := filepath.Glob(filepath.Join(conf.StagingDir, PartsDir, "*"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, dn := range dirs {
+		if isBusy(dn) {
+			continue
+		}
+		size, updated, err := partsSize(dn)
+		if err != nil {
+			if os.IsNotExist(err) { // completed since
+				continue
+			}
+			return 0, 0, err
+		}
+		if conf.UploadExpiry > 0 && time.Since(updated) > conf.UploadExpiry {
+			continue
+		}
+		n++
+		bytes += size
+	}
+	return n, bytes, nil
+}
+
+// returns whether the upload (its base, or its parts dir) is busy
+func isBusy(base string) bool {
+	uploadsBusyLock.Lock()
+	defer uploadsBusyLock.Unlock()
+	return uploadsBusy[base]
+}
+
+// returns the size of the files in the parts dir, and the last modification
+func partsSize(dn string) (size uint64, updated time.Time, err error) {
+	dh, err := os.Open(dn)
+	if err != nil {
+		return 0, updated, err
+	}
+	fis, err := dh.Readdir(-1)
+	_ = dh.Close()
+	if err != nil {
+		return 0, updated, err
+	}
+	if fi, err := os.Stat(dn); err == nil {
+		updated = fi.ModTime()
+	}
+	for _, fi := range fis {
+		size += uint64(fi.Size())
+		if fi.ModTime().After(updated) {
+			updated = fi.ModTime()
+		}
+	}
+	return size, updated, nil
+}
+
+// returns the upload, ErrNoUpload if it has expired (see removeExpiredUpload)
+func getUpload(conf Config, id string) (Upload, error) {
+	up := Upload{ID: id, Length: -1}
+	base, err := uploadBase(conf, id)
+	if err != nil {
+		return up, err
+	}
+	fi, err := os.Stat(base + ".part")
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNoUpload
+		}
+		return up, err
+	}
+	up.Offset, up.Updated = uint64(fi.Size()), fi.ModTime()
+	up.Expires = up.Updated.Add(conf.UploadExpiry)
+	if uploadExpired(conf, up) {
+		return up, ErrNoUpload
+	}
+	fh, err := os.Open(base + ".meta")
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNoUpload
+		}
+		return up, err
+	}
+	up.Info, err = ReadInfo(fh)
+	_ = fh.Close()
+	if err != nil {
+		return up, err
+	}
+	if length := up.Info.Get(InfoPref + "Upload-Length"); length != "" {
+		if up.Length, err = strconv.ParseInt(length, 10, 64); err != nil {
+			return up, err
+		}
+		up.Info.Del(InfoPref + "Upload-Length")
+	}
+	return up, nil
+}
+
+// LockParts marks the multipart upload's parts dir (in PartsDir) busy while
+// it is completed or aborted, returns the function unmarking it
+// (ErrUploadBusy if it is busy already). The parts of a busy upload are not
+// counted in the quota, and are not expired.
+func LockParts(dn string) (func(), error) {
+	return lockUpload(filepath.Clean(dn))
+}
+
+// marks the upload busy, returns the function unmarking it
+func lockUpload(base string) (func(), error) {
+	uploadsBusyLock.Lock()
+	defer uploadsBusyLock.Unlock()
+	if uploadsBusy[base] {
+		return nil, ErrUploadBusy
+	}
+	uploadsBusy[base] = true
+	return func() {
+		uploadsBusyLock.Lock()
+		delete(uploadsBusy, base)
+		uploadsBusyLock.Unlock()
+	}, nil
+}
+
+// AppendUpload appends the data to the upload, at offset - which must be
+// the number of bytes received so far (ErrOffsetMismatch otherwise).
+// The data received is kept even if reading it fails, so the upload can be
+// resumed from the returned upload's Offset.
+func AppendUpload(realm, id string, offset uint64, data io.Reader) (Upload, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return Upload{}, err
+	}
+	base, err := uploadBase(conf, id)
+	if err != nil {
+		return Upload{}, err
+	}
+	unlock, err := lockUpload(base)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer unlock()
+	up, err := getLockedUpload(conf, base, id)
+	if err != nil {
+		return up, err
+	}
+	if offset != up.Offset {
+		return up, ErrOffsetMismatch
+	}
+	// no more than announced (or allowed)
+	limit, limited, tooLarge := uint64(0), false, ErrTooLarge
+	if up.Length >= 0 {
+		limit, limited = uint64(up.Length), true
+	}
+	// the upload is busy (not counted as open), the received bytes are reserved
+	qlimit, quota, res, err := checkQuota(conf)
+	if err != nil {
+		return up, err
+	}
+	defer res.release()
+	if err = res.take(up.Offset); err != nil {
+		return up, err
+	}
+	if qlimit > 0 && (!limited || qlimit < limit) {
+		limit, limited = qlimit, true
+		if quota {
+			tooLarge = ErrQuotaExceeded
+		}
+	}
+	if limited {
+		if up.Offset > limit {
+			return up, tooLarge
+		}
+		data = &limitedReader{r: data, left: limit - up.Offset, err: tooLarge, res: res}
+	}
+
+	fh, err := os.OpenFile(base+".part", os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return up, err
+	}
+	n, err := io.Copy(fh, data)
+	if err == tooLarge { // drop what has been appended
+		n = 0
+		if e := fh.Truncate(int64(up.Offset)); e != nil {
+			logger.Errorf("cannot truncate %s.part: %s", base, e)
+		}
+	}
+	if e := fh.Sync(); e != nil && err == nil {
+		err = e
+	}
+	if e := fh.Close(); e != nil && err == nil {
+		err = e
+	}
+	up.Offset += uint64(n)
+	up.Updated = time.Now()
+	up.Expires = up.Updated.Add(conf.UploadExpiry)
+	return up, err
+}
+
+// FinishUpload stores the received data (as Put does) and removes the upload.
+// Returns ErrIncomplete if less data has been received than announced.
+func FinishUpload(realm, id string) (key UUID, deduplicated bool, err error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return
+	}
+	base, err := uploadBase(conf, id)
+	if err != nil {
+		return
+	}
+	unlock, err := lockUpload(base)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	up, err := getLockedUpload(conf, base, id)
+	if err != nil {
+		return
+	}
+	if up.Length >= 0 && up.Offset != uint64(up.Length) {
+		err = ErrIncomplete
+		return
+	}
+	fh, err := os.Open(base + ".part")
+	if err != nil {
+		return
+	}
+	key, deduplicated, err = PutDedup(realm, up.Info, fh)
+	_ = fh.Close()
+	if err != nil {
+		return
+	}
+	logger.Infof("upload %s of %s stored as %s", id, realm, key)
+	removeUpload(base)
+	return
+}
+
+// AbortUpload removes the upload
+func AbortUpload(realm, id string) error {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return err
+	}
+	base, err := uploadBase(conf, id)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockUpload(base)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !fileExists(base + ".part") {
+		return ErrNoUpload
+	}
+	removeUpload(base)
+	return nil
+}
+
+func removeUpload(base string) {
+	for _, suff := range []string{".part", ".meta"} {
+		if err := os.Remove(base + suff); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("cannot remove %s: %s", base+suff, err)
+		}
+	}
+}
+
+// ExpireUploads removes the uploads (and the multipart uploads' parts) of
+// the realm not appended to for UploadExpiry (upload_expiry), returns the
+// number of the removed uploads
+func ExpireUploads(realm string) (int, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return 0, err
+	}
+	if conf.UploadExpiry <= 0 {
+		return 0, nil
+	}
+	files, err := filepath.Glob(filepath.Join(conf.StagingDir, UploadsDir, "*.part"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, fn := range files {
+		id := filepath.Base(fn)
+		id = id[:len(id)-5]
+		if removeExpiredUpload(conf, id) {
+			n++
+		}
+	}
+	dirs, err := filepath.Glob(filepath.Join(conf.StagingDir, PartsDir, "*"))
+	if err != nil {
+		return n, err
+	}
+	for _, dn := range dirs {
+		if removeExpiredParts(conf, dn) {
+			n++
+		}
+	}
+	if n > 0 {
+		logger.Infof("removed %d expired uploads of %s", n, realm)
+	}
+	return n, nil
+}
+
+// removes the parts dir if it has expired and it is not busy
+func removeExpiredParts(conf Config, dn string) bool {
+	unlock, err := lockUpload(dn)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+	_, updated, err := partsSize(dn)
+	if err != nil || time.Since(updated) <= conf.UploadExpiry {
+		return false
+	}
+	if err = os.RemoveAll(dn); err != nil {
+		logger.Errorf("cannot remove %s: %s", dn, err)
+		return false
+	}
+	return true
+}
+
+// SpoolUpload copies data into a temp file in the realm's staging dir (to be
+// stored later), with the realm's size limit (ErrTooLarge, ErrQuotaExceeded)
+// enforced. The returned file is positioned at its start; the caller must
+// close and remove it.
+func SpoolUpload(realm string, data io.Reader) (*os.File, error) {
+	conf, err := ReadConf("", realm)
+	if err != nil {
+		return nil, err
+	}
+	data, res, err := limitData(conf, data)
+	if err != nil {
+		return nil, err
+	}
+	defer res.release()
+	dn := filepath.Join(conf.StagingDir, SpoolDir)
+	if err = os.MkdirAll(dn, 0755); err != nil {
+		return nil, err
+	}
+	fh, err := ioutil.TempFile(dn, "spool-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(fh, data); err == nil {
+		_, err = fh.Seek(0, 0)
+	}
+	if err != nil {
+		_ = fh.Close()
+		_ = os.Remove(fh.Name())
+		return nil, err
+	}
+	return fh, nil
+}